@@ -0,0 +1,163 @@
+package http2
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	xhttp2 "golang.org/x/net/http2"
+)
+
+// BenchmarkCompare compares the throughput of this package with golang.org/x/net/http2,
+// sending the requests from a client of the same package over a loopback TLS connection.
+//
+// Run it with `go test -run ^$ -bench Compare`.
+func BenchmarkCompare(b *testing.B) {
+	for _, size := range []struct {
+		name string
+		body []byte
+	}{
+		{"Small", []byte("Hello 21th century!\n")},
+		{"Large", bytes.Repeat([]byte("a"), 1<<20)},
+	} {
+		b.Run("fasthttp2/"+size.name, func(b *testing.B) {
+			benchmarkFastHTTP2(b, size.body)
+		})
+
+		b.Run("nethttp2/"+size.name, func(b *testing.B) {
+			benchmarkNetHTTP2(b, size.body)
+		})
+	}
+}
+
+func benchmarkTLSListener(b *testing.B) (net.Listener, *tls.Config) {
+	certPEM, keyPEM, err := fasthttp.GenerateTestCertificate("localhost")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+}
+
+func benchmarkFastHTTP2(b *testing.B, body []byte) {
+	ln, tlsConfig := benchmarkTLSListener(b)
+	defer ln.Close()
+
+	s := ConfigureServer(&fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			ctx.Write(body)
+		},
+	}, ServerConfig{})
+
+	go s.ServeTLS(ln, tlsConfig)
+
+	cl := NewClient(ln.Addr().String(), ClientOpts{
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	})
+	defer cl.Close()
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		req := fasthttp.AcquireRequest()
+		res := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseRequest(req)
+		defer fasthttp.ReleaseResponse(res)
+
+		for pb.Next() {
+			req.SetRequestURI("https://localhost/")
+
+			if err := cl.Do(req, res); err != nil {
+				b.Error(err)
+				return
+			}
+
+			if len(res.Body()) != len(body) {
+				b.Errorf("expected %d bytes, got %d", len(body), len(res.Body()))
+				return
+			}
+
+			res.Reset()
+		}
+	})
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+}
+
+func benchmarkNetHTTP2(b *testing.B, body []byte) {
+	ln, tlsConfig := benchmarkTLSListener(b)
+	defer ln.Close()
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(body)
+		}),
+		TLSConfig: tlsConfig,
+	}
+
+	if err := xhttp2.ConfigureServer(srv, &xhttp2.Server{}); err != nil {
+		b.Fatal(err)
+	}
+
+	go srv.Serve(tls.NewListener(ln, srv.TLSConfig))
+	defer srv.Close()
+
+	tr := &xhttp2.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	cl := &http.Client{Transport: tr}
+	url := "https://" + ln.Addr().String() + "/"
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			res, err := cl.Get(url)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+
+			n, err := io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+
+			if err != nil {
+				b.Error(err)
+				return
+			}
+
+			if n != int64(len(body)) {
+				b.Errorf("expected %d bytes, got %d", len(body), n)
+				return
+			}
+		}
+	})
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+}
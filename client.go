@@ -2,8 +2,12 @@ package http2
 
 import (
 	"container/list"
+	"context"
+	"crypto/tls"
 	"errors"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/valyala/fasthttp"
@@ -31,6 +35,32 @@ type ClientOpts struct {
 	// OnRTT is assigned to every client after creation, and the handler
 	// will be called after every RTT measurement (after receiving a PONG message).
 	OnRTT func(time.Duration)
+
+	// OnConnError is called every time the client fails to re-establish
+	// a dropped connection.
+	//
+	// The reconnection attempts are performed with an exponential backoff.
+	OnConnError func(error)
+
+	// OnStreamRefused is called every time a request can't get a stream right away:
+	// because the connections reached the server's SETTINGS_MAX_CONCURRENT_STREAMS,
+	// or because the server refused the stream (REFUSED_STREAM).
+	//
+	// It allows the callers to reduce the number of concurrent requests.
+	OnStreamRefused func()
+
+	// MaxConnAge is the maximum lifetime of a connection. The requests sent after
+	// a connection reached MaxConnAge are sent on a new connection, and the old one
+	// is closed once the requests in flight on it are completed.
+	//
+	// It allows the load balancers to spread the requests of long-lived clients.
+	// If MaxConnAge is 0, the connections are kept open.
+	MaxConnAge time.Duration
+
+	// TLSConfig is the tls configuration of the connections created by NewClient.
+	//
+	// If TLSConfig is nil, a default one is used. ConfigureClient uses the HostClient's TLSConfig instead.
+	TLSConfig *tls.Config
 }
 
 func (opts *ClientOpts) sanitize() {
@@ -45,11 +75,57 @@ func (opts *ClientOpts) sanitize() {
 
 // Ctx represents a context for a stream. Every stream is related to a context.
 type Ctx struct {
-	Request  *fasthttp.Request
+	Request *fasthttp.Request
+	// Response is filled while the response is received.
+	//
+	// If the response is incomplete, like when the server resets the stream,
+	// the error is sent to Err and Response keeps the headers and the partial body received.
 	Response *fasthttp.Response
 	Err      chan error
 
+	// OnHeaders is called, if set, once the response headers have been received
+	// and before the body is read.
+	//
+	// OnHeaders is called from the connection's reading goroutine, so it must not block.
+	// Discard can be called from OnHeaders to skip the body.
+	OnHeaders func(*fasthttp.Response)
+
+	// SensitiveHeaders contains the names of the request headers that must never be indexed.
+	//
+	// Those headers are encoded as literals never indexed, so they are not
+	// added to the connection's dynamic table (e.g. one-off authentication tokens).
+	// The names are matched case-insensitively.
+	SensitiveHeaders []string
+
+	conn     *Conn
 	streamID uint32
+
+	// mu protects the Response and the fields below while the response is being read.
+	mu sync.Mutex
+	// done is set once the request has been resolved.
+	done       bool
+	gotHeaders bool
+	// headerBlock keeps the header block fragments until the block is complete.
+	headerBlock []byte
+	// endStream is set once the server closed its side of the stream.
+	endStream bool
+
+	// window is the number of bytes the server allows us to send on the stream.
+	// window and sendDone are guarded by the Conn's winLck.
+	window int32
+	// sendDone is set once the request body doesn't need to be sent anymore.
+	sendDone bool
+}
+
+// isSensitive reports whether the header `k` is in SensitiveHeaders.
+func (ctx *Ctx) isSensitive(k []byte) bool {
+	for _, name := range ctx.SensitiveHeaders {
+		if strings.EqualFold(string(k), name) {
+			return true
+		}
+	}
+
+	return false
 }
 
 // resolve will resolve the context, meaning that provided an error,
@@ -60,13 +136,170 @@ func (ctx *Ctx) resolve(err error) {
 	}
 }
 
+// abort resolves the request with `err`, resetting its stream with StreamCanceled
+// if it was already sent. The request isn't sent if it's still queued.
+//
+// abort does nothing if the request has already been resolved, so the stream is released only once.
+func (ctx *Ctx) abort(err error) {
+	ctx.mu.Lock()
+
+	if ctx.done {
+		ctx.mu.Unlock()
+		return
+	}
+
+	id := atomic.LoadUint32(&ctx.streamID)
+	if id == 0 {
+		// writeRequest skips the requests already resolved.
+		ctx.done = true
+		ctx.resolve(err)
+		ctx.mu.Unlock()
+
+		return
+	}
+
+	c := ctx.conn
+	c.finish(ctx, id, err)
+	ctx.mu.Unlock()
+
+	// the frames the server sends before processing the reset are discarded.
+	c.cancel(ctx)
+}
+
+// ErrStreamDiscarded is sent to Err when the request is discarded before being completed.
+var ErrStreamDiscarded = errors.New("the stream has been discarded")
+
+// Discard stops reading the response, resetting the stream with StreamCanceled.
+//
+// The stream is released from the connection, and the rest of the frames
+// the server sends on the stream are discarded.
+// If the request wasn't completed, ErrStreamDiscarded is sent to Err.
+// Response keeps the headers and the partial body received before calling Discard.
+func (ctx *Ctx) Discard() error {
+	id := atomic.LoadUint32(&ctx.streamID)
+	if ctx.conn == nil || id == 0 {
+		return ErrStreamNotReady
+	}
+
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.done {
+		return nil
+	}
+
+	c := ctx.conn
+	c.finish(ctx, id, ErrStreamDiscarded)
+	c.cancel(ctx)
+
+	return nil
+}
+
+// Client sends the requests to a server over a pool of HTTP/2 connections.
+//
+// The Client can be used as the fasthttp.HostClient's Transport (see ConfigureClient),
+// or on its own by using NewClient.
 type Client struct {
 	d *Dialer
 
 	opts ClientOpts
 
-	lck   sync.Mutex
-	conns list.List
+	lck    sync.Mutex
+	conns  list.List
+	closed bool
+
+	// inFlight is the number of requests being sent by RoundTrip.
+	inFlight int32
+}
+
+// ErrClientClosed is returned when sending a request using a closed Client.
+var ErrClientClosed = errors.New("the client is closed")
+
+// NewClient returns a Client that sends the requests to `addr` (`host:port`).
+//
+// The connections are dialed on demand, and a new connection is created
+// when the existing ones can't open more streams.
+// The requests must contain the full URL, like `https://example.com/path`.
+func NewClient(addr string, opts ClientOpts) *Client {
+	d := &Dialer{
+		Addr:         addr,
+		PingInterval: opts.PingInterval,
+	}
+
+	// the dialer adds the h2 protocol to the config.
+	if opts.TLSConfig != nil {
+		d.TLSConfig = opts.TLSConfig.Clone()
+	}
+
+	cl := createClient(d, opts)
+	cl.conns.Init()
+
+	return cl
+}
+
+// Do sends `req` and waits for the response to be received in `res`.
+func (cl *Client) Do(req *fasthttp.Request, res *fasthttp.Response) error {
+	retry, err := cl.RoundTrip(nil, req, res)
+	if err != nil && retry {
+		// the request wasn't processed, so it can be sent on another connection.
+		_, err = cl.RoundTrip(nil, req, res)
+	}
+
+	return err
+}
+
+// Close closes all the connections of the client, sending a GOAWAY on each of them.
+//
+// The requests in flight fail, and the requests sent after Close return ErrClientClosed.
+// To wait for the requests in flight use Shutdown.
+func (cl *Client) Close() error {
+	cl.lck.Lock()
+
+	cl.closed = true
+
+	var conns []*Conn
+	for e := cl.conns.Front(); e != nil; e = e.Next() {
+		conns = append(conns, e.Value.(*Conn))
+	}
+
+	cl.conns.Init()
+	cl.lck.Unlock()
+
+	// the connections are closed without the lock, as Close calls onConnectionDropped.
+	for _, c := range conns {
+		_ = c.Close()
+	}
+
+	return nil
+}
+
+// Shutdown closes the client gracefully: the requests sent after Shutdown return ErrClientClosed,
+// and the connections are closed as in Close once the requests in flight are completed.
+//
+// If `ctx` is done before the requests in flight are completed, the connections
+// are closed anyway and Shutdown returns the ctx's error.
+func (cl *Client) Shutdown(ctx context.Context) error {
+	cl.lck.Lock()
+	// the dropped connections are not reconnected anymore.
+	cl.closed = true
+	cl.lck.Unlock()
+
+	ticker := time.NewTicker(streamsCheckInterval)
+	defer ticker.Stop()
+
+	var err error
+
+	for err == nil && atomic.LoadInt32(&cl.inFlight) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	_ = cl.Close()
+
+	return err
 }
 
 func createClient(d *Dialer, opts ClientOpts) *Client {
@@ -80,6 +313,15 @@ func createClient(d *Dialer, opts ClientOpts) *Client {
 	return cl
 }
 
+// reconnect backoff parameters.
+//
+// If all the attempts fail, the connections will be created on demand by RoundTrip.
+var (
+	reconnectMinBackoff  = time.Millisecond * 100
+	reconnectMaxBackoff  = time.Second * 5
+	reconnectMaxAttempts = 5
+)
+
 func (cl *Client) onConnectionDropped(c *Conn) {
 	cl.lck.Lock()
 	defer cl.lck.Unlock()
@@ -88,13 +330,46 @@ func (cl *Client) onConnectionDropped(c *Conn) {
 		if e.Value.(*Conn) == c {
 			cl.conns.Remove(e)
 
-			_, _, _ = cl.createConn()
+			if !cl.closed {
+				go cl.reconnect()
+			}
 
 			break
 		}
 	}
 }
 
+// reconnect tries to create a new connection, doubling the
+// wait time between attempts after every failure.
+func (cl *Client) reconnect() {
+	backoff, maxBackoff := reconnectMinBackoff, reconnectMaxBackoff
+
+	for i, attempts := 0, reconnectMaxAttempts; i < attempts; i++ {
+		cl.lck.Lock()
+		if cl.closed {
+			cl.lck.Unlock()
+			return
+		}
+
+		_, _, err := cl.createConn()
+		cl.lck.Unlock()
+
+		if err == nil {
+			return
+		}
+
+		if cl.opts.OnConnError != nil {
+			cl.opts.OnConnError(err)
+		}
+
+		time.Sleep(backoff)
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
 func (cl *Client) createConn() (*Conn, *list.Element, error) {
 	c, err := cl.d.Dial(ConnOpts{
 		PingInterval: cl.d.PingInterval,
@@ -109,25 +384,67 @@ func (cl *Client) createConn() (*Conn, *list.Element, error) {
 
 var ErrRequestCanceled = errors.New("request timed out")
 
-func (cl *Client) RoundTrip(_ *fasthttp.HostClient, req *fasthttp.Request, res *fasthttp.Response) (retry bool, err error) {
-	var c *Conn
+// streamsCheckInterval defines how often a server which doesn't allow
+// opening streams is checked again.
+var streamsCheckInterval = time.Millisecond * 100
+
+// getConn returns a connection that can open a new stream.
+//
+// If a connection doesn't allow opening streams (SETTINGS_MAX_CONCURRENT_STREAMS=0),
+// no new connections are created and ErrStreamsNotAllowed is returned.
+func (cl *Client) getConn() (*Conn, error) {
+	c, saturated, err := cl.findConn()
+	if saturated {
+		cl.streamRefused()
+	}
+
+	return c, err
+}
+
+// streamRefused calls OnStreamRefused, if set.
+func (cl *Client) streamRefused() {
+	if cl.opts.OnStreamRefused != nil {
+		cl.opts.OnStreamRefused()
+	}
+}
+
+// findConn implements getConn, reporting whether any connection couldn't open more streams.
+func (cl *Client) findConn() (c *Conn, saturated bool, err error) {
+	var (
+		next       *list.Element
+		notAllowed bool
+	)
 
 	cl.lck.Lock()
+	defer cl.lck.Unlock()
 
-	var next *list.Element
+	if cl.closed {
+		return nil, false, ErrClientClosed
+	}
 
 	for e := cl.conns.Front(); c == nil; e = next {
 		if e != nil {
 			c = e.Value.(*Conn)
 		} else {
+			// the server will most likely advertise the same settings on a new connection.
+			if notAllowed {
+				return nil, saturated, ErrStreamsNotAllowed
+			}
+
 			c, e, err = cl.createConn()
 			if err != nil {
-				return false, err
+				return nil, saturated, err
+			}
+
+			if !c.StreamsAllowed() {
+				return nil, saturated, ErrStreamsNotAllowed
 			}
 		}
 
 		// if we can't open a stream, then move on to the next one.
 		if !c.CanOpenStream() {
+			notAllowed = notAllowed || !c.StreamsAllowed()
+			saturated = true
 			c = nil
 			next = e.Next()
 		}
@@ -138,15 +455,97 @@ func (cl *Client) RoundTrip(_ *fasthttp.HostClient, req *fasthttp.Request, res *
 			cl.conns.Remove(e)
 			c = nil
 		}
+
+		// the connection is rotated, so the next request dials a new one.
+		if c != nil && cl.opts.MaxConnAge > 0 && time.Since(c.createdAt) >= cl.opts.MaxConnAge {
+			next = e.Next()
+			cl.conns.Remove(e)
+
+			go drainConn(c)
+
+			c = nil
+		}
 	}
 
-	cl.lck.Unlock()
+	return c, saturated, nil
+}
+
+// drainConn closes `c` once the requests in flight on it are completed.
+func drainConn(c *Conn) {
+	ticker := time.NewTicker(streamsCheckInterval)
+	defer ticker.Stop()
+
+	// the requests taken from the pool before rotating `c` might still be queued.
+	for !c.Closed() {
+		<-ticker.C
+
+		if atomic.LoadInt32(&c.openStreams) == 0 && len(c.in) == 0 {
+			break
+		}
+	}
+
+	_ = c.Close()
+}
+
+// waitConn checks every streamsCheckInterval whether the server allows opening streams again.
+//
+// If it doesn't within MaxResponseTime, ErrStreamsNotAllowed is returned.
+func (cl *Client) waitConn() (*Conn, error) {
+	if cl.opts.MaxResponseTime <= 0 {
+		return nil, ErrStreamsNotAllowed
+	}
+
+	ticker := time.NewTicker(streamsCheckInterval)
+	defer ticker.Stop()
+
+	deadline := time.Now().Add(cl.opts.MaxResponseTime)
+
+	for time.Now().Before(deadline) {
+		<-ticker.C
+
+		c, err := cl.getConn()
+		if !errors.Is(err, ErrStreamsNotAllowed) {
+			return c, err
+		}
+	}
+
+	return nil, ErrStreamsNotAllowed
+}
+
+// RoundTrip sends `req` and waits for the response to be received in `res`.
+//
+// `retry` is true if the request wasn't processed by the server, like when it wasn't sent
+// or its stream is above the last one processed according to the server's GOAWAY (see Conn.GoAway).
+func (cl *Client) RoundTrip(hc *fasthttp.HostClient, req *fasthttp.Request, res *fasthttp.Response) (retry bool, err error) {
+	return cl.RoundTripContext(context.Background(), hc, req, res)
+}
+
+// RoundTripContext is like RoundTrip, but the request is canceled once `ctx` is done.
+//
+// If the request was already sent, its stream is reset with StreamCanceled
+// and the ctx's error is returned. Response keeps the partial response received.
+func (cl *Client) RoundTripContext(ctx context.Context, _ *fasthttp.HostClient, req *fasthttp.Request, res *fasthttp.Response) (retry bool, err error) {
+	atomic.AddInt32(&cl.inFlight, 1)
+	defer atomic.AddInt32(&cl.inFlight, -1)
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	c, err := cl.getConn()
+	if errors.Is(err, ErrStreamsNotAllowed) {
+		c, err = cl.waitConn()
+	}
+
+	if err != nil {
+		return false, err
+	}
 
 	ch := make(chan error, 1)
 
 	var cancelTimer *time.Timer
 
-	ctx := &Ctx{
+	rctx := &Ctx{
 		Request:  req,
 		Response: res,
 		Err:      ch,
@@ -154,25 +553,40 @@ func (cl *Client) RoundTrip(_ *fasthttp.HostClient, req *fasthttp.Request, res *
 
 	if cl.opts.MaxResponseTime > 0 {
 		cancelTimer = time.AfterFunc(cl.opts.MaxResponseTime, func() {
-			select {
-			case ch <- ErrRequestCanceled:
-			}
-
-			c.cancel(ctx)
+			rctx.abort(ErrRequestCanceled)
 		})
 	}
 
-	c.Write(ctx)
+	if err = c.Write(rctx); err != nil {
+		if cancelTimer != nil {
+			cancelTimer.Stop()
+		}
+
+		// the request wasn't sent, so it can be retried on another connection.
+		return true, err
+	}
 
 	select {
 	case err = <-ch:
+	case <-ctx.Done():
+		rctx.abort(ctx.Err())
+		// the response might have been completed before aborting.
+		err = <-ch
 	}
 
 	if cancelTimer != nil {
 		cancelTimer.Stop()
 	}
 
-	close(ch)
+	// the stream slots might have been taken after choosing the connection.
+	if errors.Is(err, ErrNotAvailableStreams) || errors.Is(err, RefusedStreamError) {
+		cl.streamRefused()
+	}
+
+	// the streams above the last one processed by the server can be sent on another connection.
+	if ga := c.GoAway(); err != nil && ga != nil && atomic.LoadUint32(&rctx.streamID) > ga.Stream() {
+		return true, err
+	}
 
 	return false, err
 }
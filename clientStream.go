@@ -0,0 +1,510 @@
+package http2
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// StreamFrame is the content received on a ClientStream.
+type StreamFrame struct {
+	// Headers contains the decoded fields of a header block.
+	//
+	// The fields can be released using ReleaseHeaderField once they are no longer needed.
+	Headers []*HeaderField
+
+	// Data contains the payload of a DATA frame.
+	Data []byte
+
+	// EndStream reports whether the server closed its side of the stream.
+	EndStream bool
+
+	// flow is the size accounted by the flow control, including the padding.
+	flow int
+}
+
+// ClientStream is a low-level stream opened using Conn.OpenStream.
+//
+// It allows exchanging headers and data with the server
+// without using the fasthttp Request/Response model.
+//
+// Reading and writing can be performed concurrently, each direction
+// having its own flow control window: the writes block until the server
+// allows sending more data, and the server is only allowed to send
+// more data once the frames are consumed using Read.
+// Concurrent writes on the same stream are not supported.
+type ClientStream struct {
+	c *Conn
+
+	// id is assigned when the first header block is written,
+	// so the stream identifiers are always sent in increasing order.
+	id uint32
+
+	lck    sync.Mutex
+	cond   sync.Cond
+	frames []*StreamFrame
+	err    error
+	// window is the number of bytes the server allows us to send,
+	// guarded by the connection's winLck like the connection window.
+	window int32
+
+	// pending is the header block being received (only accessed by the readLoop).
+	pending *StreamFrame
+	// block keeps the header block fragments until the block is complete.
+	block []byte
+
+	localClosed  bool
+	remoteClosed bool
+	released     bool
+}
+
+// OpenStream reserves a new stream in the connection.
+//
+// The stream is sent to the server with the first call to WriteHeaders.
+// Frames received on the stream must be consumed calling Read,
+// otherwise they are kept in memory until the stream is closed.
+func (c *Conn) OpenStream() (*ClientStream, error) {
+	if c.Closed() {
+		return nil, io.EOF
+	}
+
+	if !c.StreamsAllowed() {
+		return nil, ErrStreamsNotAllowed
+	}
+
+	if !c.CanOpenStream() {
+		return nil, ErrNotAvailableStreams
+	}
+
+	atomic.AddInt32(&c.openStreams, 1)
+
+	cs := &ClientStream{c: c}
+	cs.cond.L = &cs.lck
+
+	return cs, nil
+}
+
+// ID returns the stream identifier, or 0 if no header block was written yet.
+func (cs *ClientStream) ID() uint32 {
+	return atomic.LoadUint32(&cs.id)
+}
+
+// WriteHeaders encodes and writes `hfs` as a header block.
+//
+// If endStream is true, the client's side of the stream gets closed.
+func (cs *ClientStream) WriteHeaders(hfs []*HeaderField, endStream bool) error {
+	c := cs.c
+
+	c.wlck.Lock()
+	defer c.wlck.Unlock()
+
+	if err := cs.writable(); err != nil {
+		return err
+	}
+
+	if cs.id == 0 {
+		c.winLck.Lock()
+		cs.window = atomic.LoadInt32(&c.serverStreamWindow)
+		c.winLck.Unlock()
+
+		atomic.StoreUint32(&cs.id, c.nextID)
+		c.nextID += 2
+
+		c.streams.Store(cs.id, cs)
+	}
+
+	fr := AcquireFrameHeader()
+	defer ReleaseFrameHeader(fr)
+
+	fr.SetStream(cs.id)
+
+	h := AcquireFrame(FrameHeaders).(*Headers)
+	fr.SetBody(h)
+
+	for _, hf := range hfs {
+		c.enc.AppendHeaderField(h, hf, true)
+	}
+
+	h.SetPadding(false)
+	h.SetEndStream(endStream)
+	h.SetEndHeaders(true)
+
+	_, err := fr.WriteTo(c.bw)
+	if err == nil {
+		err = c.bw.Flush()
+	}
+
+	return cs.wrote(endStream, err)
+}
+
+// WriteData writes `b` as DATA frames.
+//
+// WriteData blocks while the server's flow control window for the stream is exhausted.
+// If endStream is true, the client's side of the stream gets closed.
+func (cs *ClientStream) WriteData(b []byte, endStream bool) error {
+	if err := cs.writable(); err != nil {
+		return err
+	}
+
+	if cs.ID() == 0 {
+		return ErrStreamNotReady
+	}
+
+	for {
+		n, err := cs.reserve(len(b))
+		if err != nil {
+			return err
+		}
+
+		err = cs.writeData(b[:n], endStream && n == len(b))
+		if err != nil {
+			return cs.wrote(false, err)
+		}
+
+		if b = b[n:]; len(b) == 0 {
+			break
+		}
+	}
+
+	return cs.wrote(endStream, nil)
+}
+
+// reserve waits until the stream's and the connection's windows allow sending data,
+// and returns how many bytes of the `n` requested can be sent in the next frame.
+func (cs *ClientStream) reserve(n int) (int, error) {
+	c := cs.c
+
+	c.winLck.Lock()
+	defer c.winLck.Unlock()
+
+	for n > 0 && (c.serverWindow <= 0 || cs.window <= 0) && cs.failed() == nil && !c.Closed() {
+		c.winCond.Wait()
+	}
+
+	if err := cs.failed(); err != nil {
+		return 0, err
+	}
+
+	if c.Closed() {
+		return 0, io.EOF
+	}
+
+	for _, win := range [...]int32{c.serverWindow, cs.window, c.dataFrameSize()} {
+		if n > int(win) {
+			n = int(win)
+		}
+	}
+
+	c.serverWindow -= int32(n)
+	cs.window -= int32(n)
+
+	return n, nil
+}
+
+// failed returns the error the stream failed with, if any.
+func (cs *ClientStream) failed() error {
+	cs.lck.Lock()
+	defer cs.lck.Unlock()
+
+	return cs.err
+}
+
+func (cs *ClientStream) writeData(b []byte, endStream bool) error {
+	c := cs.c
+
+	c.wlck.Lock()
+	defer c.wlck.Unlock()
+
+	fr := AcquireFrameHeader()
+	defer ReleaseFrameHeader(fr)
+
+	fr.SetStream(cs.id)
+
+	data := AcquireFrame(FrameData).(*Data)
+	data.SetEndStream(endStream)
+	data.SetPadding(false)
+	data.SetData(b)
+
+	fr.SetBody(data)
+
+	_, err := fr.WriteTo(c.bw)
+	if err == nil {
+		err = c.bw.Flush()
+	}
+
+	return err
+}
+
+// Read returns the next frame received on the stream.
+//
+// Read returns io.EOF after the server closed its side of the stream,
+// or an Error if the stream was reset.
+func (cs *ClientStream) Read() (*StreamFrame, error) {
+	cs.lck.Lock()
+	defer cs.lck.Unlock()
+
+	for len(cs.frames) == 0 && cs.err == nil && !cs.remoteClosed {
+		cs.cond.Wait()
+	}
+
+	if len(cs.frames) == 0 {
+		if cs.err != nil {
+			return nil, cs.err
+		}
+
+		return nil, io.EOF
+	}
+
+	sf := cs.frames[0]
+	cs.frames[0] = nil
+	cs.frames = cs.frames[1:]
+
+	// no more data will be received once the server closed its side.
+	if sf.flow == 0 || cs.remoteClosed || cs.err != nil {
+		return sf, nil
+	}
+
+	cs.lck.Unlock()
+	err := cs.updateWindow(sf.flow)
+	cs.lck.Lock()
+
+	return sf, err
+}
+
+// updateWindow allows the server to send `n` more bytes on the stream.
+func (cs *ClientStream) updateWindow(n int) error {
+	c := cs.c
+
+	c.wlck.Lock()
+	defer c.wlck.Unlock()
+
+	fr := AcquireFrameHeader()
+	defer ReleaseFrameHeader(fr)
+
+	fr.SetStream(cs.id)
+
+	wu := AcquireFrame(FrameWindowUpdate).(*WindowUpdate)
+	wu.SetIncrement(n)
+
+	fr.SetBody(wu)
+
+	_, err := fr.WriteTo(c.bw)
+	if err == nil {
+		err = c.bw.Flush()
+	}
+
+	return err
+}
+
+// Close closes the client's side of the stream, if it wasn't closed already.
+//
+// The frames sent by the server can still be read after calling Close.
+func (cs *ClientStream) Close() error {
+	cs.lck.Lock()
+	done := cs.localClosed || cs.err != nil
+	cs.lck.Unlock()
+
+	if done || cs.ID() == 0 {
+		if !done {
+			cs.fail(ErrStreamClosed)
+		}
+
+		return nil
+	}
+
+	return cs.WriteData(nil, true)
+}
+
+// Reset resets the stream sending a RST_STREAM frame with `code`.
+func (cs *ClientStream) Reset(code ErrorCode) error {
+	c := cs.c
+
+	c.wlck.Lock()
+	defer c.wlck.Unlock()
+
+	cs.fail(NewResetStreamError(code, "stream reset by the client"))
+
+	if cs.id == 0 {
+		return nil
+	}
+
+	fr := AcquireFrameHeader()
+	defer ReleaseFrameHeader(fr)
+
+	fr.SetStream(cs.id)
+
+	rst := AcquireFrame(FrameResetStream).(*RstStream)
+	rst.SetCode(code)
+
+	fr.SetBody(rst)
+
+	_, err := fr.WriteTo(c.bw)
+	if err == nil {
+		err = c.bw.Flush()
+	}
+
+	return err
+}
+
+// writable returns an error if no more frames can be written on the stream.
+func (cs *ClientStream) writable() error {
+	cs.lck.Lock()
+	defer cs.lck.Unlock()
+
+	if cs.err != nil {
+		return cs.err
+	}
+
+	if cs.localClosed {
+		return ErrStreamClosed
+	}
+
+	return nil
+}
+
+// wrote updates the stream state after writing a frame.
+func (cs *ClientStream) wrote(endStream bool, err error) error {
+	if err != nil {
+		cs.c.lastErr = err
+		cs.fail(err)
+
+		return err
+	}
+
+	if endStream {
+		cs.lck.Lock()
+		cs.localClosed = true
+		cs.releaseIfClosed()
+		cs.lck.Unlock()
+	}
+
+	return nil
+}
+
+// push queues `sf` to be read.
+func (cs *ClientStream) push(sf *StreamFrame) {
+	cs.lck.Lock()
+	defer cs.lck.Unlock()
+
+	if cs.err != nil {
+		return
+	}
+
+	cs.frames = append(cs.frames, sf)
+
+	if sf.EndStream {
+		cs.remoteClosed = true
+		cs.releaseIfClosed()
+	}
+
+	cs.cond.Broadcast()
+}
+
+// addWindow increases the window of the stream by `n`, which might be negative.
+func (cs *ClientStream) addWindow(n int32) {
+	c := cs.c
+
+	c.winLck.Lock()
+	defer c.winLck.Unlock()
+
+	cs.window += n
+
+	c.winCond.Broadcast()
+}
+
+// fail makes the next reads and writes on the stream return `err`.
+func (cs *ClientStream) fail(err error) {
+	cs.lck.Lock()
+
+	if cs.err == nil {
+		cs.err = err
+	}
+
+	cs.release()
+
+	cs.cond.Broadcast()
+	cs.lck.Unlock()
+
+	// wake up the writes waiting for the windows to be updated.
+	cs.c.winLck.Lock()
+	cs.c.winCond.Broadcast()
+	cs.c.winLck.Unlock()
+}
+
+func (cs *ClientStream) releaseIfClosed() {
+	if cs.localClosed && cs.remoteClosed {
+		cs.release()
+	}
+}
+
+// release frees the stream slot in the connection.
+func (cs *ClientStream) release() {
+	if cs.released {
+		return
+	}
+
+	cs.released = true
+
+	atomic.AddInt32(&cs.c.openStreams, -1)
+
+	if id := atomic.LoadUint32(&cs.id); id != 0 {
+		cs.c.streams.Delete(id)
+	}
+}
+
+// readClientStream handles a frame received on a ClientStream.
+func (c *Conn) readClientStream(fr *FrameHeader, cs *ClientStream) error {
+	switch fr.Type() {
+	case FrameHeaders, FrameContinuation:
+		if cs.pending == nil {
+			cs.pending = &StreamFrame{}
+		}
+
+		if fr.Flags().Has(FlagEndStream) {
+			cs.pending.EndStream = true
+		}
+
+		// the header fields can be split between the frames of the block.
+		cs.block = append(cs.block, fr.Body().(FrameWithHeaders).Headers()...)
+		if !fr.Flags().Has(FlagEndHeaders) {
+			break
+		}
+
+		for b := cs.block; len(b) > 0; {
+			hf := AcquireHeaderField()
+
+			var err error
+
+			b, err = c.dec.Next(hf, b)
+			if err != nil {
+				ReleaseHeaderField(hf)
+				return err
+			}
+
+			cs.pending.Headers = append(cs.pending.Headers, hf)
+		}
+
+		sf := cs.pending
+		cs.pending, cs.block = nil, cs.block[:0]
+
+		cs.push(sf)
+	case FrameData:
+		data := fr.Body().(*Data)
+
+		cs.push(&StreamFrame{
+			Data:      append([]byte(nil), data.Data()...),
+			EndStream: data.EndStream(),
+			flow:      fr.Len(),
+		})
+
+		c.consumeData(fr)
+	case FrameWindowUpdate:
+		cs.addWindow(int32(fr.Body().(*WindowUpdate).Increment()))
+	case FrameResetStream:
+		code := fr.Body().(*RstStream).Code()
+
+		cs.fail(NewResetStreamError(code, "stream reset by the server"))
+	}
+
+	return nil
+}
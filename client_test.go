@@ -0,0 +1,631 @@
+package http2
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestClientReconnectBackoff(t *testing.T) {
+	defer func(min time.Duration, attempts int) {
+		reconnectMinBackoff, reconnectMaxAttempts = min, attempts
+	}(reconnectMinBackoff, reconnectMaxAttempts)
+
+	reconnectMinBackoff = time.Millisecond * 20
+	reconnectMaxAttempts = 4
+
+	errDial := errors.New("unreachable")
+
+	var (
+		lck   sync.Mutex
+		calls []time.Time
+		errs  int
+		done  = make(chan struct{})
+	)
+
+	d := &Dialer{
+		Addr: "localhost:0",
+		NetDial: func(string) (net.Conn, error) {
+			lck.Lock()
+			calls = append(calls, time.Now())
+			lck.Unlock()
+
+			return nil, errDial
+		},
+	}
+
+	cl := createClient(d, ClientOpts{
+		OnConnError: func(err error) {
+			if !errors.Is(err, errDial) {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			lck.Lock()
+			errs++
+			if errs == reconnectMaxAttempts {
+				close(done)
+			}
+			lck.Unlock()
+		},
+	})
+
+	c := &Conn{}
+	cl.conns.PushBack(c)
+
+	cl.onConnectionDropped(c)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("OnConnError wasn't called")
+	}
+
+	// wait for the last backoff to make sure there are no more attempts
+	time.Sleep(reconnectMinBackoff << reconnectMaxAttempts)
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	if len(calls) != reconnectMaxAttempts {
+		t.Fatalf("expected %d attempts, got %d", reconnectMaxAttempts, len(calls))
+	}
+
+	for i := 1; i < len(calls); i++ {
+		expected := reconnectMinBackoff << (i - 1)
+		if elapsed := calls[i].Sub(calls[i-1]); elapsed < expected {
+			t.Fatalf("attempt %d was performed after %s, expected at least %s", i, elapsed, expected)
+		}
+	}
+}
+
+func TestClientDo(t *testing.T) {
+	certPEM, keyPEM, err := fasthttp.GenerateTestCertificate("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := ConfigureServer(&fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			ctx.Write(ctx.Path())
+		},
+	}, ServerConfig{})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go s.ServeTLS(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+
+	cl := NewClient(ln.Addr().String(), ClientOpts{
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	})
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			req := fasthttp.AcquireRequest()
+			res := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseRequest(req)
+			defer fasthttp.ReleaseResponse(res)
+
+			path := "/" + strconv.Itoa(i)
+			req.SetRequestURI("https://localhost" + path)
+
+			if err := cl.Do(req, res); err != nil {
+				t.Error(err)
+				return
+			}
+
+			if string(res.Body()) != path {
+				t.Errorf("expected %q, got %q", path, res.Body())
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	// the requests are multiplexed over the same connection.
+	if n := cl.conns.Len(); n != 1 {
+		t.Fatalf("expected 1 connection, got %d", n)
+	}
+
+	cl.Close()
+
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.SetRequestURI("https://localhost/")
+
+	if err := cl.Do(req, res); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("expected ErrClientClosed, got %v", err)
+	}
+}
+
+func TestClientShutdown(t *testing.T) {
+	certPEM, keyPEM, err := fasthttp.GenerateTestCertificate("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := ConfigureServer(&fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			d, _ := time.ParseDuration(string(ctx.Path()[1:]))
+			time.Sleep(d)
+
+			ctx.WriteString("done")
+		},
+	}, ServerConfig{
+		MaxHandlerWorkers: 4,
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go s.ServeTLS(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+
+	for _, test := range []struct {
+		name    string
+		delay   string
+		timeout time.Duration
+		err     error
+	}{
+		{"Drained", "200ms", time.Second * 5, nil},
+		{"Deadline", "2s", time.Millisecond * 100, context.DeadlineExceeded},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cl := NewClient(ln.Addr().String(), ClientOpts{
+				TLSConfig: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+			})
+
+			reqErr := make(chan error, 1)
+
+			go func() {
+				req := fasthttp.AcquireRequest()
+				res := fasthttp.AcquireResponse()
+				defer fasthttp.ReleaseRequest(req)
+				defer fasthttp.ReleaseResponse(res)
+
+				req.SetRequestURI("https://localhost/" + test.delay)
+
+				err := cl.Do(req, res)
+				if err == nil && string(res.Body()) != "done" {
+					err = fmt.Errorf("unexpected body %q", res.Body())
+				}
+
+				reqErr <- err
+			}()
+
+			// wait for the request to be sent.
+			for atomic.LoadInt32(&cl.inFlight) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+
+			if err := cl.Shutdown(ctx); !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+
+			select {
+			case err := <-reqErr:
+				if (err == nil) != (test.err == nil) {
+					t.Fatalf("unexpected request error: %v", err)
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatal("the request wasn't completed")
+			}
+
+			if n := cl.conns.Len(); n != 0 {
+				t.Fatalf("expected the connections to be closed, got %d", n)
+			}
+
+			req := fasthttp.AcquireRequest()
+			res := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseRequest(req)
+			defer fasthttp.ReleaseResponse(res)
+
+			req.SetRequestURI("https://localhost/")
+
+			if err := cl.Do(req, res); !errors.Is(err, ErrClientClosed) {
+				t.Fatalf("expected ErrClientClosed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestClientRoundTripContext(t *testing.T) {
+	certPEM, keyPEM, err := fasthttp.GenerateTestCertificate("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := ConfigureServer(&fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			d, _ := time.ParseDuration(string(ctx.Path()[1:]))
+			time.Sleep(d)
+
+			ctx.WriteString("done")
+		},
+	}, ServerConfig{
+		MaxHandlerWorkers: 4,
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go s.ServeTLS(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+
+	cl := NewClient(ln.Addr().String(), ClientOpts{
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	})
+	defer cl.Close()
+
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	req.SetRequestURI("https://localhost/1s")
+
+	start := time.Now()
+
+	if _, err := cl.RoundTripContext(ctx, nil, req, res); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Fatalf("the request was canceled after %s", elapsed)
+	}
+
+	c := cl.conns.Front().Value.(*Conn)
+
+	// the stream is released once, even if the response arrives after the cancellation.
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(i))
+
+		req.SetRequestURI("https://localhost/" + strconv.Itoa(i) + "ms")
+		_, _ = cl.RoundTripContext(ctx, nil, req, res)
+
+		cancel()
+	}
+
+	if n := c.Info().OpenStreams; n != 0 {
+		t.Fatalf("expected 0 open streams, got %d", n)
+	}
+
+	// a canceled context isn't sent.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := cl.RoundTripContext(ctx, nil, req, res); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	req.SetRequestURI("https://localhost/0s")
+	res.Reset()
+
+	if err := cl.Do(req, res); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(res.Body()) != "done" {
+		t.Fatalf("unexpected body %q", res.Body())
+	}
+
+	if n := c.Info().OpenStreams; n != 0 {
+		t.Fatalf("expected 0 open streams, got %d", n)
+	}
+}
+
+func TestClientOnStreamRefused(t *testing.T) {
+	certPEM, keyPEM, err := fasthttp.GenerateTestCertificate("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := ConfigureServer(&fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			time.Sleep(time.Millisecond * 200)
+		},
+	}, ServerConfig{
+		MaxConcurrentStreams: 1,
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go s.ServeTLS(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+
+	var refused int32
+
+	cl := NewClient(ln.Addr().String(), ClientOpts{
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		OnStreamRefused: func() {
+			atomic.AddInt32(&refused, 1)
+		},
+	})
+	defer cl.Close()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			req := fasthttp.AcquireRequest()
+			res := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseRequest(req)
+			defer fasthttp.ReleaseResponse(res)
+
+			req.SetRequestURI("https://localhost/")
+
+			if err := cl.Do(req, res); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		// let the previous request take the only stream slot.
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&refused); n == 0 {
+		t.Fatal("OnStreamRefused wasn't called")
+	}
+}
+
+func TestClientReconnectHPACK(t *testing.T) {
+	certPEM, keyPEM, err := fasthttp.GenerateTestCertificate("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := ConfigureServer(&fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			ctx.Write(ctx.Request.Header.Peek("X-Token"))
+		},
+	}, ServerConfig{})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go s.ServeTLS(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+
+	cl := NewClient(ln.Addr().String(), ClientOpts{
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	})
+	defer cl.Close()
+
+	do := func(token string) {
+		t.Helper()
+
+		req := fasthttp.AcquireRequest()
+		res := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseRequest(req)
+		defer fasthttp.ReleaseResponse(res)
+
+		req.SetRequestURI("https://localhost/")
+		req.Header.Set("X-Token", token)
+
+		if err := cl.Do(req, res); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(res.Body()) != token {
+			t.Fatalf("expected %q, got %q", token, res.Body())
+		}
+	}
+
+	// the fields get indexed in the dynamic table of the first connection.
+	do("first")
+	do("first")
+
+	cl.lck.Lock()
+	c := cl.conns.Front().Value.(*Conn)
+	cl.lck.Unlock()
+
+	c.Close()
+
+	// a new connection must not refer to the indices of the closed one.
+	for _, token := range []string{"first", "second", "second"} {
+		do(token)
+	}
+
+	cl.lck.Lock()
+	defer cl.lck.Unlock()
+
+	for e := cl.conns.Front(); e != nil; e = e.Next() {
+		if nc := e.Value.(*Conn); nc == c || nc.enc == c.enc {
+			t.Fatal("the closed connection is still being used")
+		}
+	}
+}
+
+func TestClientMaxConnAge(t *testing.T) {
+	certPEM, keyPEM, err := fasthttp.GenerateTestCertificate("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := ConfigureServer(&fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			d, _ := time.ParseDuration(string(ctx.Path()[1:]))
+			time.Sleep(d)
+
+			ctx.WriteString("done")
+		},
+	}, ServerConfig{
+		MaxHandlerWorkers: 4,
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go s.ServeTLS(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+
+	cl := NewClient(ln.Addr().String(), ClientOpts{
+		MaxConnAge: time.Millisecond * 100,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	})
+	defer cl.Close()
+
+	do := func(path string) error {
+		req := fasthttp.AcquireRequest()
+		res := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseRequest(req)
+		defer fasthttp.ReleaseResponse(res)
+
+		req.SetRequestURI("https://localhost/" + path)
+
+		err := cl.Do(req, res)
+		if err == nil && string(res.Body()) != "done" {
+			err = fmt.Errorf("unexpected body %q", res.Body())
+		}
+
+		return err
+	}
+
+	reqErr := make(chan error, 1)
+
+	go func() {
+		reqErr <- do("500ms")
+	}()
+
+	// wait for the request to be sent.
+	for atomic.LoadInt32(&cl.inFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cl.lck.Lock()
+	old := cl.conns.Front().Value.(*Conn)
+	cl.lck.Unlock()
+
+	time.Sleep(time.Millisecond * 150)
+
+	if err := do("0s"); err != nil {
+		t.Fatal(err)
+	}
+
+	cl.lck.Lock()
+	if n := cl.conns.Len(); n != 1 || cl.conns.Front().Value.(*Conn) == old {
+		cl.lck.Unlock()
+		t.Fatalf("the connection wasn't rotated: %d connections", n)
+	}
+	cl.lck.Unlock()
+
+	if old.Closed() {
+		t.Fatal("the connection was closed with a request in flight")
+	}
+
+	// the request in flight is completed on the old connection.
+	select {
+	case err := <-reqErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("the request wasn't completed")
+	}
+
+	for i := 0; !old.Closed(); i++ {
+		if i == 100 {
+			t.Fatal("the old connection wasn't closed")
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
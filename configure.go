@@ -3,7 +3,6 @@ package http2
 import (
 	"crypto/tls"
 	"errors"
-	"net"
 
 	"github.com/valyala/fasthttp"
 )
@@ -23,18 +22,16 @@ func configureDialer(d *Dialer) {
 
 	emptyServerName := tlsConfig.ServerName == ""
 	if emptyServerName {
-		host, _, err := net.SplitHostPort(d.Addr)
-		if err != nil {
-			host = d.Addr
-		}
-
-		tlsConfig.ServerName = host
+		_, tlsConfig.ServerName = dialAddr(d.Addr)
 	}
 
 	tlsConfig.NextProtos = append(tlsConfig.NextProtos, "h2")
 }
 
 // ConfigureClient configures the fasthttp.HostClient to run over HTTP/2.
+//
+// The HostClient's Transport is set to a *Client, which must be closed
+// once the HostClient isn't used anymore, like `hc.Transport.(*http2.Client).Close()`.
 func ConfigureClient(c *fasthttp.HostClient, opts ClientOpts) error {
 	emptyServerName := c.TLSConfig != nil && c.TLSConfig.ServerName == ""
 
@@ -76,7 +73,7 @@ func ConfigureClient(c *fasthttp.HostClient, opts ClientOpts) error {
 // HTTP/2 connections. The HTTP/2 connection can be only
 // established if the fasthttp server is using TLS.
 //
-// Future implementations may support HTTP/2 through plain TCP.
+// To serve HTTP/2 over plain TCP (h2c) see Server.ServeConnH2C and Server.H2CUpgrade.
 //
 // This package currently supports the following fasthttp.Server settings:
 //   - Handler: Obviously, the handler is taken from the Server.
@@ -87,6 +84,11 @@ func ConfigureClient(c *fasthttp.HostClient, opts ClientOpts) error {
 //     To disable the option you can set it to zero. No value is taken by default,
 //     which means that by default ALL connections are open until either endpoint
 //     closes the connection.
+//   - MaxRequestBodySize: Limits the SETTINGS_INITIAL_WINDOW_SIZE, so the clients can't
+//     send more data on a stream than the body allowed before the server updates the window.
+//   - ReadBufferSize: If set, it is advertised as SETTINGS_MAX_HEADER_LIST_SIZE (unless
+//     ServerConfig.MaxHeaderListSize is set), and as SETTINGS_MAX_FRAME_SIZE when it is
+//     above the default frame size (16KB).
 func ConfigureServer(s *fasthttp.Server, cnf ServerConfig) *Server {
 	cnf.defaults()
 
@@ -106,6 +108,7 @@ func ConfigureServerAndConfig(s *fasthttp.Server, tlsConfig *tls.Config) *Server
 	s2 := &Server{
 		s: s,
 	}
+	s2.cnf.defaults()
 
 	s.NextProto(H2TLSProto, s2.ServeConn)
 	tlsConfig.NextProtos = append(tlsConfig.NextProtos, H2TLSProto)
@@ -114,3 +117,12 @@ func ConfigureServerAndConfig(s *fasthttp.Server, tlsConfig *tls.Config) *Server
 }
 
 var ErrNotAvailableStreams = errors.New("ran out of available streams")
+
+// ErrStreamsNotAllowed is returned when the server advertised a
+// SETTINGS_MAX_CONCURRENT_STREAMS of 0.
+var ErrStreamsNotAllowed = errors.New("the server doesn't allow opening streams")
+
+// ErrStreamClosed is returned when writing on a ClientStream
+// whose client side has already been closed, or when writing
+// the response body of a stream reset by the client.
+var ErrStreamClosed = errors.New("the stream is closed")
@@ -3,13 +3,14 @@ package http2
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -27,14 +28,38 @@ type ConnOpts struct {
 	// DisablePingChecking ...
 	DisablePingChecking bool
 
+	// ReadIdleTimeout is the maximum time the client waits for a frame from the server.
+	//
+	// If no frame (of any kind) arrives within ReadIdleTimeout the connection is closed,
+	// detecting dead servers faster than the unanswered pings.
+	// ReadIdleTimeout should be higher than PingInterval, so the ping replies keep
+	// the idle connections alive. A ReadIdleTimeout of <=0 disables the timeout.
+	ReadIdleTimeout time.Duration
+
 	// OnDisconnect is a callback that fires when the Conn disconnects.
 	OnDisconnect func(c *Conn)
+
+	// FlowController decides when the connection's window is replenished.
+	//
+	// The default sends a WINDOW_UPDATE once less than half of the window is left.
+	// The streams' windows are replenished as their data is read.
+	FlowController FlowController
+
+	// OnGoAway is a callback that fires when the server sends a GOAWAY,
+	// before the Conn gets closed.
+	//
+	// `ga` contains the error code and the debug data sent by the server.
+	// It must not be retained after returning, use ga.Copy instead.
+	OnGoAway func(ga *GoAway)
 }
 
 // Handshake performs an HTTP/2 handshake. That means, it will send
 // the preface if `preface` is true, send a settings frame and a
 // window update frame (for the connection's window).
-// TODO: explain more
+//
+// `maxWin` is the connection window advertised to the peer. As every connection
+// starts with a window of 65535 bytes, the WINDOW_UPDATE increments the window
+// by the difference, and it is not sent if `maxWin` is not above the initial window.
 func Handshake(preface bool, bw *bufio.Writer, st *Settings, maxWin int32) error {
 	if preface {
 		err := WritePreface(bw)
@@ -53,89 +78,156 @@ func Handshake(preface bool, bw *bufio.Writer, st *Settings, maxWin int32) error
 	fr.SetBody(st2)
 
 	_, err := fr.WriteTo(bw)
-	if err == nil {
+	if err == nil && maxWin > int32(defaultWindowSize) {
 		// then send a window update
 		fr := AcquireFrameHeader()
 		wu := AcquireFrame(FrameWindowUpdate).(*WindowUpdate)
-		wu.SetIncrement(int(maxWin))
+		wu.SetIncrement(int(maxWin) - int(defaultWindowSize))
 
 		fr.SetBody(wu)
 
 		_, err = fr.WriteTo(bw)
-		if err == nil {
-			err = bw.Flush()
-		}
 
 		ReleaseFrameHeader(fr)
 	}
 
+	if err == nil {
+		err = bw.Flush()
+	}
+
 	return err
 }
 
+// connWindow returns the connection window resulting from advertising `maxWin` in the Handshake.
+func connWindow(maxWin int32) int32 {
+	if maxWin < int32(defaultWindowSize) {
+		return int32(defaultWindowSize)
+	}
+
+	return maxWin
+}
+
 // Conn represents a raw HTTP/2 connection over TLS + TCP.
 type Conn struct {
 	c net.Conn
 
 	br *bufio.Reader
 	bw *bufio.Writer
+	// wlck serializes the writes to bw between the writeLoop and Close.
+	wlck sync.Mutex
 
 	enc *HPACK
 	dec *HPACK
 
 	nextID uint32
 
-	serverWindow       int32
+	// serverWindow is the server's connection window, the number of bytes we can send.
+	serverWindow int32
+	// winLck guards serverWindow and the send windows of the requests.
+	winLck sync.Mutex
+	// winCond is signaled when the send windows are updated.
+	winCond sync.Cond
+	// serverStreamWindow is the server's SETTINGS_INITIAL_WINDOW_SIZE.
 	serverStreamWindow int32
 
 	maxWindow     int32
 	currentWindow int32
 
 	openStreams int32
+	// maxStreams is the server's SETTINGS_MAX_CONCURRENT_STREAMS.
+	maxStreams uint32
+	// serverFrameSize is the server's SETTINGS_MAX_FRAME_SIZE.
+	serverFrameSize uint32
 
 	current Settings
 	serverS Settings
+	// serverSLck guards serverS, which is updated by the readLoop.
+	serverSLck sync.Mutex
 
 	state    connState
 	closeRef uint32
 
 	reqQueued sync.Map
+	// discardBlock keeps the header block fragments received on discarded streams.
+	discardBlock []byte
+	// streams contains the streams opened with OpenStream.
+	streams sync.Map
 
 	in  chan *Ctx
 	out chan *FrameHeader
+	// inLck prevents closing `in` while Write is queuing a request.
+	inLck sync.RWMutex
+	// done is closed when the connection gets closed.
+	done chan struct{}
+	// ready is closed when the server acknowledges our SETTINGS.
+	ready chan struct{}
+	// acked is set once ready is closed (only accessed by the readLoop).
+	acked bool
 
 	pingInterval time.Duration
+	// pingReset receives the intervals set with SetPingInterval.
+	pingReset chan time.Duration
+	// readIdleTimeout is the max time to wait for the next frame.
+	readIdleTimeout time.Duration
 
-	unacks      int
+	unacks      int32
 	disableAcks bool
+	// rtt is the round-trip time measured with the last ping acknowledged.
+	rtt int64
 
 	lastErr      error
 	onDisconnect func(*Conn)
+	onGoAway     func(*GoAway)
+	// goAway stores a copy of the GOAWAY received from the server.
+	goAway atomic.Value
+	// flow decides when the connection's window is replenished.
+	flow FlowController
 
 	closed uint64
+	// createdAt is the time the Conn was created, used by the Client's MaxConnAge.
+	createdAt time.Time
 }
 
 // NewConn returns a new HTTP/2 connection.
 // To start using the connection you need to call Handshake.
+//
+// Every Conn has its own HPACK encoder and decoder, starting with empty dynamic tables,
+// so the connections created after a disconnection don't reuse the indices of the previous one.
 func NewConn(c net.Conn, opts ConnOpts) *Conn {
 	nc := &Conn{
-		c:             c,
-		br:            bufio.NewReaderSize(c, 4096),
-		bw:            bufio.NewWriterSize(c, maxFrameSize),
-		enc:           AcquireHPACK(),
-		dec:           AcquireHPACK(),
-		nextID:        1,
-		maxWindow:     1 << 20,
-		currentWindow: 1 << 20,
-		in:            make(chan *Ctx, 128),
-		out:           make(chan *FrameHeader, 128),
-		pingInterval:  opts.PingInterval,
-		disableAcks:   opts.DisablePingChecking,
-		onDisconnect:  opts.OnDisconnect,
+		c:               c,
+		br:              bufio.NewReaderSize(c, 4096),
+		bw:              bufio.NewWriterSize(c, maxFrameSize),
+		enc:             AcquireHPACK(),
+		dec:             AcquireHPACK(),
+		nextID:          1,
+		serverWindow:    int32(defaultWindowSize),
+		maxWindow:       1 << 20,
+		currentWindow:   1 << 20,
+		in:              make(chan *Ctx, 128),
+		out:             make(chan *FrameHeader, 128),
+		done:            make(chan struct{}),
+		pingReset:       make(chan time.Duration),
+		serverFrameSize: defaultDataFrameSize,
+		ready:           make(chan struct{}),
+		pingInterval:    opts.PingInterval,
+		readIdleTimeout: opts.ReadIdleTimeout,
+		disableAcks:     opts.DisablePingChecking,
+		onDisconnect:    opts.OnDisconnect,
+		onGoAway:        opts.OnGoAway,
+		flow:            opts.FlowController,
+		createdAt:       time.Now(),
+	}
+
+	if nc.flow == nil {
+		nc.flow = halfWindow{}
 	}
 
 	nc.current.SetMaxWindowSize(1 << 20)
 	nc.current.SetPush(false)
 
+	nc.winCond.L = &nc.winLck
+
 	return nc
 }
 
@@ -147,6 +239,7 @@ type Dialer struct {
 	// TLSConfig is the tls configuration.
 	//
 	// If TLSConfig is nil, a default one will be defined on the Dial call.
+	// The TLS renegotiation is always disabled, as HTTP/2 forbids it.
 	TLSConfig *tls.Config
 
 	// PingInterval defines the interval in which the client will ping the server.
@@ -159,6 +252,24 @@ type Dialer struct {
 	NetDial fasthttp.DialFunc
 }
 
+// dialAddr returns the address to dial and the host of `addr`.
+//
+// `addr` can be a hostname or an IP address (IPv6 addresses can be enclosed in brackets),
+// optionally followed by a port. If the port is missing, 443 is used.
+func dialAddr(addr string) (hostport, host string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// the address doesn't contain a port
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	}
+
+	if port == "" {
+		port = "443"
+	}
+
+	return net.JoinHostPort(host, port), host
+}
+
 func (d *Dialer) tryDial() (net.Conn, error) {
 	if d.TLSConfig == nil || !func() bool {
 		for _, proto := range d.TLSConfig.NextProtos {
@@ -172,16 +283,26 @@ func (d *Dialer) tryDial() (net.Conn, error) {
 		configureDialer(d)
 	}
 
+	// RFC(9.2.1):
+	//
+	// A deployment of HTTP/2 over TLS 1.2 MUST disable renegotiation.
+	//
+	// crypto/tls answers the server's renegotiation requests with an alert,
+	// failing the connection, so no frame can be sent after it.
+	d.TLSConfig.Renegotiation = tls.RenegotiateNever
+
 	var c net.Conn
 	var err error
 
+	addr, _ := dialAddr(d.Addr)
+
 	if d.NetDial != nil {
-		c, err = d.NetDial(d.Addr)
+		c, err = d.NetDial(addr)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		tcpAddr, err := net.ResolveTCPAddr("tcp", d.Addr)
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
 		if err != nil {
 			return nil, err
 		}
@@ -231,6 +352,15 @@ func (c *Conn) LastErr() error {
 	return c.lastErr
 }
 
+// GoAway returns the GOAWAY received from the server, or nil if the server didn't send any.
+//
+// The requests sent on the streams above ga.Stream() were not processed by the server,
+// so they can be retried on a new connection. The returned GoAway must not be modified.
+func (c *Conn) GoAway() *GoAway {
+	ga, _ := c.goAway.Load().(*GoAway)
+	return ga
+}
+
 // Handshake will perform the necessary handshake to establish the connection
 // with the server. If an error is returned you can assume the TCP connection has been closed.
 func (c *Conn) Handshake() error {
@@ -246,11 +376,14 @@ func (c *Conn) Handshake() error {
 func (c *Conn) doHandshake() error {
 	var err error
 
-	if err = Handshake(true, c.bw, &c.current, c.maxWindow-65535); err != nil {
+	if err = Handshake(true, c.bw, &c.current, c.maxWindow); err != nil {
 		_ = c.c.Close()
 		return err
 	}
 
+	c.maxWindow = connWindow(c.maxWindow)
+	c.currentWindow = c.maxWindow
+
 	var fr *FrameHeader
 
 	if fr, err = ReadFrameFrom(c.br); err == nil && fr.Type() != FrameSettings {
@@ -260,8 +393,10 @@ func (c *Conn) doHandshake() error {
 		st := fr.Body().(*Settings)
 		if !st.IsAck() {
 			st.CopyTo(&c.serverS)
+			atomic.StoreUint32(&c.maxStreams, st.MaxConcurrentStreams())
+			atomic.StoreUint32(&c.serverFrameSize, st.MaxFrameSize())
 
-			c.serverStreamWindow += int32(c.serverS.MaxWindowSize())
+			atomic.StoreInt32(&c.serverStreamWindow, int32(c.serverS.MaxWindowSize()))
 			if st.HeaderTableSize() <= defaultHeaderTableSize {
 				c.enc.SetMaxTableSize(st.HeaderTableSize())
 			}
@@ -291,9 +426,130 @@ func (c *Conn) doHandshake() error {
 	return err
 }
 
+// RemoteAddr returns the server's network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.c.RemoteAddr()
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.c.LocalAddr()
+}
+
+// TLSConnectionState returns the state of the TLS connection,
+// or false if the connection doesn't use TLS.
+func (c *Conn) TLSConnectionState() (tls.ConnectionState, bool) {
+	if tc, ok := c.c.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return tc.ConnectionState(), true
+	}
+
+	return tls.ConnectionState{}, false
+}
+
+// ConnectionWindow returns the connection-level flow control window advertised to the server.
+//
+// It is the maximum number of bytes the server can send on all the streams
+// before the client updates the window.
+func (c *Conn) ConnectionWindow() int32 {
+	return c.maxWindow
+}
+
 // CanOpenStream returns whether the client will be able to open a new stream or not.
 func (c *Conn) CanOpenStream() bool {
-	return atomic.LoadInt32(&c.openStreams) < int32(c.serverS.maxStreams)
+	return atomic.LoadInt32(&c.openStreams) < int32(atomic.LoadUint32(&c.maxStreams))
+}
+
+// StreamsAllowed returns false if the server advertised a
+// SETTINGS_MAX_CONCURRENT_STREAMS of 0, meaning no stream can be opened
+// until the server raises it.
+func (c *Conn) StreamsAllowed() bool {
+	return atomic.LoadUint32(&c.maxStreams) != 0
+}
+
+// ConnInfo contains the metadata of a connection, as returned by Conn.Info.
+type ConnInfo struct {
+	// Protocol is the protocol negotiated using ALPN, or empty if the connection doesn't use TLS.
+	Protocol string
+
+	// TLSVersion is the TLS version (like tls.VersionTLS13), or 0 if the connection doesn't use TLS.
+	TLSVersion uint16
+
+	// ServerSettings are the settings received from the server.
+	ServerSettings Settings
+
+	// RTT is the round-trip time measured with the last ping acknowledged by the server,
+	// or 0 if no ping has been acknowledged yet.
+	RTT time.Duration
+
+	// OpenStreams is the number of streams open in the connection.
+	OpenStreams int
+}
+
+// Info returns the metadata of the connection.
+func (c *Conn) Info() ConnInfo {
+	var info ConnInfo
+
+	if state, ok := c.TLSConnectionState(); ok {
+		info.Protocol = state.NegotiatedProtocol
+		info.TLSVersion = state.Version
+	}
+
+	c.serverSLck.Lock()
+	c.serverS.CopyTo(&info.ServerSettings)
+	c.serverSLck.Unlock()
+
+	info.RTT = time.Duration(atomic.LoadInt64(&c.rtt))
+	info.OpenStreams = int(atomic.LoadInt32(&c.openStreams))
+
+	return info
+}
+
+// HeaderCompressionRatio returns the compression ratio of the request headers
+// sent on the connection, as returned by HPACK.CompressionRatio.
+func (c *Conn) HeaderCompressionRatio() float64 {
+	c.wlck.Lock()
+	defer c.wlck.Unlock()
+
+	return c.enc.CompressionRatio()
+}
+
+// WaitReady blocks until the server acknowledges the client's SETTINGS,
+// which completes the initial SETTINGS exchange.
+//
+// Once WaitReady returns, the settings the server sent before its
+// acknowledgement are applied, so CanOpenStream reflects the server's limits.
+// WaitReady returns io.EOF if the connection is closed before, or the ctx error if ctx is done.
+func (c *Conn) WaitReady(ctx context.Context) error {
+	select {
+	case <-c.ready:
+		return nil
+	default:
+	}
+
+	select {
+	case <-c.ready:
+		return nil
+	case <-c.done:
+		return io.EOF
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetPingInterval changes the interval at which the connection pings the server,
+// sending the next ping `d` after SetPingInterval is called.
+//
+// An interval <= 0 sets DefaultPingInterval, as the pings can't be disabled.
+func (c *Conn) SetPingInterval(d time.Duration) {
+	if d <= 0 {
+		d = DefaultPingInterval
+	}
+
+	// the ticker is only accessed by the writeLoop.
+	select {
+	case c.pingReset <- d:
+	case <-c.done:
+	}
 }
 
 // Closed indicates whether the connection is closed or not.
@@ -308,7 +564,17 @@ func (c *Conn) Close() error {
 		return io.EOF
 	}
 
+	// unblock the requests waiting to be queued before closing `in`.
+	close(c.done)
+
+	// and the request bodies waiting for the server to update the windows.
+	c.winLck.Lock()
+	c.winCond.Broadcast()
+	c.winLck.Unlock()
+
+	c.inLck.Lock()
 	close(c.in)
+	c.inLck.Unlock()
 
 	fr := AcquireFrameHeader()
 	defer ReleaseFrameHeader(fr)
@@ -319,10 +585,12 @@ func (c *Conn) Close() error {
 
 	fr.SetBody(ga)
 
+	c.wlck.Lock()
 	_, err := fr.WriteTo(c.bw)
 	if err == nil {
 		err = c.bw.Flush()
 	}
+	c.wlck.Unlock()
 
 	_ = c.c.Close()
 
@@ -335,9 +603,25 @@ func (c *Conn) Close() error {
 
 // Write queues the request to be sent to the server.
 //
-// Check if `c` has been previously closed before accessing this function.
-func (c *Conn) Write(r *Ctx) {
-	c.in <- r
+// Write returns io.EOF if the connection is closed, in which case
+// the request is not sent and nothing is sent to r.Err.
+// It is safe to call Write and Close concurrently.
+func (c *Conn) Write(r *Ctx) error {
+	c.inLck.RLock()
+	defer c.inLck.RUnlock()
+
+	if c.Closed() {
+		return io.EOF
+	}
+
+	r.conn = c
+
+	select {
+	case c.in <- r:
+		return nil
+	case <-c.done:
+		return io.EOF
+	}
 }
 
 var ErrStreamNotReady = errors.New("stream hasn't been created")
@@ -356,15 +640,22 @@ func (c *Conn) Cancel(ctx *Ctx) error {
 }
 
 func (c *Conn) cancel(ctx *Ctx) {
+	c.resetStream(ctx, StreamCanceled)
+}
+
+// resetStream stops sending the request of `ctx` and resets its stream with `code`.
+func (c *Conn) resetStream(ctx *Ctx, code ErrorCode) {
 	h := AcquireFrameHeader()
 	h.SetStream( // TODO: use atomic here??
 		atomic.LoadUint32(&ctx.streamID))
 
 	fr := AcquireFrame(FrameResetStream).(*RstStream)
-	fr.SetCode(StreamCanceled)
+	fr.SetCode(code)
 
 	h.SetBody(fr)
 
+	c.stopSending(ctx)
+
 	c.out <- h
 }
 
@@ -409,12 +700,7 @@ func (c *Conn) writeLoop() {
 			lastErr = io.ErrUnexpectedEOF
 		}
 
-		c.reqQueued.Range(func(_, v interface{}) bool {
-			r := v.(*Ctx)
-			r.resolve(lastErr)
-
-			return true
-		})
+		c.failQueued(lastErr)
 	}()
 
 	if c.pingInterval <= 0 {
@@ -434,9 +720,14 @@ loop:
 
 			err := c.writeRequest(ctx)
 			if err != nil {
-				ctx.resolve(err)
+				ctx.mu.Lock()
+				if !ctx.done {
+					ctx.done = true
+					ctx.resolve(err)
+				}
+				ctx.mu.Unlock()
 
-				if errors.Is(err, ErrNotAvailableStreams) {
+				if errors.Is(err, ErrNotAvailableStreams) || errors.Is(err, ErrStreamsNotAllowed) {
 					continue
 				}
 
@@ -461,16 +752,60 @@ loop:
 				lastErr = WriteError{err}
 				break loop
 			}
+		case d := <-c.pingReset:
+			c.pingInterval = d
+			ticker.Reset(d)
 		}
 
-		if !c.disableAcks && c.unacks >= 3 {
+		if !c.disableAcks && atomic.LoadInt32(&c.unacks) >= 3 {
 			lastErr = ErrTimeout
 			break loop
 		}
 	}
 }
 
+// failQueued resolves the requests waiting for a response with `err`.
+func (c *Conn) failQueued(err error) {
+	c.reqQueued.Range(func(k, v interface{}) bool {
+		r := v.(*Ctx)
+
+		r.mu.Lock()
+		if !r.done {
+			c.finish(r, k.(uint32), err)
+		}
+		r.mu.Unlock()
+
+		return true
+	})
+}
+
+// failAbove resolves with `err` the requests sent on the streams above `stream`.
+//
+// RFC(6.8):
+//
+// The sender of the GOAWAY frame [...] will not process any frames
+// on streams initiated by the receiver with identifiers higher than the
+// last stream identifier.
+func (c *Conn) failAbove(stream uint32, err error) {
+	c.reqQueued.Range(func(k, v interface{}) bool {
+		if id := k.(uint32); id > stream {
+			r := v.(*Ctx)
+
+			r.mu.Lock()
+			if !r.done {
+				c.finish(r, id, err)
+			}
+			r.mu.Unlock()
+		}
+
+		return true
+	})
+}
+
 func (c *Conn) writeFrame(fr *FrameHeader) error {
+	c.wlck.Lock()
+	defer c.wlck.Unlock()
+
 	_, err := fr.WriteTo(c.bw)
 	if err == nil {
 		if err = c.bw.Flush(); err != nil {
@@ -481,47 +816,121 @@ func (c *Conn) writeFrame(fr *FrameHeader) error {
 	return err
 }
 
+// finish resolves the request `r` with `err`, releasing its stream.
+//
+// It must be called holding r.mu.
 func (c *Conn) finish(r *Ctx, stream uint32, err error) {
+	r.done = true
+
 	atomic.AddInt32(&c.openStreams, -1)
 
+	c.stopSending(r)
+
 	r.resolve(err)
 
 	c.reqQueued.Delete(stream)
 }
 
 func (c *Conn) readLoop() {
-	defer func() { _ = c.Close() }()
+	defer func() {
+		_ = c.Close()
+
+		err := c.lastErr
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+
+		c.streams.Range(func(_, v interface{}) bool {
+			v.(*ClientStream).fail(err)
+			return true
+		})
+	}()
 
 	for {
+		if c.readIdleTimeout > 0 {
+			_ = c.c.SetReadDeadline(time.Now().Add(c.readIdleTimeout))
+		}
+
 		fr, err := c.readNext()
 		if err != nil {
+			if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() && c.readIdleTimeout > 0 {
+				err = ErrReadIdleTimeout
+			}
+
 			c.lastErr = err
 			break
 		}
 
-		// TODO: panic otherwise?
+		if cs, ok := c.streams.Load(fr.Stream()); ok {
+			err := c.readClientStream(fr, cs.(*ClientStream))
+			ReleaseFrameHeader(fr)
+
+			if err != nil {
+				// the HPACK decoder can't be used anymore.
+				c.lastErr = err
+				break
+			}
+
+			continue
+		}
+
+		var r *Ctx
 		if ri, ok := c.reqQueued.Load(fr.Stream()); ok {
-			r := ri.(*Ctx)
+			r = ri.(*Ctx)
+			r.mu.Lock()
 
-			err := c.readStream(fr, r.Response)
-			if err == nil {
-				if fr.Flags().Has(FlagEndStream) {
-					c.finish(r, fr.Stream(), nil)
-				}
-			} else {
-				c.finish(r, fr.Stream(), err)
+			// the request might have been discarded after loading it.
+			if r.done {
+				r.mu.Unlock()
+				r = nil
+			}
+		}
 
-				fmt.Fprintf(os.Stderr, "%s. payload=%v\n", err, fr.payload)
+		if r == nil {
+			// the frames of discarded streams still need to be accounted.
+			if err := c.discardFrame(fr); err != nil {
+				c.lastErr = err
+				break
+			}
 
-				if errors.Is(err, FlowControlError) {
-					break
-				}
+			ReleaseFrameHeader(fr)
+
+			continue
+		}
+
+		err = c.readStream(fr, r)
+
+		// the first header block has been completely received.
+		isHeaders := fr.Type() == FrameHeaders || fr.Type() == FrameContinuation
+		if err == nil && isHeaders && !r.gotHeaders && len(r.headerBlock) == 0 {
+			r.gotHeaders = true
+
+			if r.OnHeaders != nil {
+				// OnHeaders might discard the request.
+				r.mu.Unlock()
+				r.OnHeaders(r.Response)
+				r.mu.Lock()
 			}
+		}
 
-			if c.state == connStateClosed {
-				if fr.Stream() == c.closeRef {
-					break
-				}
+		if !r.done {
+			// the stream ends once the header block is complete.
+			if err != nil || (r.endStream && len(r.headerBlock) == 0) {
+				c.finish(r, fr.Stream(), err)
+			}
+		}
+
+		r.mu.Unlock()
+
+		// the error was delivered to the request by finish.
+		// A reset only affects the stream, while flow control errors end the connection.
+		if err != nil && fr.Type() != FrameResetStream && errors.Is(err, FlowControlError) {
+			break
+		}
+
+		if c.state == connStateClosed {
+			if fr.Stream() == c.closeRef {
+				break
 			}
 		}
 
@@ -529,20 +938,78 @@ func (c *Conn) readLoop() {
 	}
 }
 
+// discardFrame accounts the frame `fr` received on a stream which is not being read.
+//
+// The header blocks are decoded to keep the HPACK state in sync with the server.
+func (c *Conn) discardFrame(fr *FrameHeader) error {
+	switch fr.Type() {
+	case FrameData:
+		c.consumeData(fr)
+	case FrameHeaders, FrameContinuation:
+		c.discardBlock = append(c.discardBlock, fr.Body().(FrameWithHeaders).Headers()...)
+		if !fr.Flags().Has(FlagEndHeaders) {
+			break
+		}
+
+		hf := AcquireHeaderField()
+		defer ReleaseHeaderField(hf)
+
+		var err error
+
+		for b := c.discardBlock; err == nil && len(b) > 0; {
+			b, err = c.dec.Next(hf, b)
+		}
+
+		c.discardBlock = c.discardBlock[:0]
+
+		return err
+	}
+
+	return nil
+}
+
 func (c *Conn) writeRequest(ctx *Ctx) error {
+	if !c.StreamsAllowed() {
+		return ErrStreamsNotAllowed
+	}
+
 	if !c.CanOpenStream() {
 		return ErrNotAvailableStreams
 	}
 
-	req := ctx.Request
+	c.wlck.Lock()
+	defer c.wlck.Unlock()
 
-	hasBody := len(req.Body()) != 0
+	ctx.mu.Lock()
 
-	enc := c.enc
+	// the request might have been canceled while it was queued.
+	if ctx.done {
+		ctx.mu.Unlock()
+		return nil
+	}
 
 	id := c.nextID
 	c.nextID += 2
 
+	c.winLck.Lock()
+	ctx.window = atomic.LoadInt32(&c.serverStreamWindow)
+	ctx.sendDone = false
+	c.winLck.Unlock()
+
+	// store the ctx before sending the request, so a cancellation releases the stream.
+	atomic.StoreUint32(&ctx.streamID, id)
+	c.reqQueued.Store(id, ctx)
+	atomic.AddInt32(&c.openStreams, 1)
+
+	// the request can't be resolved while it's being written, as the caller might reuse it.
+	defer ctx.mu.Unlock()
+
+	req := ctx.Request
+
+	hasBody := len(req.Body()) != 0
+
+	enc := c.enc
+
 	fr := AcquireFrameHeader()
 	defer ReleaseFrameHeader(fr)
 
@@ -573,37 +1040,51 @@ func (c *Conn) writeRequest(ctx *Ctx) error {
 			return
 		}
 
-		hf.SetBytes(ToLower(k), v)
+		// k must not be modified, lowercase the copy instead.
+		hf.SetBytes(k, v)
+		ToLower(hf.key)
+
+		hf.sensible = ctx.isSensitive(k)
 		enc.AppendHeaderField(h, hf, false)
+		hf.sensible = false
 	})
 
 	h.SetPadding(false)
 	h.SetEndStream(!hasBody)
 	h.SetEndHeaders(true)
 
-	// store the ctx before sending the request
-	atomic.StoreUint32(&ctx.streamID, id)
-	c.reqQueued.Store(id, ctx)
+	var body []byte
 
 	_, err := fr.WriteTo(c.bw)
 	if err == nil && hasBody {
-		// release headers bc it's going to get replaced by the data frame
-		ReleaseFrame(h)
+		// the body is sent while the flow control windows allow it.
+		body = req.Body()
+
+		for err == nil && len(body) > 0 {
+			n := c.reserveWindow(ctx, len(body), false)
+			if n == 0 {
+				break
+			}
 
-		err = writeData(c.bw, fr, req.Body())
+			err = writeDataFrame(c.bw, id, body[:n], n == len(body))
+			body = body[n:]
+		}
 	}
 
 	if err == nil {
 		err = c.bw.Flush()
-		if err == nil {
-			atomic.AddInt32(&c.openStreams, 1)
-		}
+	}
+
+	if err == nil && len(body) > 0 {
+		// the request might be released before the rest of the body is sent.
+		go c.writeBody(ctx, id, append([]byte(nil), body...))
 	}
 
 	if err != nil {
 		c.lastErr = err
-		// if we had any error, remove it from the reqQueued.
-		c.reqQueued.Delete(id)
+
+		// if we had any error, release the stream.
+		c.finish(ctx, id, err)
 	}
 
 	ReleaseHeaderField(hf)
@@ -611,31 +1092,114 @@ func (c *Conn) writeRequest(ctx *Ctx) error {
 	return err
 }
 
-func writeData(bw *bufio.Writer, fh *FrameHeader, body []byte) (err error) {
-	step := 1 << 14
+// writeBody sends the rest of the request body once the server updates the flow control windows.
+func (c *Conn) writeBody(ctx *Ctx, stream uint32, body []byte) {
+	for len(body) > 0 {
+		n := c.reserveWindow(ctx, len(body), true)
+		if n == 0 {
+			return
+		}
 
-	data := AcquireFrame(FrameData).(*Data)
-	fh.SetBody(data)
+		c.wlck.Lock()
+		err := writeDataFrame(c.bw, stream, body[:n], n == len(body))
+		if err == nil {
+			err = c.bw.Flush()
+		}
+		c.wlck.Unlock()
+
+		// the connection is broken, so the requests waiting for a response won't get any.
+		if err != nil {
+			c.failQueued(WriteError{err})
+			_ = c.c.Close()
 
-	for i := 0; err == nil && i < len(body); i += step {
-		if i+step >= len(body) {
-			step = len(body) - i
+			return
 		}
 
-		data.SetEndStream(i+step == len(body))
-		data.SetPadding(false)
-		data.SetData(body[i : step+i])
+		body = body[n:]
+	}
+}
+
+// reserveWindow returns how many bytes of the `n` requested can be sent in the next DATA frame
+// of `ctx`, according to the flow control windows of the connection and the stream.
+//
+// If `wait` is true, reserveWindow waits until the server updates the windows.
+// It returns 0 if no data can be sent, or the request is finished.
+func (c *Conn) reserveWindow(ctx *Ctx, n int, wait bool) int {
+	c.winLck.Lock()
+	defer c.winLck.Unlock()
+
+	for wait && (c.serverWindow <= 0 || ctx.window <= 0) && !ctx.sendDone && !c.Closed() {
+		c.winCond.Wait()
+	}
 
-		_, err = fh.WriteTo(bw)
+	if ctx.sendDone || c.Closed() {
+		return 0
+	}
+
+	for _, win := range [...]int32{c.serverWindow, ctx.window, c.dataFrameSize()} {
+		if n > int(win) {
+			n = int(win)
+		}
 	}
 
+	if n <= 0 {
+		return 0
+	}
+
+	c.serverWindow -= int32(n)
+	ctx.window -= int32(n)
+
+	return n
+}
+
+// stopSending stops sending the body of `ctx`.
+func (c *Conn) stopSending(ctx *Ctx) {
+	c.winLck.Lock()
+	ctx.sendDone = true
+	c.winCond.Broadcast()
+	c.winLck.Unlock()
+}
+
+// addWindow increases the send window of `ctx`, or the connection's if `ctx` is nil.
+func (c *Conn) addWindow(ctx *Ctx, n int32) {
+	c.winLck.Lock()
+	if ctx == nil {
+		c.serverWindow += n
+	} else {
+		ctx.window += n
+	}
+	c.winCond.Broadcast()
+	c.winLck.Unlock()
+}
+
+// writeDataFrame writes `body` into `bw` as a DATA frame on `stream`,
+// ending the stream if `endStream` is true.
+//
+// The DATA frame uses its own FrameHeader, so no state (like flags)
+// is shared with the frames previously written on the stream.
+func writeDataFrame(bw *bufio.Writer, stream uint32, body []byte, endStream bool) error {
+	fh := AcquireFrameHeader()
+	defer ReleaseFrameHeader(fh)
+
+	fh.SetStream(stream)
+
+	data := AcquireFrame(FrameData).(*Data)
+	data.SetEndStream(endStream)
+	data.SetPadding(false)
+	data.SetData(body)
+
+	fh.SetBody(data)
+
+	_, err := fh.WriteTo(bw)
+
 	return err
 }
 
 func (c *Conn) readNext() (fr *FrameHeader, err error) {
 loop:
 	for err == nil {
-		fr, err = ReadFrameFrom(c.br)
+		// the frames can't be larger than our SETTINGS_MAX_FRAME_SIZE.
+		fr, err = ReadFrameFromWithSize(c.br, c.maxFrameSize())
 		if err != nil {
 			break
 		}
@@ -647,22 +1211,34 @@ loop:
 		switch fr.Type() {
 		case FrameSettings:
 			st := fr.Body().(*Settings)
-			if !st.IsAck() { // if it has ack, just ignore
+			if !st.IsAck() {
 				c.handleSettings(st)
+			} else if !c.acked {
+				// the settings received before the ack are already applied.
+				c.acked = true
+				close(c.ready)
 			}
 		case FrameWindowUpdate:
 			win := int32(fr.Body().(*WindowUpdate).Increment())
 
-			atomic.AddInt32(&c.serverWindow, win)
+			c.addWindow(nil, win)
 		case FramePing:
 			ping := fr.Body().(*Ping)
 			if !ping.IsAck() {
 				c.handlePing(ping)
 			} else {
-				c.unacks--
+				atomic.AddInt32(&c.unacks, -1)
+				atomic.StoreInt64(&c.rtt, int64(time.Since(ping.DataAsTime())))
 			}
 		case FrameGoAway:
 			ga := fr.Body().(*GoAway)
+			if c.onGoAway != nil {
+				c.onGoAway(ga)
+			}
+
+			c.goAway.Store(ga.Copy())
+			c.failAbove(ga.stream, c.GoAway())
+
 			if ga.stream == 0 {
 				_ = c.c.Close()
 				err = ga
@@ -683,6 +1259,23 @@ loop:
 
 var ErrTimeout = errors.New("server is not replying to pings")
 
+// ErrReadIdleTimeout is returned when no frames were received within ConnOpts.ReadIdleTimeout.
+var ErrReadIdleTimeout = errors.New("no frames received from the server")
+
+// dataFrameSize returns the maximum size of the DATA frames sent, the server's SETTINGS_MAX_FRAME_SIZE.
+func (c *Conn) dataFrameSize() int32 {
+	return int32(atomic.LoadUint32(&c.serverFrameSize))
+}
+
+// maxFrameSize returns the SETTINGS_MAX_FRAME_SIZE advertised to the server.
+func (c *Conn) maxFrameSize() uint32 {
+	if n := c.current.MaxFrameSize(); n != 0 {
+		return n
+	}
+
+	return defaultDataFrameSize
+}
+
 func (c *Conn) writePing() error {
 	fr := AcquireFrameHeader()
 	defer ReleaseFrameHeader(fr)
@@ -692,11 +1285,14 @@ func (c *Conn) writePing() error {
 
 	fr.SetBody(ping)
 
+	c.wlck.Lock()
+	defer c.wlck.Unlock()
+
 	_, err := fr.WriteTo(c.bw)
 	if err == nil {
 		err = c.bw.Flush()
 		if err == nil {
-			c.unacks++
+			atomic.AddInt32(&c.unacks, 1)
 		}
 	}
 
@@ -704,10 +1300,33 @@ func (c *Conn) writePing() error {
 }
 
 func (c *Conn) handleSettings(st *Settings) {
-	st.CopyTo(&c.serverS)
+	// the frames only include the parameters that changed, and they are applied in the order received.
+	c.serverSLck.Lock()
+	st.applyTo(&c.serverS)
+	maxStreams, win, tableSize := c.serverS.MaxConcurrentStreams(), int32(c.serverS.MaxWindowSize()), c.serverS.HeaderTableSize()
+	frameSize := c.serverS.MaxFrameSize()
+	c.serverSLck.Unlock()
+
+	atomic.StoreUint32(&c.maxStreams, maxStreams)
+	atomic.StoreUint32(&c.serverFrameSize, frameSize)
+
+	if delta := win - atomic.SwapInt32(&c.serverStreamWindow, win); delta != 0 {
+		// the change applies to the windows of the open streams too (RFC 7540 section 6.9.2).
+		c.streams.Range(func(_, v interface{}) bool {
+			v.(*ClientStream).addWindow(delta)
+			return true
+		})
+
+		c.reqQueued.Range(func(_, v interface{}) bool {
+			c.addWindow(v.(*Ctx), delta)
+			return true
+		})
+	}
 
-	c.serverStreamWindow += int32(c.serverS.MaxWindowSize())
-	c.enc.SetMaxTableSize(st.HeaderTableSize())
+	// the writeLoop encodes the requests' headers holding wlck.
+	c.wlck.Lock()
+	c.enc.SetMaxTableSize(tableSize)
+	c.wlck.Unlock()
 
 	// reply back
 	fr := AcquireFrameHeader()
@@ -721,26 +1340,45 @@ func (c *Conn) handleSettings(st *Settings) {
 }
 
 func (c *Conn) handlePing(ping *Ping) {
-	// reply back
+	// reply back using a new frame, as `ping` is released by the caller.
 	fr := AcquireFrameHeader()
 
-	ping.SetAck(true)
+	pong := AcquireFrame(FramePing).(*Ping)
+	ping.CopyTo(pong)
+	pong.SetAck(true)
 
-	fr.SetBody(ping)
+	fr.SetBody(pong)
 
 	c.out <- fr
 }
 
-func (c *Conn) readStream(fr *FrameHeader, res *fasthttp.Response) (err error) {
+func (c *Conn) readStream(fr *FrameHeader, ctx *Ctx) (err error) {
+	res := ctx.Response
+
+	if (fr.Type() == FrameHeaders || fr.Type() == FrameData) && fr.Flags().Has(FlagEndStream) {
+		ctx.endStream = true
+	}
+
 	switch fr.Type() {
 	case FrameHeaders, FrameContinuation:
+		// the header fields can be split between the frames of the block.
 		h := fr.Body().(FrameWithHeaders)
-		err = c.readHeader(h.Headers(), res)
-	case FrameData:
-		c.currentWindow -= int32(fr.Len())
-		currentWin := c.currentWindow
+		ctx.headerBlock = append(ctx.headerBlock, h.Headers()...)
 
-		c.serverWindow -= int32(fr.Len())
+		if fr.Flags().Has(FlagEndHeaders) {
+			err = c.readHeader(ctx.headerBlock, res)
+			ctx.headerBlock = ctx.headerBlock[:0]
+		}
+	case FrameData:
+		// RFC(8.1):
+		//
+		// An HTTP response consists of one HEADERS frame, followed by zero or more DATA frames.
+		if !ctx.gotHeaders || len(ctx.headerBlock) > 0 {
+			c.consumeData(fr)
+			c.resetStream(ctx, ProtocolError)
+
+			return NewResetStreamError(ProtocolError, "DATA frame before the response headers")
+		}
 
 		data := fr.Body().(*Data)
 		if data.Len() != 0 {
@@ -750,18 +1388,31 @@ func (c *Conn) readStream(fr *FrameHeader, res *fasthttp.Response) (err error) {
 			c.updateWindow(fr.Stream(), fr.Len())
 		}
 
-		if currentWin < c.maxWindow/2 {
-			nValue := c.maxWindow - currentWin
-
-			c.currentWindow = c.maxWindow
-
-			c.updateWindow(0, int(nValue))
-		}
+		c.consumeData(fr)
+	case FrameWindowUpdate:
+		c.addWindow(ctx, int32(fr.Body().(*WindowUpdate).Increment()))
+	case FrameResetStream:
+		// the body received so far is kept in `res`.
+		err = NewResetStreamError(fr.Body().(*RstStream).Code(), "stream reset by the server")
 	}
 
 	return
 }
 
+// consumeData updates the connection's flow control window after receiving the DATA frame `fr`.
+func (c *Conn) consumeData(fr *FrameHeader) {
+	n := int32(fr.Len())
+
+	c.currentWindow -= n
+	c.flow.Consumed(0, n)
+
+	if inc := windowIncrement(c.flow, 0, c.currentWindow, c.maxWindow); inc > 0 {
+		c.currentWindow += inc
+
+		c.updateWindow(0, int(inc))
+	}
+}
+
 func (c *Conn) updateWindow(streamID uint32, size int) {
 	fr := AcquireFrameHeader()
 
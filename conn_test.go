@@ -0,0 +1,2121 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func getClientConn(s *Server, opts ConnOpts) (*Conn, net.Listener, error) {
+	s.cnf.defaults()
+
+	ln := fasthttputil.NewInmemoryListener()
+
+	go serve(s, ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nc := NewConn(c, opts)
+
+	return nc, ln, nc.Handshake()
+}
+
+// rawPeer is the server side of a client Conn which reads
+// and writes frames without any processing.
+type rawPeer struct {
+	c  net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+}
+
+func (p *rawPeer) readFrame() (*FrameHeader, error) {
+	return ReadFrameFrom(p.br)
+}
+
+func (p *rawPeer) writeFrame(fr *FrameHeader) error {
+	_, err := fr.WriteTo(p.bw)
+	if err == nil {
+		err = p.bw.Flush()
+	}
+
+	return err
+}
+
+// getRawConn returns a client Conn whose handshake has been performed
+// against a rawPeer advertising `st`. The Conn loops are not started.
+func getRawConn(st *Settings, opts ConnOpts) (*Conn, *rawPeer, error) {
+	pc := fasthttputil.NewPipeConns()
+
+	peer := &rawPeer{
+		c:  pc.Conn2(),
+		br: bufio.NewReader(pc.Conn2()),
+		bw: bufio.NewWriter(pc.Conn2()),
+	}
+
+	if st == nil {
+		st = &Settings{}
+		st.Reset()
+	}
+
+	fr := AcquireFrameHeader()
+	fr.SetBody(st)
+
+	err := peer.writeFrame(fr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nc := NewConn(pc.Conn1(), opts)
+	if err = nc.doHandshake(); err != nil {
+		return nil, nil, err
+	}
+
+	if !ReadPreface(peer.br) {
+		return nil, nil, errors.New("wrong preface")
+	}
+
+	// settings, window update and the settings' ack
+	for i := 0; i < 3; i++ {
+		fr, err := peer.readFrame()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+
+	return nc, peer, nil
+}
+
+// writeData writes `body` into `bw` as DATA frames of the default size on `stream`,
+// ending the stream with the last frame if `endStream` is true.
+func writeData(bw *bufio.Writer, stream uint32, body []byte, endStream bool) (err error) {
+	step := int(defaultDataFrameSize)
+
+	for i := 0; err == nil && i < len(body); i += step {
+		if i+step >= len(body) {
+			step = len(body) - i
+		}
+
+		err = writeDataFrame(bw, stream, body[i:i+step], endStream && i+step == len(body))
+	}
+
+	return err
+}
+
+func doRequest(c *Conn, req *fasthttp.Request, res *fasthttp.Response) error {
+	ctx := &Ctx{
+		Request:  req,
+		Response: res,
+		Err:      make(chan error, 1),
+	}
+
+	if err := c.Write(ctx); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-ctx.Err:
+		return err
+	case <-time.After(time.Second * 5):
+		return ErrRequestCanceled
+	}
+}
+
+func TestFramePoolDoubleRelease(t *testing.T) {
+	fr := AcquireFrameHeader()
+	if fr.released {
+		t.Fatal("an acquired frame header must not be marked as released")
+	}
+
+	fr.SetBody(AcquireFrame(FrameData))
+
+	ReleaseFrameHeader(fr)
+
+	if !fr.released || fr.Body() != nil {
+		t.Fatal("expected the frame header to be released along with its body")
+	}
+
+	// the second release must return before touching fr, so a frame
+	// referenced after the first release isn't returned to the pool.
+	data := AcquireFrame(FrameData)
+	fr.fr = data
+
+	ReleaseFrameHeader(fr)
+
+	if !fr.released || fr.Body() != data {
+		t.Fatal("expected the second release to be a no-op")
+	}
+
+	ReleaseFrame(data)
+	ReleaseFrame(nil)
+}
+
+func TestRequestWithBodyStress(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.SetBody(ctx.Request.Body())
+			},
+		},
+	}
+
+	c, ln, err := getClientConn(s, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			req := fasthttp.AcquireRequest()
+			res := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseRequest(req)
+			defer fasthttp.ReleaseResponse(res)
+
+			for j := 0; j < 10; j++ {
+				body := bytes.Repeat([]byte(strconv.Itoa(i)), 1<<14+j*1000)
+
+				req.Reset()
+				res.Reset()
+
+				req.Header.SetMethod("POST")
+				req.SetRequestURI("https://localhost/echo")
+				req.SetBody(body)
+
+				if err := doRequest(c, req, res); err != nil {
+					t.Error(err)
+					return
+				}
+
+				if !bytes.Equal(res.Body(), body) {
+					t.Errorf("unexpected body: %d <> %d", len(res.Body()), len(body))
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestWriteRequestDataFrames(t *testing.T) {
+	c, peer, err := getRawConn(nil, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.c.Close()
+
+	body := bytes.Repeat([]byte("a"), 1<<14+100)
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("https://localhost/upload")
+	req.SetBody(body)
+
+	err = c.writeRequest(&Ctx{
+		Request:  req,
+		Response: &fasthttp.Response{},
+		Err:      make(chan error, 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []struct {
+		kind  FrameType
+		flags FrameFlags
+		size  int
+	}{
+		{kind: FrameHeaders, flags: FlagEndHeaders},
+		{kind: FrameData, flags: 0, size: 1 << 14},
+		{kind: FrameData, flags: FlagEndStream, size: 100},
+	}
+
+	for _, e := range expect {
+		fr, err := peer.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.Type() != e.kind {
+			t.Fatalf("unexpected frame type: %s <> %s", e.kind, fr.Type())
+		}
+
+		if fr.Flags() != e.flags {
+			t.Fatalf("unexpected flags for %s: %d <> %d", fr.Type(), e.flags, fr.Flags())
+		}
+
+		if e.kind == FrameData && fr.Len() != e.size {
+			t.Fatalf("unexpected data size: %d <> %d", e.size, fr.Len())
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+}
+
+// writeMaxStreams sends a SETTINGS frame with SETTINGS_MAX_CONCURRENT_STREAMS only,
+// as Settings doesn't encode a value of 0.
+func (p *rawPeer) writeMaxStreams(n uint32) error {
+	_, err := p.bw.Write([]byte{
+		0, 0, 6, byte(FrameSettings), 0, 0, 0, 0, 0,
+		byte(MaxConcurrentStreams >> 8), byte(MaxConcurrentStreams),
+		byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n),
+	})
+	if err == nil {
+		err = p.bw.Flush()
+	}
+
+	return err
+}
+
+// readUntil reads frames until one of type `ft` is received.
+func (p *rawPeer) readUntil(ft FrameType) (*FrameHeader, error) {
+	for {
+		fr, err := p.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		if fr.Type() == ft {
+			return fr, nil
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	c, peer, err := getRawConn(nil, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer peer.c.Close()
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	if err := c.WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	cancel()
+
+	// the server lowers the limit before acknowledging the client's settings.
+	if err := peer.writeMaxStreams(1); err != nil {
+		t.Fatal(err)
+	}
+
+	fr := AcquireFrameHeader()
+	st := AcquireFrame(FrameSettings).(*Settings)
+	st.SetAck(true)
+	fr.SetBody(st)
+
+	if err := peer.writeFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+	ReleaseFrameHeader(fr)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := c.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadUint32(&c.maxStreams); n != 1 {
+		t.Fatalf("expected max streams of 1, got %d", n)
+	}
+
+	cs, err := c.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Reset(StreamCanceled)
+
+	if c.CanOpenStream() {
+		t.Fatal("the stream limit wasn't applied")
+	}
+
+	c.Close()
+
+	if err := c.WaitReady(context.Background()); err != nil {
+		t.Fatalf("a ready connection must not return an error, got %v", err)
+	}
+}
+
+func TestMaxConcurrentStreamsZero(t *testing.T) {
+	c, peer, err := getRawConn(nil, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	if err := peer.writeMaxStreams(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the settings' ack
+	fr, err := peer.readUntil(FrameSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ReleaseFrameHeader(fr)
+
+	if c.StreamsAllowed() || c.CanOpenStream() {
+		t.Fatal("expected the connection to not allow opening streams")
+	}
+
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.Header.SetMethod("GET")
+	req.SetRequestURI("https://localhost/")
+
+	err = doRequest(c, req, res)
+	if !errors.Is(err, ErrStreamsNotAllowed) {
+		t.Fatalf("expected ErrStreamsNotAllowed, got %v", err)
+	}
+
+	cl := createClient(&Dialer{}, ClientOpts{
+		MaxResponseTime: time.Millisecond * 300,
+	})
+	cl.conns.PushBack(c)
+
+	_, err = cl.RoundTrip(nil, req, res)
+	if !errors.Is(err, ErrStreamsNotAllowed) {
+		t.Fatalf("expected ErrStreamsNotAllowed, got %v", err)
+	}
+
+	cl.opts.MaxResponseTime = time.Second * 5
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := cl.RoundTrip(nil, req, res)
+		errCh <- err
+	}()
+
+	time.Sleep(streamsCheckInterval * 2)
+
+	if err := peer.writeMaxStreams(10); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err = peer.readUntil(FrameHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := makeHeaders(fr.Stream(), AcquireHPACK(), true, true, map[string]string{
+		string(StringStatus): "200",
+	})
+	ReleaseFrameHeader(fr)
+
+	if err := peer.writeFrame(h); err != nil {
+		t.Fatal(err)
+	}
+	ReleaseFrameHeader(h)
+
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode() != 200 {
+		t.Fatalf("unexpected status code: %d", res.StatusCode())
+	}
+}
+
+func TestDialerAddr(t *testing.T) {
+	errDial := errors.New("dial")
+
+	for _, tc := range []struct {
+		addr       string
+		dialed     string
+		serverName string
+	}{
+		{"example.com:8443", "example.com:8443", "example.com"},
+		{"example.com", "example.com:443", "example.com"},
+		{"127.0.0.1", "127.0.0.1:443", "127.0.0.1"},
+		{"[::1]:8443", "[::1]:8443", "::1"},
+		{"[::1]", "[::1]:443", "::1"},
+		{"::1", "[::1]:443", "::1"},
+	} {
+		var dialed string
+
+		d := &Dialer{
+			Addr: tc.addr,
+			NetDial: func(addr string) (net.Conn, error) {
+				dialed = addr
+				return nil, errDial
+			},
+		}
+
+		if _, err := d.tryDial(); !errors.Is(err, errDial) {
+			t.Fatalf("%s: unexpected error: %v", tc.addr, err)
+		}
+
+		if dialed != tc.dialed {
+			t.Fatalf("%s: expected to dial %s, got %s", tc.addr, tc.dialed, dialed)
+		}
+
+		if d.TLSConfig.ServerName != tc.serverName {
+			t.Fatalf("%s: expected ServerName %s, got %s", tc.addr, tc.serverName, d.TLSConfig.ServerName)
+		}
+	}
+}
+
+func TestPartialResponseOnReset(t *testing.T) {
+	c, peer, err := getRawConn(nil, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer peer.c.Close()
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	go func() {
+		fr, err := peer.readUntil(FrameHeaders)
+		if err != nil {
+			return
+		}
+
+		id := fr.Stream()
+		ReleaseFrameHeader(fr)
+
+		h := makeHeaders(id, AcquireHPACK(), true, false, map[string]string{
+			string(StringStatus): "200",
+		})
+		peer.writeFrame(h)
+		ReleaseFrameHeader(h)
+
+		fr = AcquireFrameHeader()
+		fr.SetStream(id)
+
+		data := AcquireFrame(FrameData).(*Data)
+		data.SetData([]byte("partial"))
+		fr.SetBody(data)
+
+		peer.writeFrame(fr)
+
+		rst := AcquireFrame(FrameResetStream).(*RstStream)
+		rst.SetCode(InternalError)
+		fr.SetBody(rst)
+
+		peer.writeFrame(fr)
+		ReleaseFrameHeader(fr)
+
+		// keep reading what the client sends.
+		for {
+			if fr, err = peer.readFrame(); err != nil {
+				return
+			}
+			ReleaseFrameHeader(fr)
+		}
+	}()
+
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.Header.SetMethod("GET")
+	req.SetRequestURI("https://localhost/")
+
+	err = doRequest(c, req, res)
+	if !errors.Is(err, InternalError) {
+		t.Fatalf("expected a reset with InternalError, got %v", err)
+	}
+
+	if res.StatusCode() != 200 || string(res.Body()) != "partial" {
+		t.Fatalf("unexpected partial response: %d %q", res.StatusCode(), res.Body())
+	}
+
+	if c.Closed() {
+		t.Fatal("the connection must remain open after a stream reset")
+	}
+}
+
+func TestDiscardAfterHeaders(t *testing.T) {
+	c, peer, err := getRawConn(nil, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer peer.c.Close()
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	enc := AcquireHPACK()
+
+	// writeHeaders writes a header block indexing the fields, so the client
+	// fails decoding the next blocks if it doesn't decode this one.
+	writeHeaders := func(id uint32, endStream bool, fields ...string) error {
+		fr := AcquireFrameHeader()
+		defer ReleaseFrameHeader(fr)
+
+		fr.SetStream(id)
+
+		h := AcquireFrame(FrameHeaders).(*Headers)
+		h.SetEndHeaders(true)
+		h.SetEndStream(endStream)
+		fr.SetBody(h)
+
+		hf := AcquireHeaderField()
+		defer ReleaseHeaderField(hf)
+
+		for i := 0; i < len(fields); i += 2 {
+			hf.Set(fields[i], fields[i+1])
+			enc.AppendHeaderField(h, hf, true)
+		}
+
+		return peer.writeFrame(fr)
+	}
+
+	writeData := func(id uint32, b []byte) error {
+		fr := AcquireFrameHeader()
+		defer ReleaseFrameHeader(fr)
+
+		fr.SetStream(id)
+
+		data := AcquireFrame(FrameData).(*Data)
+		data.SetData(b)
+		fr.SetBody(data)
+
+		return peer.writeFrame(fr)
+	}
+
+	peerErr := make(chan error, 1)
+	go func() {
+		peerErr <- func() error {
+			fr, err := peer.readUntil(FrameHeaders)
+			if err != nil {
+				return err
+			}
+
+			id := fr.Stream()
+			ReleaseFrameHeader(fr)
+
+			if err := writeHeaders(id, false, ":status", "200", "x-first", "1"); err != nil {
+				return err
+			}
+
+			fr, err = peer.readUntil(FrameResetStream)
+			if err != nil {
+				return err
+			}
+
+			code := fr.Body().(*RstStream).Code()
+			ReleaseFrameHeader(fr)
+
+			if code != StreamCanceled {
+				return fmt.Errorf("expected StreamCanceled, got %s", code)
+			}
+
+			// the frames sent before receiving the RST_STREAM.
+			for i := 0; i < 3; i++ {
+				if err := writeData(id, make([]byte, 1<<14)); err != nil {
+					return err
+				}
+			}
+
+			if err := writeHeaders(id, true, "x-trailer", "discarded"); err != nil {
+				return err
+			}
+
+			fr, err = peer.readUntil(FrameHeaders)
+			if err != nil {
+				return err
+			}
+
+			id = fr.Stream()
+			ReleaseFrameHeader(fr)
+
+			return writeHeaders(id, true, ":status", "200", "x-trailer", "discarded")
+		}()
+
+		for {
+			fr, err := peer.readFrame()
+			if err != nil {
+				return
+			}
+			ReleaseFrameHeader(fr)
+		}
+	}()
+
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.Header.SetMethod("GET")
+	req.SetRequestURI("https://localhost/")
+
+	var ctx *Ctx
+
+	ctx = &Ctx{
+		Request:  req,
+		Response: res,
+		Err:      make(chan error, 1),
+		OnHeaders: func(res *fasthttp.Response) {
+			if err := ctx.Discard(); err != nil {
+				t.Error(err)
+			}
+		},
+	}
+
+	c.Write(ctx)
+
+	if err := <-ctx.Err; !errors.Is(err, ErrStreamDiscarded) {
+		t.Fatalf("expected ErrStreamDiscarded, got %v", err)
+	}
+
+	if string(res.Header.Peek("x-first")) != "1" {
+		t.Fatalf("expected the response headers to be kept: %s", res.Header.String())
+	}
+
+	if n := atomic.LoadInt32(&c.openStreams); n != 0 {
+		t.Fatalf("expected no open streams, got %d", n)
+	}
+
+	res.Reset()
+
+	if err := doRequest(c, req, res); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-peerErr; err != nil {
+		t.Fatal(err)
+	}
+
+	if string(res.Header.Peek("x-trailer")) != "discarded" {
+		t.Fatalf("unexpected response headers: %s", res.Header.String())
+	}
+}
+
+func TestClientStreamExchange(t *testing.T) {
+	c, peer, err := getRawConn(nil, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer peer.c.Close()
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	cs, err := c.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hfs []*HeaderField
+	for _, kv := range [][2]string{
+		{":method", "POST"},
+		{":path", "/echo"},
+		{":scheme", "https"},
+		{":authority", "localhost"},
+	} {
+		hf := AcquireHeaderField()
+		hf.Set(kv[0], kv[1])
+		hfs = append(hfs, hf)
+	}
+
+	if err := cs.WriteHeaders(hfs, false); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := peer.readUntil(FrameHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fr.Stream() != cs.ID() || fr.Flags().Has(FlagEndStream) {
+		t.Fatalf("unexpected headers frame: stream=%d flags=%d", fr.Stream(), fr.Flags())
+	}
+
+	dec, hf := AcquireHPACK(), AcquireHeaderField()
+
+	path := ""
+	for b := fr.Body().(*Headers).Headers(); len(b) > 0; {
+		if b, err = dec.Next(hf, b); err != nil {
+			t.Fatal(err)
+		}
+
+		if hf.Key() == ":path" {
+			path = hf.Value()
+		}
+	}
+	ReleaseFrameHeader(fr)
+
+	if path != "/echo" {
+		t.Fatalf("unexpected path: %q", path)
+	}
+
+	h := makeHeaders(cs.ID(), AcquireHPACK(), true, false, map[string]string{
+		string(StringStatus): "200",
+	})
+	if err := peer.writeFrame(h); err != nil {
+		t.Fatal(err)
+	}
+	ReleaseFrameHeader(h)
+
+	sf, err := cs.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sf.Headers) != 1 || sf.Headers[0].Value() != "200" || sf.EndStream {
+		t.Fatalf("unexpected response headers: %v", sf.Headers)
+	}
+
+	if err := cs.WriteData([]byte("ping"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err = peer.readUntil(FrameData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := fr.Body().(*Data).Data(); string(b) != "ping" {
+		t.Fatalf("unexpected data: %q", b)
+	}
+
+	fr.Body().(*Data).SetData([]byte("pong"))
+	fr.Body().(*Data).SetEndStream(true)
+
+	if err := peer.writeFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+	ReleaseFrameHeader(fr)
+
+	sf, err = cs.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(sf.Data) != "pong" || !sf.EndStream {
+		t.Fatalf("unexpected data: %q (end=%v)", sf.Data, sf.EndStream)
+	}
+
+	if _, err := cs.Read(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+
+	if err := cs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err = peer.readUntil(FrameData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fr.Body().(*Data).Len() != 0 || !fr.Flags().Has(FlagEndStream) {
+		t.Fatal("expected an empty DATA frame closing the stream")
+	}
+	ReleaseFrameHeader(fr)
+
+	if err := cs.WriteData([]byte("late"), false); !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("expected ErrStreamClosed, got %v", err)
+	}
+
+	if n := atomic.LoadInt32(&c.openStreams); n != 0 {
+		t.Fatalf("expected no open streams, got %d", n)
+	}
+}
+
+func TestClientStreamBidirectional(t *testing.T) {
+	c, peer, err := getRawConn(nil, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer peer.c.Close()
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	cs, err := c.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hf := AcquireHeaderField()
+	hf.Set(":path", "/echo")
+
+	if err := cs.WriteHeaders([]*HeaderField{hf}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer echoes every DATA frame, and only allows the client
+	// to send more data after the frame has been echoed.
+	peerErr := make(chan error, 1)
+	go func() {
+		defer func() {
+			// keep reading the frames the client sends after the exchange.
+			for {
+				fr, err := peer.readFrame()
+				if err != nil {
+					return
+				}
+				ReleaseFrameHeader(fr)
+			}
+		}()
+
+		peerErr <- func() error {
+			fr, err := peer.readUntil(FrameHeaders)
+			if err != nil {
+				return err
+			}
+			ReleaseFrameHeader(fr)
+
+			h := makeHeaders(cs.ID(), AcquireHPACK(), true, false, map[string]string{
+				string(StringStatus): "200",
+			})
+			if err := peer.writeFrame(h); err != nil {
+				return err
+			}
+			ReleaseFrameHeader(h)
+
+			window, updates := int(c.serverS.MaxWindowSize()), 0
+
+			for {
+				fr, err := peer.readUntil(FrameData)
+				if err != nil {
+					return err
+				}
+
+				if window -= fr.Len(); window < 0 {
+					return errors.New("the client exceeded the stream window")
+				}
+
+				end := fr.Flags().Has(FlagEndStream)
+
+				if err := peer.writeFrame(fr); err != nil {
+					return err
+				}
+
+				if end {
+					if updates == 0 {
+						return errors.New("the window was never updated")
+					}
+
+					return nil
+				}
+
+				wu := AcquireFrame(FrameWindowUpdate).(*WindowUpdate)
+				wu.SetIncrement(fr.Len())
+				window += fr.Len()
+				updates++
+
+				fr.SetBody(wu)
+
+				if err := peer.writeFrame(fr); err != nil {
+					return err
+				}
+
+				// the connection window is consumed too.
+				fr.SetStream(0)
+
+				if err := peer.writeFrame(fr); err != nil {
+					return err
+				}
+				ReleaseFrameHeader(fr)
+			}
+		}()
+	}()
+
+	msg := bytes.Repeat([]byte("0123456789abcdef"), 1<<14)
+
+	writeErr := make(chan error, 1)
+	go func() {
+		for b := msg; len(b) > 0; b = b[10000:] {
+			if len(b) <= 10000 {
+				writeErr <- cs.WriteData(b, true)
+				return
+			}
+
+			if err := cs.WriteData(b[:10000], false); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+	}()
+
+	var body []byte
+
+	for {
+		sf, err := cs.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body = append(body, sf.Data...)
+	}
+
+	if err := <-writeErr; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-peerErr; err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(body, msg) {
+		t.Fatalf("unexpected echo: got %d bytes, expected %d", len(body), len(msg))
+	}
+}
+
+func TestClientStreamConnectionWindow(t *testing.T) {
+	c, peer, err := getRawConn(nil, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer peer.c.Close()
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	// the stream window is large, but the connection only allows 10 bytes.
+	c.winLck.Lock()
+	c.serverWindow = 10
+	c.winLck.Unlock()
+
+	cs, err := c.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hf := AcquireHeaderField()
+	hf.Set(":path", "/upload")
+
+	if err := cs.WriteHeaders([]*HeaderField{hf}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := peer.readUntil(FrameHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ReleaseFrameHeader(fr)
+
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- cs.WriteData([]byte("0123456789abcdefghijklmnopqrstuv"), true)
+	}()
+
+	fr, err = peer.readUntil(FrameData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := fr.Body().(*Data).Data(); string(b) != "0123456789" || fr.Flags().Has(FlagEndStream) {
+		t.Fatalf("unexpected data: %q (end=%v)", b, fr.Flags().Has(FlagEndStream))
+	}
+
+	select {
+	case err := <-writeErr:
+		t.Fatalf("the write exceeded the connection window: %v", err)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	wu := AcquireFrame(FrameWindowUpdate).(*WindowUpdate)
+	wu.SetIncrement(22)
+
+	fr.SetStream(0)
+	fr.SetBody(wu)
+
+	if err := peer.writeFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+	ReleaseFrameHeader(fr)
+
+	fr, err = peer.readUntil(FrameData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := fr.Body().(*Data).Data(); string(b) != "abcdefghijklmnopqrstuv" || !fr.Flags().Has(FlagEndStream) {
+		t.Fatalf("unexpected data: %q (end=%v)", b, fr.Flags().Has(FlagEndStream))
+	}
+	ReleaseFrameHeader(fr)
+
+	if err := <-writeErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadIdleTimeout(t *testing.T) {
+	closed := make(chan struct{})
+
+	c, peer, err := getRawConn(nil, ConnOpts{
+		ReadIdleTimeout: time.Millisecond * 100,
+		OnDisconnect: func(*Conn) {
+			close(closed)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer peer.c.Close()
+
+	start := time.Now()
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	// the server reads everything but never replies.
+	go func() {
+		for {
+			fr, err := peer.readFrame()
+			if err != nil {
+				return
+			}
+
+			ReleaseFrameHeader(fr)
+		}
+	}()
+
+	// the pings would take several seconds to detect the dead server.
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("the connection wasn't closed")
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Millisecond*100 {
+		t.Fatalf("the connection was closed after %s", elapsed)
+	}
+
+	if c.LastErr() != ErrReadIdleTimeout {
+		t.Fatalf("unexpected error: %v", c.LastErr())
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		c, peer, err := getRawConn(nil, ConnOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go c.writeLoop()
+		go c.readLoop()
+
+		go func() {
+			for {
+				fr, err := peer.readFrame()
+				if err != nil {
+					return
+				}
+
+				ReleaseFrameHeader(fr)
+			}
+		}()
+
+		var wg sync.WaitGroup
+
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for k := 0; k < 50; k++ {
+					req := fasthttp.AcquireRequest()
+					req.Header.SetMethod("GET")
+					req.SetRequestURI("http://localhost/")
+
+					err := c.Write(&Ctx{
+						Request:  req,
+						Response: fasthttp.AcquireResponse(),
+						Err:      make(chan error, 1),
+					})
+					if err != nil && err != io.EOF {
+						t.Errorf("unexpected error: %v", err)
+					}
+				}
+			}()
+		}
+
+		c.Close()
+		wg.Wait()
+
+		if err := c.Write(&Ctx{Err: make(chan error, 1)}); err != io.EOF {
+			t.Fatalf("expected io.EOF, got %v", err)
+		}
+
+		peer.c.Close()
+	}
+}
+
+func TestOnGoAway(t *testing.T) {
+	goAways := make(chan *GoAway, 1)
+	closed := make(chan struct{})
+
+	c, peer, err := getRawConn(nil, ConnOpts{
+		OnGoAway: func(ga *GoAway) {
+			select {
+			case <-closed:
+				t.Error("the callback fired after closing the connection")
+			default:
+			}
+
+			goAways <- ga.Copy()
+		},
+		OnDisconnect: func(*Conn) {
+			close(closed)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer peer.c.Close()
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	go func() {
+		for {
+			fr, err := peer.readFrame()
+			if err != nil {
+				return
+			}
+
+			ReleaseFrameHeader(fr)
+		}
+	}()
+
+	fr := AcquireFrameHeader()
+
+	ga := AcquireFrame(FrameGoAway).(*GoAway)
+	ga.SetCode(EnhanceYourCalm)
+	ga.SetData([]byte("too many requests"))
+
+	fr.SetBody(ga)
+
+	if err := peer.writeFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+	ReleaseFrameHeader(fr)
+
+	select {
+	case ga := <-goAways:
+		if ga.Code() != EnhanceYourCalm || string(ga.Data()) != "too many requests" {
+			t.Fatalf("unexpected GOAWAY: %s %q", ga.Code(), ga.Data())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the callback didn't fire")
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("the connection wasn't closed")
+	}
+}
+
+func TestHandshakeConnectionWindow(t *testing.T) {
+	for _, win := range []int32{1 << 10, 1<<16 - 1, 1 << 20, 1 << 24} {
+		testHandshakeConnectionWindow(t, win)
+	}
+}
+
+func testHandshakeConnectionWindow(t *testing.T, win int32) {
+	pc := fasthttputil.NewPipeConns()
+	defer pc.Close()
+
+	peer := &rawPeer{
+		c:  pc.Conn2(),
+		br: bufio.NewReader(pc.Conn2()),
+		bw: bufio.NewWriter(pc.Conn2()),
+	}
+
+	st := &Settings{}
+	st.Reset()
+
+	fr := AcquireFrameHeader()
+	fr.SetBody(st)
+
+	if err := peer.writeFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConn(pc.Conn1(), ConnOpts{})
+	c.maxWindow = win
+
+	if err := c.doHandshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !ReadPreface(peer.br) {
+		t.Fatal("wrong preface")
+	}
+
+	// every connection starts with a window of 65535 bytes.
+	window := int64(defaultWindowSize)
+
+	for {
+		fr, err := peer.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch body := fr.Body().(type) {
+		case *WindowUpdate:
+			window += int64(body.Increment())
+		case *Settings:
+			if body.IsAck() {
+				ReleaseFrameHeader(fr)
+
+				expected := win
+				if expected < int32(defaultWindowSize) {
+					expected = int32(defaultWindowSize)
+				}
+
+				if window != int64(expected) || c.ConnectionWindow() != expected {
+					t.Fatalf("expected a window of %d, got %d (conn %d)", expected, window, c.ConnectionWindow())
+				}
+
+				return
+			}
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+}
+
+func TestSensitiveHeaders(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.Write(ctx.Request.Header.Peek("Authorization"))
+			},
+		},
+	}
+
+	c, ln, err := getClientConn(s, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	c.enc.Trace = true
+
+	for i := 0; i < 2; i++ {
+		req := fasthttp.AcquireRequest()
+		res := fasthttp.AcquireResponse()
+
+		req.Header.SetMethod("GET")
+		req.SetRequestURI("https://localhost/")
+		req.Header.Set("Authorization", "Bearer token")
+
+		ctx := &Ctx{
+			Request:          req,
+			Response:         res,
+			Err:              make(chan error, 1),
+			SensitiveHeaders: []string{"authorization"},
+		}
+
+		c.Write(ctx)
+
+		select {
+		case err := <-ctx.Err:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+
+		if string(res.Body()) != "Bearer token" {
+			t.Fatalf("unexpected authorization: %q", res.Body())
+		}
+
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(res)
+	}
+
+	n := 0
+
+	for _, tr := range c.enc.Traces() {
+		if tr.Key != "authorization" {
+			continue
+		}
+
+		n++
+
+		if tr.Representation != RepresentationLiteralNeverIndexed {
+			t.Fatalf("authorization encoded as %s", tr.Representation)
+		}
+	}
+
+	if n != 2 {
+		t.Fatalf("expected 2 authorization fields, got %d", n)
+	}
+
+	for _, hf := range c.enc.dynamic {
+		if hf.Key() == "authorization" {
+			t.Fatal("authorization was added to the dynamic table")
+		}
+	}
+}
+
+func TestHeaderCompressionRatio(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+		},
+	}
+
+	c, ln, err := getClientConn(s, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	var ratios []float64
+
+	for i := 0; i < 5; i++ {
+		req := fasthttp.AcquireRequest()
+		res := fasthttp.AcquireResponse()
+
+		req.Header.SetMethod("GET")
+		req.SetRequestURI("http://localhost/items")
+		req.Header.SetUserAgent("http2-test-client/1.0")
+		req.Header.Set("Cookie", "session=4c9c2ba1-8e8d-4d3a-9f7e-5d4e0b2f1a6c")
+
+		if err := doRequest(c, req, res); err != nil {
+			t.Fatal(err)
+		}
+
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(res)
+
+		ratios = append(ratios, c.HeaderCompressionRatio())
+	}
+
+	// the dynamic table warms up after the first request.
+	for i := 1; i < len(ratios); i++ {
+		if ratios[i] >= ratios[i-1] {
+			t.Fatalf("the ratio didn't improve: %v", ratios)
+		}
+	}
+}
+
+func TestConnAddrs(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+		},
+	}
+	s.cnf.defaults()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go serve(s, ln)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConn(nc, ConnOpts{})
+	if err := c.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.RemoteAddr().String() != ln.Addr().String() {
+		t.Fatalf("expected remote address %s, got %s", ln.Addr(), c.RemoteAddr())
+	}
+
+	if c.LocalAddr().String() != nc.LocalAddr().String() {
+		t.Fatalf("expected local address %s, got %s", nc.LocalAddr(), c.LocalAddr())
+	}
+
+	if _, ok := c.TLSConnectionState(); ok {
+		t.Fatal("the connection doesn't use TLS")
+	}
+}
+
+func TestConnTLSConnectionState(t *testing.T) {
+	certPEM, keyPEM, err := fasthttp.GenerateTestCertificate("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+		},
+	}
+	s.cnf.defaults()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{H2TLSProto},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go serve(s, ln)
+
+	d := &Dialer{
+		Addr: ln.Addr().String(),
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{H2TLSProto},
+		},
+	}
+
+	c, err := d.Dial(ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.RemoteAddr().String() != ln.Addr().String() {
+		t.Fatalf("expected remote address %s, got %s", ln.Addr(), c.RemoteAddr())
+	}
+
+	state, ok := c.TLSConnectionState()
+	if !ok {
+		t.Fatal("expected a TLS connection")
+	}
+
+	if state.NegotiatedProtocol != H2TLSProto {
+		t.Fatalf("unexpected protocol %q", state.NegotiatedProtocol)
+	}
+}
+
+func TestConnInfo(t *testing.T) {
+	certPEM, keyPEM, err := fasthttp.GenerateTestCertificate("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := ConfigureServer(&fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {},
+	}, ServerConfig{
+		MaxConcurrentStreams: 32,
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go s.ServeTLS(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+
+	d := &Dialer{
+		Addr: ln.Addr().String(),
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{H2TLSProto},
+		},
+	}
+
+	c, err := d.Dial(ConnOpts{
+		PingInterval: time.Millisecond * 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.Header.SetMethod("GET")
+	req.SetRequestURI("https://localhost/")
+
+	if err := doRequest(c, req, res); err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for a ping to be acknowledged.
+	deadline := time.Now().Add(time.Second)
+	for c.Info().RTT == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	info := c.Info()
+
+	if info.Protocol != H2TLSProto {
+		t.Fatalf("unexpected protocol %q", info.Protocol)
+	}
+
+	if info.TLSVersion < tls.VersionTLS12 {
+		t.Fatalf("unexpected TLS version %x", info.TLSVersion)
+	}
+
+	if n := info.ServerSettings.MaxConcurrentStreams(); n != 32 {
+		t.Fatalf("expected the server's max streams of 32, got %d", n)
+	}
+
+	if info.RTT <= 0 {
+		t.Fatal("the RTT wasn't measured")
+	}
+
+	if info.OpenStreams != 0 {
+		t.Fatalf("unexpected open streams: %d", info.OpenStreams)
+	}
+}
+
+func TestRequestBodyFlowControl(t *testing.T) {
+	const streamWindow = 1000
+
+	st := &Settings{}
+	st.Reset()
+	st.SetMaxWindowSize(streamWindow)
+
+	c, peer, err := getRawConn(st, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer peer.c.Close()
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	windowUpdate := func(id uint32, n int) error {
+		fr := AcquireFrameHeader()
+		defer ReleaseFrameHeader(fr)
+
+		fr.SetStream(id)
+
+		wu := AcquireFrame(FrameWindowUpdate).(*WindowUpdate)
+		wu.SetIncrement(n)
+		fr.SetBody(wu)
+
+		return peer.writeFrame(fr)
+	}
+
+	body := bytes.Repeat([]byte("a"), 200000)
+
+	peerErr := make(chan error, 1)
+	go func() {
+		peerErr <- func() error {
+			fr, err := peer.readUntil(FrameHeaders)
+			if err != nil {
+				return err
+			}
+
+			id := fr.Stream()
+			ReleaseFrameHeader(fr)
+
+			connWindow, strmWindow := int(defaultWindowSize), streamWindow
+			received := 0
+
+			for {
+				fr, err := peer.readUntil(FrameData)
+				if err != nil {
+					return err
+				}
+
+				n, end := fr.Len(), fr.Flags().Has(FlagEndStream)
+				ReleaseFrameHeader(fr)
+
+				connWindow -= n
+				strmWindow -= n
+				received += n
+
+				if connWindow < 0 || strmWindow < 0 {
+					return fmt.Errorf("the client exceeded the window: connection=%d stream=%d", connWindow, strmWindow)
+				}
+
+				if end {
+					break
+				}
+
+				// the windows are updated once they are exhausted.
+				if strmWindow == 0 {
+					if err := windowUpdate(id, streamWindow); err != nil {
+						return err
+					}
+
+					strmWindow = streamWindow
+				}
+
+				if connWindow < streamWindow {
+					if err := windowUpdate(0, int(defaultWindowSize)-connWindow); err != nil {
+						return err
+					}
+
+					connWindow = int(defaultWindowSize)
+				}
+			}
+
+			if received != len(body) {
+				return fmt.Errorf("expected %d bytes, got %d", len(body), received)
+			}
+
+			fr = AcquireFrameHeader()
+			defer ReleaseFrameHeader(fr)
+
+			fr.SetStream(id)
+
+			h := AcquireFrame(FrameHeaders).(*Headers)
+			h.SetEndHeaders(true)
+			h.SetEndStream(true)
+			fr.SetBody(h)
+
+			enc := AcquireHPACK()
+			defer ReleaseHPACK(enc)
+
+			hf := AcquireHeaderField()
+			defer ReleaseHeaderField(hf)
+
+			hf.Set(":status", "200")
+			enc.AppendHeaderField(h, hf, true)
+
+			return peer.writeFrame(fr)
+		}()
+	}()
+
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("https://localhost/")
+	req.SetBody(body)
+
+	if err := doRequest(c, req, res); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-peerErr; err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode() != 200 {
+		t.Fatalf("unexpected status code %d", res.StatusCode())
+	}
+}
+
+func TestRequestBodyWindowUpdates(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.SetBodyString(strconv.Itoa(len(ctx.Request.Body())))
+			},
+		},
+		cnf: ServerConfig{
+			ConnectionWindowSize: 1 << 16,
+			StreamWindowSize:     1 << 14,
+		},
+	}
+
+	c, ln, err := getClientConn(s, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("https://localhost/")
+
+	// the bodies are larger than the windows advertised by the server,
+	// so the server must update them while receiving the bodies.
+	for i := 0; i < 3; i++ {
+		req.SetBody(bytes.Repeat([]byte("a"), 1<<17))
+		res.Reset()
+
+		if err := doRequest(c, req, res); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(res.Body()) != strconv.Itoa(1<<17) {
+			t.Fatalf("unexpected body %q", res.Body())
+		}
+	}
+}
+
+func TestWriteBodyError(t *testing.T) {
+	st := &Settings{}
+	st.Reset()
+	st.SetMaxWindowSize(10)
+
+	c, peer, err := getRawConn(st, ConnOpts{
+		PingInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer peer.c.Close()
+
+	errWrite := errors.New("broken pipe")
+
+	fc := &failingConn{Conn: c.c, err: errWrite}
+	c.bw.Reset(fc)
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("http://localhost/")
+	req.SetBody(bytes.Repeat([]byte("a"), 100))
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- doRequest(c, req, res)
+	}()
+
+	fr, err := peer.readUntil(FrameData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := fr.Stream()
+	ReleaseFrameHeader(fr)
+
+	// the rest of the body is sent after the window update.
+	atomic.StoreInt32(&fc.fail, 1)
+
+	fr = AcquireFrameHeader()
+	fr.SetStream(id)
+
+	wu := AcquireFrame(FrameWindowUpdate).(*WindowUpdate)
+	wu.SetIncrement(100)
+	fr.SetBody(wu)
+
+	err = peer.writeFrame(fr)
+	ReleaseFrameHeader(fr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errCh; !errors.Is(err, errWrite) {
+		t.Fatalf("expected %v, got %v", errWrite, err)
+	}
+}
+
+func TestDataBeforeHeaders(t *testing.T) {
+	c, peer, err := getRawConn(nil, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer peer.c.Close()
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.SetRequestURI("http://localhost/")
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- doRequest(c, req, res)
+	}()
+
+	fr, err := peer.readUntil(FrameHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := fr.Stream()
+	ReleaseFrameHeader(fr)
+
+	// the response starts with a DATA frame.
+	if err := writeData(peer.bw, id, []byte("body"), true); err != nil {
+		t.Fatal(err)
+	}
+
+	peer.bw.Flush()
+
+	if err := <-errCh; !errors.Is(err, ProtocolError) {
+		t.Fatalf("expected ProtocolError, got %v", err)
+	}
+
+	fr, err = peer.readUntil(FrameResetStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ReleaseFrameHeader(fr)
+
+	if code := fr.Body().(*RstStream).Code(); fr.Stream() != id || code != ProtocolError {
+		t.Fatalf("expected a RST_STREAM with ProtocolError on stream %d, got %s on stream %d", id, code, fr.Stream())
+	}
+}
+
+func TestConnSetPingInterval(t *testing.T) {
+	c, peer, err := getRawConn(nil, ConnOpts{
+		PingInterval:        time.Hour,
+		DisablePingChecking: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	const interval = 20 * time.Millisecond
+
+	start := time.Now()
+	c.SetPingInterval(interval)
+
+	for i := 0; i < 3; i++ {
+		fr, err := peer.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.Type() != FramePing {
+			t.Fatalf("unexpected %s frame", fr.Type())
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+
+	if elapsed := time.Since(start); elapsed < 3*interval || elapsed > time.Second {
+		t.Fatalf("expected 3 pings every %s, got them in %s", interval, elapsed)
+	}
+}
+
+func TestRequestDataFrameSize(t *testing.T) {
+	st := &Settings{}
+	st.Reset()
+	st.SetMaxFrameSize(1 << 15)
+
+	c, peer, err := getRawConn(st, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("http://localhost/")
+	req.SetBody(bytes.Repeat([]byte("a"), 40000))
+
+	go doRequest(c, req, res)
+
+	var sizes []int
+
+	for end := false; !end; {
+		fr, err := ReadFrameFromWithSize(peer.br, 1<<15)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.Type() == FrameData {
+			sizes = append(sizes, fr.Len())
+			end = fr.Flags().Has(FlagEndStream)
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+
+	if len(sizes) != 2 || sizes[0] != 1<<15 || sizes[1] != 40000-1<<15 {
+		t.Fatalf("unexpected DATA frame sizes %v", sizes)
+	}
+}
+
+func TestDialerDisablesRenegotiation(t *testing.T) {
+	errDial := errors.New("dial")
+
+	d := &Dialer{
+		Addr: "example.com",
+		TLSConfig: &tls.Config{
+			NextProtos:    []string{"h2"},
+			Renegotiation: tls.RenegotiateFreelyAsClient,
+		},
+		NetDial: func(string) (net.Conn, error) {
+			return nil, errDial
+		},
+	}
+
+	if _, err := d.tryDial(); !errors.Is(err, errDial) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if d.TLSConfig.Renegotiation != tls.RenegotiateNever {
+		t.Fatalf("expected the renegotiation to be disabled, got %v", d.TLSConfig.Renegotiation)
+	}
+}
+
+func TestGoAwayLastStream(t *testing.T) {
+	c, peer, err := getRawConn(nil, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer peer.c.Close()
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	ctxs := make([]*Ctx, 2)
+
+	for i := range ctxs {
+		req := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(req)
+
+		req.SetRequestURI("https://localhost/")
+
+		ctxs[i] = &Ctx{
+			Request:  req,
+			Response: &fasthttp.Response{},
+			Err:      make(chan error, 1),
+		}
+
+		if err := c.Write(ctxs[i]); err != nil {
+			t.Fatal(err)
+		}
+
+		fr, err := peer.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ReleaseFrameHeader(fr)
+	}
+
+	if c.GoAway() != nil {
+		t.Fatal("unexpected GOAWAY before receiving it")
+	}
+
+	fr := AcquireFrameHeader()
+
+	ga := AcquireFrame(FrameGoAway).(*GoAway)
+	ga.SetStream(1)
+	ga.SetCode(NoError)
+	ga.SetData([]byte("shutting down"))
+
+	fr.SetBody(ga)
+
+	if err := peer.writeFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+	ReleaseFrameHeader(fr)
+
+	// the stream 3 was not processed by the server.
+	select {
+	case err := <-ctxs[1].Err:
+		var ga *GoAway
+		if !errors.As(err, &ga) || ga.Stream() != 1 {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the request above the last stream wasn't resolved")
+	}
+
+	ga = c.GoAway()
+	if ga == nil || ga.Stream() != 1 || ga.Code() != NoError || string(ga.Data()) != "shutting down" {
+		t.Fatalf("unexpected GOAWAY: %v", ga)
+	}
+
+	fr = makeHeaders(1, AcquireHPACK(), true, true, map[string]string{
+		string(StringStatus): "200",
+	})
+
+	if err := peer.writeFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+	ReleaseFrameHeader(fr)
+
+	// the streams up to the last one are still completed.
+	select {
+	case err := <-ctxs[0].Err:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the request below the last stream wasn't completed")
+	}
+}
@@ -1,5 +1,9 @@
 package http2
 
+import (
+	"fmt"
+)
+
 const FrameContinuation FrameType = 0x9
 
 var (
@@ -21,6 +25,11 @@ func (c *Continuation) Type() FrameType {
 	return FrameContinuation
 }
 
+// String returns a readable representation of the frame, meant for debugging.
+func (c *Continuation) String() string {
+	return fmt.Sprintf("CONTINUATION[EndHeaders=%v Length=%d]", c.endHeaders, len(c.rawHeaders))
+}
+
 func (c *Continuation) Reset() {
 	c.endHeaders = false
 	c.rawHeaders = c.rawHeaders[:0]
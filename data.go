@@ -1,6 +1,8 @@
 package http2
 
 import (
+	"fmt"
+
 	"github.com/dgrr/http2/http2utils"
 )
 
@@ -25,6 +27,11 @@ func (data *Data) Type() FrameType {
 	return FrameData
 }
 
+// String returns a readable representation of the frame, meant for debugging.
+func (data *Data) String() string {
+	return fmt.Sprintf("DATA[EndStream=%v Padding=%v Length=%d]", data.endStream, data.hasPadding, len(data.b))
+}
+
 func (data *Data) Reset() {
 	data.endStream = false
 	data.hasPadding = false
@@ -38,6 +38,7 @@ func requestHandler(ctx *fasthttp.RequestCtx) {
 	defer fasthttp.ReleaseResponse(res)
 
 	ctx.Request.CopyTo(req)
+	http2.StripHopByHopHeaders(&req.Header)
 
 	req.Header.SetProtocol("HTTP/1.1")
 	req.SetRequestURI("http://localhost:8080" + string(ctx.RequestURI()))
@@ -0,0 +1,49 @@
+package http2
+
+// FlowController decides when the flow-control windows of the data received
+// are replenished with a WINDOW_UPDATE frame.
+//
+// The same FlowController is used by all the windows of a connection, and it
+// might be shared between connections, so the implementations keeping state
+// (like the ones estimating the bandwidth-delay product) must be safe for concurrent use.
+type FlowController interface {
+	// Consumed is called after receiving `n` bytes of flow-controlled data
+	// on the stream `id`. An `id` of 0 refers to the connection's window.
+	Consumed(id uint32, n int32)
+
+	// WindowUpdate returns the increment of the WINDOW_UPDATE frame to send for the window
+	// of the stream `id`, where `window` is the number of bytes the peer can still send
+	// and `max` the size of the window advertised.
+	//
+	// If WindowUpdate returns 0 no frame is sent.
+	// The window can't be incremented above `max`.
+	WindowUpdate(id uint32, window, max int32) int32
+}
+
+// halfWindow is the default FlowController, which replenishes the windows
+// once less than half of them is left.
+type halfWindow struct{}
+
+func (halfWindow) Consumed(uint32, int32) {}
+
+func (halfWindow) WindowUpdate(_ uint32, window, max int32) int32 {
+	if window < max/2 {
+		return max - window
+	}
+
+	return 0
+}
+
+// windowIncrement returns the increment chosen by `fc` for `window`, limited to `max`.
+func windowIncrement(fc FlowController, id uint32, window, max int32) int32 {
+	inc := fc.WindowUpdate(id, window, max)
+	if inc > max-window {
+		inc = max - window
+	}
+
+	if inc < 0 {
+		inc = 0
+	}
+
+	return inc
+}
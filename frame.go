@@ -123,6 +123,43 @@ func AcquireFrame(ftype FrameType) Frame {
 	return fr
 }
 
+// copyFrame returns a copy of fr acquired from the pool.
+func copyFrame(fr Frame) Frame {
+	cp := AcquireFrame(fr.Type())
+
+	switch fr := fr.(type) {
+	case *Data:
+		fr.CopyTo(cp.(*Data))
+	case *Headers:
+		fr.CopyTo(cp.(*Headers))
+	case *Priority:
+		fr.CopyTo(cp.(*Priority))
+	case *RstStream:
+		fr.CopyTo(cp.(*RstStream))
+	case *Settings:
+		fr.CopyTo(cp.(*Settings))
+	case *PushPromise:
+		fr.CopyTo(cp.(*PushPromise))
+	case *Ping:
+		fr.CopyTo(cp.(*Ping))
+	case *GoAway:
+		fr.CopyTo(cp.(*GoAway))
+	case *WindowUpdate:
+		fr.CopyTo(cp.(*WindowUpdate))
+	case *Continuation:
+		fr.CopyTo(cp.(*Continuation))
+	}
+
+	return cp
+}
+
+// ReleaseFrame puts fr back into its pool.
+//
+// fr must not be referenced by any FrameHeader after calling this function.
 func ReleaseFrame(fr Frame) {
+	if fr == nil {
+		return
+	}
+
 	framePools[fr.Type()].Put(fr)
 }
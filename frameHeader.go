@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"net"
 	"sync"
+	"time"
 
 	"github.com/dgrr/http2/http2utils"
 )
@@ -42,6 +44,7 @@ var frameHeaderPool = sync.Pool{
 // delete the FrameHeader
 //
 // FrameHeader instance MUST NOT be used from different goroutines.
+// Use Clone to hand a copy of the frame to another goroutine.
 //
 // https://tools.ietf.org/html/rfc7540#section-4.1
 type FrameHeader struct {
@@ -56,18 +59,35 @@ type FrameHeader struct {
 	payload   []byte
 
 	fr Frame
+
+	// released guards against returning the same FrameHeader to the pool twice.
+	released bool
 }
 
 // AcquireFrameHeader gets a FrameHeader from pool.
 func AcquireFrameHeader() *FrameHeader {
 	fr := frameHeaderPool.Get().(*FrameHeader)
 	fr.Reset()
+	fr.released = false
 	return fr
 }
 
 // ReleaseFrameHeader reset and puts fr to the pool.
+//
+// The body of the frame (if any) is released too. Releasing the same
+// FrameHeader more than once is a no-op.
 func ReleaseFrameHeader(fr *FrameHeader) {
-	ReleaseFrame(fr.Body())
+	if fr.released {
+		return
+	}
+
+	fr.released = true
+
+	if fr.fr != nil {
+		ReleaseFrame(fr.fr)
+		fr.fr = nil
+	}
+
 	frameHeaderPool.Put(fr)
 }
 
@@ -137,30 +157,40 @@ func ReadFrameFrom(br *bufio.Reader) (*FrameHeader, error) {
 
 	_, err := fr.ReadFrom(br)
 	if err != nil {
-		if fr.Body() != nil {
-			ReleaseFrameHeader(fr)
-		} else {
-			frameHeaderPool.Put(fr)
-		}
-
+		ReleaseFrameHeader(fr)
 		fr = nil
 	}
 
 	return fr, err
 }
 
+// ReadFrameFromTimeout reads a frame from `br`, failing if the frame is not received within `timeout`.
+//
+// `br` must be reading from `c`, whose read deadline bounds the wait and is unset before returning.
+// If the frame is not received in time, the returned error is a net.Error whose Timeout method returns true.
+// In that case `br` might contain part of a frame, so the connection shouldn't be used anymore.
+//
+// It is meant for probing the HTTP/2 support of a server, for example
+// reading the SETTINGS frame the server sends after the preface.
+func ReadFrameFromTimeout(c net.Conn, br *bufio.Reader, timeout time.Duration) (*FrameHeader, error) {
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	fr, err := ReadFrameFrom(br)
+
+	_ = c.SetReadDeadline(time.Time{})
+
+	return fr, err
+}
+
 func ReadFrameFromWithSize(br *bufio.Reader, max uint32) (*FrameHeader, error) {
 	fr := AcquireFrameHeader()
 	fr.maxLen = max
 
 	_, err := fr.ReadFrom(br)
 	if err != nil {
-		if fr.Body() != nil {
-			ReleaseFrameHeader(fr)
-		} else {
-			frameHeaderPool.Put(fr)
-		}
-
+		ReleaseFrameHeader(fr)
 		fr = nil
 	}
 
@@ -178,6 +208,7 @@ func (f *FrameHeader) ReadFrom(br *bufio.Reader) (int64, error) {
 
 // TODO: Delete rb?
 func (f *FrameHeader) readFrom(br *bufio.Reader) (int64, error) {
+	// Peek keeps reading until the header is buffered, so it can be received in many reads.
 	header, err := br.Peek(DefaultFrameSize)
 	if err != nil {
 		return -1, err
@@ -193,7 +224,8 @@ func (f *FrameHeader) readFrom(br *bufio.Reader) (int64, error) {
 		return 0, err
 	}
 
-	if f.kind > FrameContinuation {
+	// FrameType is signed, so the types above 0x7f are negative.
+	if f.kind < 0 || f.kind > FrameContinuation {
 		_, _ = br.Discard(f.length)
 		return 0, ErrUnknownFrameType
 	}
@@ -212,6 +244,8 @@ func (f *FrameHeader) readFrom(br *bufio.Reader) (int64, error) {
 		n, err = io.ReadFull(br, f.payload[:n])
 		if err != nil {
 			ReleaseFrame(f.fr)
+			f.fr = nil
+
 			return 0, err
 		}
 
@@ -241,6 +275,41 @@ func (f *FrameHeader) WriteTo(w *bufio.Writer) (wb int64, err error) {
 	return wb, err
 }
 
+// Clone returns a deep copy of the frame and its body, acquired from the pool.
+//
+// The clone doesn't share any memory with `f`, so it can be handed to
+// another goroutine while `f` is reused. The clone must be released using ReleaseFrameHeader.
+func (f *FrameHeader) Clone() *FrameHeader {
+	fr := AcquireFrameHeader()
+
+	fr.length = f.length
+	fr.kind = f.kind
+	fr.flags = f.flags
+	fr.stream = f.stream
+	fr.maxLen = f.maxLen
+	fr.rawHeader = f.rawHeader
+	fr.payload = append(fr.payload[:0], f.payload...)
+
+	if f.fr != nil {
+		fr.fr = copyFrame(f.fr)
+	}
+
+	return fr
+}
+
+// String returns a readable representation of the frame and its body, meant for debugging.
+//
+// The length is the one of the last frame read or written.
+func (f *FrameHeader) String() string {
+	s := fmt.Sprintf("%s(stream=%d, flags=%#x, length=%d)", f.kind, f.stream, uint8(f.flags), f.length)
+
+	if body, ok := f.fr.(fmt.Stringer); ok {
+		s += " " + body.String()
+	}
+
+	return s
+}
+
 func (f *FrameHeader) Body() Frame {
 	return f.fr
 }
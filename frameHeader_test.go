@@ -3,10 +3,16 @@ package http2
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/dgrr/http2/http2utils"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
 )
 
 const (
@@ -86,4 +92,308 @@ func TestFrameRead(t *testing.T) {
 	}
 }
 
+func TestFrameReadOneByte(t *testing.T) {
+	bf := bytes.NewBuffer(nil)
+	bw := bufio.NewWriter(bf)
+
+	fr := AcquireFrameHeader()
+	fr.SetStream(1)
+
+	data := AcquireFrame(FrameData).(*Data)
+	data.SetData([]byte(testStr))
+	fr.SetBody(data)
+
+	fr.WriteTo(bw)
+	ReleaseFrameHeader(fr)
+
+	// a frame of an unknown type, whose payload is discarded.
+	var h [9]byte
+
+	http2utils.Uint24ToBytes(h[:3], 4)
+	h[3] = 0xff
+
+	bw.Write(h[:])
+	bw.WriteString("abcd")
+
+	fr = AcquireFrameHeader()
+
+	ping := AcquireFrame(FramePing).(*Ping)
+	ping.SetData([]byte("12345678"))
+	fr.SetBody(ping)
+
+	fr.WriteTo(bw)
+	ReleaseFrameHeader(fr)
+
+	bw.Flush()
+
+	// every Read returns a single byte, like a frame received in 1-byte TCP segments.
+	br := bufio.NewReader(iotest.OneByteReader(bf))
+
+	fr, err := ReadFrameFrom(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fr.Type() != FrameData || fr.Stream() != 1 || string(fr.Body().(*Data).Data()) != testStr {
+		t.Fatalf("unexpected frame: %s", fr)
+	}
+
+	ReleaseFrameHeader(fr)
+
+	if _, err = ReadFrameFrom(br); err != ErrUnknownFrameType {
+		t.Fatalf("expected ErrUnknownFrameType, got %v", err)
+	}
+
+	fr, err = ReadFrameFrom(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fr.Type() != FramePing || string(fr.Body().(*Ping).Data()) != "12345678" {
+		t.Fatalf("unexpected frame: %s", fr)
+	}
+
+	ReleaseFrameHeader(fr)
+
+	if _, err = ReadFrameFrom(br); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
 // TODO: continue
+
+func TestReadFrameFromTimeout(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+		},
+	}
+	s.cnf.defaults()
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go serve(s, ln)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	br := bufio.NewReader(c)
+	bw := bufio.NewWriter(c)
+
+	st := &Settings{}
+	st.Reset()
+
+	if err := Handshake(true, bw, st, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := ReadFrameFromTimeout(c, br, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st, ok := fr.Body().(*Settings); !ok || st.IsAck() {
+		t.Fatalf("expected the server's SETTINGS, got %s", fr.Type())
+	}
+
+	ReleaseFrameHeader(fr)
+
+	// the server doesn't send anything else after the handshake.
+	for {
+		fr, err := ReadFrameFromTimeout(c, br, time.Millisecond*100)
+		if err != nil {
+			if ne, ok := err.(interface{ Timeout() bool }); !ok || !ne.Timeout() {
+				t.Fatalf("expected a timeout, got %v", err)
+			}
+
+			break
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+}
+
+func TestFrameHeaderClone(t *testing.T) {
+	fr := AcquireFrameHeader()
+	fr.SetStream(3)
+
+	data := AcquireFrame(FrameData).(*Data)
+	data.SetEndStream(true)
+	data.SetData([]byte(testStr))
+
+	fr.SetBody(data)
+
+	// round-trip the frame, so the header and the payload are set too.
+	var bf bytes.Buffer
+
+	bw := bufio.NewWriter(&bf)
+	fr.WriteTo(bw)
+	bw.Flush()
+
+	original := append([]byte(nil), bf.Bytes()...)
+
+	ReleaseFrameHeader(fr)
+
+	fr, err := ReadFrameFrom(bufio.NewReader(&bf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone := fr.Clone()
+	defer ReleaseFrameHeader(clone)
+
+	// the original is modified and reused after being cloned.
+	fr.SetStream(5)
+	fr.SetFlags(0)
+	copy(fr.payload, "xxxx")
+	fr.Body().(*Data).SetEndStream(false)
+	fr.Body().(*Data).SetData([]byte("modified"))
+
+	ReleaseFrameHeader(fr)
+
+	reused := AcquireFrameHeader()
+	reused.SetBody(AcquireFrame(FramePing))
+	defer ReleaseFrameHeader(reused)
+
+	if clone.Type() != FrameData || clone.Stream() != 3 || !clone.Flags().Has(FlagEndStream) {
+		t.Fatalf("unexpected clone: type=%s stream=%d flags=%d", clone.Type(), clone.Stream(), clone.Flags())
+	}
+
+	if clone.Len() != len(testStr) {
+		t.Fatalf("unexpected length: %d", clone.Len())
+	}
+
+	cdata := clone.Body().(*Data)
+	if string(cdata.Data()) != testStr || !cdata.EndStream() {
+		t.Fatalf("unexpected body: %q", cdata.Data())
+	}
+
+	bf.Reset()
+	clone.WriteTo(bw)
+	bw.Flush()
+
+	if !bytes.Equal(bf.Bytes(), original) {
+		t.Fatalf("the clone serializes differently: %x <> %x", bf.Bytes(), original)
+	}
+}
+
+func TestFrameString(t *testing.T) {
+	data := AcquireFrame(FrameData).(*Data)
+	data.SetEndStream(true)
+	data.SetData([]byte(testStr))
+
+	h := AcquireFrame(FrameHeaders).(*Headers)
+	h.SetEndHeaders(true)
+	h.SetStream(1)
+	h.SetWeight(16)
+	h.SetHeaders([]byte{0x82, 0x84})
+
+	pry := AcquireFrame(FramePriority).(*Priority)
+	pry.SetStream(3)
+	pry.SetWeight(32)
+
+	rst := AcquireFrame(FrameResetStream).(*RstStream)
+	rst.SetCode(StreamCanceled)
+
+	st := AcquireFrame(FrameSettings).(*Settings)
+	st.SetAck(true)
+
+	pp := AcquireFrame(FramePushPromise).(*PushPromise)
+	pp.SetHeader([]byte{0x82})
+
+	ping := AcquireFrame(FramePing).(*Ping)
+	ping.SetData([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	ping.SetAck(true)
+
+	ga := AcquireFrame(FrameGoAway).(*GoAway)
+	ga.SetStream(7)
+	ga.SetCode(ProtocolError)
+	ga.SetData([]byte("bye"))
+
+	wu := AcquireFrame(FrameWindowUpdate).(*WindowUpdate)
+	wu.SetIncrement(1024)
+
+	cont := AcquireFrame(FrameContinuation).(*Continuation)
+	cont.SetHeader([]byte{0x82, 0x84, 0x86})
+
+	for _, tc := range []struct {
+		fr       Frame
+		expected string
+	}{
+		{data, "DATA[EndStream=true Padding=false Length=25]"},
+		{h, "HEADERS[EndStream=false EndHeaders=true Padding=false Dependency=1 Weight=16 Length=2]"},
+		{pry, "PRIORITY[Dependency=3 Weight=32]"},
+		{rst, "RST_STREAM[Code=StreamCanceled]"},
+		{st, "SETTINGS[ACK]"},
+		{pp, "PUSH_PROMISE[PromisedStream=0 EndHeaders=false Padding=false Length=1]"},
+		{ping, "PING[Ack=true Data=0102030405060708]"},
+		{ga, `GOAWAY[LastStream=7 Code=ProtocolError Data="bye"]`},
+		{wu, "WINDOW_UPDATE[Increment=1024]"},
+		{cont, "CONTINUATION[EndHeaders=false Length=3]"},
+	} {
+		if s := tc.fr.(fmt.Stringer).String(); s != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.fr.Type(), tc.expected, s)
+		}
+	}
+
+	fr := AcquireFrameHeader()
+	defer ReleaseFrameHeader(fr)
+
+	fr.SetStream(5)
+	fr.SetBody(wu)
+
+	// the flags and the length are set when the frame is serialized.
+	bw := bufio.NewWriter(io.Discard)
+	fr.WriteTo(bw)
+
+	expected := "FrameWindowUpdate(stream=5, flags=0x0, length=4) WINDOW_UPDATE[Increment=1024]"
+	if s := fr.String(); s != expected {
+		t.Fatalf("expected %q, got %q", expected, s)
+	}
+}
+
+func TestSettingsBase64(t *testing.T) {
+	st := &Settings{}
+	st.Reset()
+	st.SetMaxConcurrentStreams(250)
+	st.SetMaxWindowSize(1 << 20)
+	st.SetMaxFrameSize(1 << 15)
+	st.SetMaxHeaderListSize(8192)
+	st.SetPush(true)
+
+	s := EncodeSettingsBase64(st)
+	if strings.ContainsAny(s, "+/=") {
+		t.Fatalf("expected base64url without padding, got %q", s)
+	}
+
+	for _, v := range []string{s, s + strings.Repeat("=", (4-len(s)%4)%4)} {
+		st2, err := DecodeSettingsBase64(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if st2.String() != st.String() {
+			t.Fatalf("expected %s, got %s", st, st2)
+		}
+	}
+
+	// SETTINGS_ENABLE_PUSH=0 and SETTINGS_INITIAL_WINDOW_SIZE=4194304.
+	st2, err := DecodeSettingsBase64("AAIAAAAAAAQAQAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st2.Push() || st2.MaxWindowSize() != 4<<20 || st2.MaxFrameSize() != defaultDataFrameSize {
+		t.Fatalf("unexpected settings %s", st2)
+	}
+
+	for _, v := range []string{"AAIAAAA", "not base64!"} {
+		if _, err := DecodeSettingsBase64(v); err == nil {
+			t.Fatalf("expected an error decoding %q", v)
+		}
+	}
+}
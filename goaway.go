@@ -25,6 +25,11 @@ func (ga *GoAway) Type() FrameType {
 	return FrameGoAway
 }
 
+// String returns a readable representation of the frame, meant for debugging.
+func (ga *GoAway) String() string {
+	return fmt.Sprintf("GOAWAY[LastStream=%d Code=%s Data=%q]", ga.stream, ga.code.String(), ga.data)
+}
+
 func (ga *GoAway) Reset() {
 	ga.stream = 0
 	ga.code = 0
@@ -0,0 +1,137 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+
+	"github.com/valyala/fasthttp"
+)
+
+// h2cUpgrade contains the request and the settings of an HTTP/1.1 connection upgraded to h2c.
+type h2cUpgrade struct {
+	req      *fasthttp.Request
+	settings *Settings
+}
+
+// bufferedConn is a net.Conn whose first bytes have been read into br.
+type bufferedConn struct {
+	net.Conn
+
+	br *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.br.Read(b)
+}
+
+// CloseWrite closes the writing side of the underlying connection.
+func (bc *bufferedConn) CloseWrite() error {
+	if cw, ok := bc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return errors.New("the connection doesn't support CloseWrite")
+}
+
+// ServeConnH2C serves a cleartext connection, like the ones received
+// from a load balancer terminating TLS.
+//
+// The connections starting with the HTTP/2 preface are served as HTTP/2 (with prior knowledge),
+// and the rest are served by the fasthttp.Server as HTTP/1.1. To let the HTTP/1.1 clients upgrade
+// the connection, the fasthttp.Server's Handler must be wrapped with H2CUpgrade.
+//
+// https://tools.ietf.org/html/rfc7540#section-3.4
+func (s *Server) ServeConnH2C(c net.Conn) error {
+	if s.cnf.ProxyProtocol {
+		pc, err := readProxyHeader(c)
+		if err != nil {
+			_ = c.Close()
+			return err
+		}
+
+		c = pc
+	}
+
+	br := bufio.NewReader(c)
+
+	// the bytes are compared as they are received, as an HTTP/1.1 request might be shorter than the preface.
+	for i := 1; i <= prefaceLen; i++ {
+		b, err := br.Peek(i)
+		if err != nil {
+			_ = c.Close()
+			return err
+		}
+
+		if b[i-1] != http2Preface[i-1] {
+			return s.s.ServeConn(&bufferedConn{Conn: c, br: br})
+		}
+	}
+
+	cnf := s.cnf
+	cnf.ProxyProtocol = false
+
+	return s.serveConn(&bufferedConn{Conn: c, br: br}, cnf)
+}
+
+// H2CUpgrade returns a fasthttp.RequestHandler upgrading to h2c the HTTP/1.1 connections
+// of the requests with an `Upgrade: h2c` and an HTTP2-Settings header, as described in RFC 7540 section 3.2.
+//
+// The upgraded connections are served as HTTP/2, where the request that triggered the upgrade
+// is served as the stream 1. The rest of requests, including the ones received over TLS, are passed to `next`.
+func (s *Server) H2CUpgrade(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if ctx.IsTLS() || StreamFromCtx(ctx) != nil || !isH2CUpgrade(&ctx.Request.Header) {
+			next(ctx)
+			return
+		}
+
+		// RFC(3.2.1):
+		//
+		// A server MUST NOT upgrade the connection to HTTP/2 if this header field
+		// is not present or if more than one is present.
+		values := ctx.Request.Header.PeekAll("HTTP2-Settings")
+		if len(values) != 1 {
+			next(ctx)
+			return
+		}
+
+		st, err := DecodeSettingsBase64(string(values[0]))
+		if err != nil {
+			next(ctx)
+			return
+		}
+
+		req := fasthttp.AcquireRequest()
+		ctx.Request.CopyTo(req)
+
+		// the connection-specific fields are not valid in HTTP/2.
+		req.Header.Del(fasthttp.HeaderConnection)
+		req.Header.Del(fasthttp.HeaderUpgrade)
+		req.Header.Del("HTTP2-Settings")
+
+		ctx.Response.Reset()
+		ctx.SetStatusCode(fasthttp.StatusSwitchingProtocols)
+		ctx.Response.Header.Set(fasthttp.HeaderConnection, "Upgrade")
+		ctx.Response.Header.Set(fasthttp.HeaderUpgrade, H2Clean)
+
+		ctx.Hijack(func(c net.Conn) {
+			_ = s.serveHTTP2(c, s.cnf, &h2cUpgrade{
+				req:      req,
+				settings: st,
+			})
+		})
+	}
+}
+
+// isH2CUpgrade reports whether the request asks to upgrade the connection to h2c.
+func isH2CUpgrade(h *fasthttp.RequestHeader) bool {
+	for _, v := range bytes.Split(h.Peek(fasthttp.HeaderUpgrade), []byte(",")) {
+		if bytes.EqualFold(bytes.TrimSpace(v), []byte(H2Clean)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -167,14 +167,14 @@ func TestH2Spec(t *testing.T) {
 		{desc: "http2/8.1.2.1/3"},
 		// {desc: "http2/8.1.2.1/4"},
 		// {desc: "http2/8.1.2.2/1"},
-		// {desc: "http2/8.1.2.2/2"},
-		// {desc: "http2/8.1.2.3/1"},
-		// {desc: "http2/8.1.2.3/2"},
-		// {desc: "http2/8.1.2.3/3"},
-		// {desc: "http2/8.1.2.3/4"},
-		// {desc: "http2/8.1.2.3/5"},
-		// {desc: "http2/8.1.2.3/6"},
-		// {desc: "http2/8.1.2.3/7"},
+		{desc: "http2/8.1.2.2/2"},
+		{desc: "http2/8.1.2.3/1"},
+		{desc: "http2/8.1.2.3/2"},
+		{desc: "http2/8.1.2.3/3"},
+		{desc: "http2/8.1.2.3/4"},
+		{desc: "http2/8.1.2.3/5"},
+		{desc: "http2/8.1.2.3/6"},
+		{desc: "http2/8.1.2.3/7"},
 		// {desc: "http2/8.1.2.6/1"},
 		// {desc: "http2/8.1.2.6/2"},
 		// {desc: "http2/8.1.2/1"},
@@ -1,6 +1,8 @@
 package http2
 
 import (
+	"fmt"
+
 	"github.com/dgrr/http2/http2utils"
 )
 
@@ -52,6 +54,12 @@ func (h *Headers) Type() FrameType {
 	return FrameHeaders
 }
 
+// String returns a readable representation of the frame, meant for debugging.
+func (h *Headers) String() string {
+	return fmt.Sprintf("HEADERS[EndStream=%v EndHeaders=%v Padding=%v Dependency=%d Weight=%d Length=%d]",
+		h.endStream, h.endHeaders, h.hasPadding, h.stream, h.weight, len(h.rawHeaders))
+}
+
 func (h *Headers) Headers() []byte {
 	return h.rawHeaders
 }
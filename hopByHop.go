@@ -0,0 +1,51 @@
+package http2
+
+import (
+	"bytes"
+
+	"github.com/valyala/fasthttp"
+)
+
+// hopByHopHeaders are the fields meaningful only for a single connection (RFC 7230 section 6.1),
+// which must not be forwarded by the proxies.
+var hopByHopHeaders = []string{
+	fasthttp.HeaderConnection,
+	"Proxy-Connection",
+	fasthttp.HeaderKeepAlive,
+	fasthttp.HeaderProxyAuthenticate,
+	fasthttp.HeaderProxyAuthorization,
+	fasthttp.HeaderTE,
+	fasthttp.HeaderTrailer,
+	fasthttp.HeaderTransferEncoding,
+	fasthttp.HeaderUpgrade,
+}
+
+// StripHopByHopHeaders removes from `h` the hop-by-hop fields, including the ones
+// listed in the Connection field, so the request can be forwarded by a proxy handler.
+//
+// The `te: trailers` field is kept, as it tells the upstream server
+// that the client accepts the trailers of the response.
+func StripHopByHopHeaders(h *fasthttp.RequestHeader) {
+	for _, v := range bytes.Split(h.Peek(fasthttp.HeaderConnection), []byte(",")) {
+		if k := bytes.TrimSpace(v); len(k) > 0 {
+			h.DelBytes(k)
+		}
+	}
+
+	acceptsTrailers := false
+	for _, v := range bytes.Split(h.Peek(fasthttp.HeaderTE), []byte(",")) {
+		// the transfer codings might have parameters, like `trailers;q=1`.
+		v, _, _ = bytes.Cut(v, []byte(";"))
+		if bytes.EqualFold(bytes.TrimSpace(v), StringTrailers) {
+			acceptsTrailers = true
+		}
+	}
+
+	for _, k := range hopByHopHeaders {
+		h.Del(k)
+	}
+
+	if acceptsTrailers {
+		h.SetBytesKV(StringTE, StringTrailers)
+	}
+}
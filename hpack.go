@@ -25,6 +25,14 @@ type HPACK struct {
 	// the fields established by the client losing performance calculated by client.
 	DisableDynamicTable bool
 
+	// Trace records the representation used to encode every header field
+	// appended with AppendHeader. The records can be read using Traces.
+	//
+	// This option is meant for debugging the interoperability with other HPACK implementations.
+	Trace bool
+
+	traces []HeaderFieldTrace
+
 	// the dynamic table is in an inverse order.
 	//
 	// the insertion point should be the beginning. But we are going to do
@@ -37,6 +45,18 @@ type HPACK struct {
 	maxTableSize uint32
 	// maxTableSize comming from the settings frame
 	maxTableSizeSettings uint32
+
+	// tableSizeUpdate is set when the max table size changed. The encoder must
+	// signal the change at the beginning of the next header block.
+	tableSizeUpdate bool
+
+	// evictions is the number of fields evicted from the dynamic table.
+	evictions uint64
+
+	// rawBytes and encodedBytes are the sizes of the header fields
+	// before and after being encoded by AppendHeader.
+	rawBytes     uint64
+	encodedBytes uint64
 }
 
 func headerFieldsToString(hfs []*HeaderField, indexOffset int) string {
@@ -86,11 +106,80 @@ func (hp *HPACK) Reset() {
 	hp.releaseDynamic()
 	hp.maxTableSize = defaultHeaderTableSize
 	hp.maxTableSizeSettings = defaultHeaderTableSize
+	hp.tableSizeUpdate = false
+	hp.evictions = 0
+	hp.rawBytes = 0
+	hp.encodedBytes = 0
+	hp.traces = hp.traces[:0]
+	hp.Trace = false
 	hp.DisableCompression = false
 }
 
+// Representation defines how a header field has been encoded.
+//
+// https://tools.ietf.org/html/rfc7541#section-6
+type Representation uint8
+
+const (
+	RepresentationIndexed Representation = iota
+	RepresentationLiteralWithIndexing
+	RepresentationLiteralWithoutIndexing
+	RepresentationLiteralNeverIndexed
+)
+
+func (r Representation) String() string {
+	switch r {
+	case RepresentationIndexed:
+		return "Indexed"
+	case RepresentationLiteralWithIndexing:
+		return "Literal with incremental indexing"
+	case RepresentationLiteralWithoutIndexing:
+		return "Literal without indexing"
+	case RepresentationLiteralNeverIndexed:
+		return "Literal never indexed"
+	}
+
+	return "Unknown"
+}
+
+// HeaderFieldTrace is the record of an encoded header field.
+type HeaderFieldTrace struct {
+	Key   string
+	Value string
+
+	Representation Representation
+}
+
+// Traces returns the records of the header fields encoded since Trace
+// was enabled or since the last call to ResetTraces.
+func (hp *HPACK) Traces() []HeaderFieldTrace {
+	return hp.traces
+}
+
+// ResetTraces deletes the records of the encoded header fields.
+func (hp *HPACK) ResetTraces() {
+	hp.traces = hp.traces[:0]
+}
+
+func (hp *HPACK) trace(hf *HeaderField, r Representation) {
+	if hp.Trace {
+		hp.traces = append(hp.traces, HeaderFieldTrace{
+			Key:            hf.Key(),
+			Value:          hf.Value(),
+			Representation: r,
+		})
+	}
+}
+
 // SetMaxTableSize sets the maximum dynamic table size.
+//
+// If the size changes, the next header field appended will be
+// preceded by a Dynamic Table Size Update.
 func (hp *HPACK) SetMaxTableSize(size uint32) {
+	if size != hp.maxTableSize {
+		hp.tableSizeUpdate = true
+	}
+
 	hp.maxTableSizeSettings = size
 	hp.maxTableSize = size
 }
@@ -105,6 +194,28 @@ func (hp *HPACK) DynamicSize() (n uint32) {
 	return
 }
 
+// Evictions returns the number of header fields evicted from the dynamic table
+// since the HPACK was reset.
+//
+// A high number of evictions per header block means the peer is
+// constantly replacing the dynamic table contents.
+func (hp *HPACK) Evictions() uint64 {
+	return hp.evictions
+}
+
+// CompressionRatio returns the size of the header fields encoded by AppendHeader
+// divided by their size before being encoded, or 0 if no field was encoded.
+//
+// The lower the ratio the better the compression, which usually improves
+// as the dynamic table gets filled with the fields repeated between header blocks.
+func (hp *HPACK) CompressionRatio() float64 {
+	if hp.rawBytes == 0 {
+		return 0
+	}
+
+	return float64(hp.encodedBytes) / float64(hp.rawBytes)
+}
+
 // add header field to the dynamic table.
 func (hp *HPACK) addDynamic(hf *HeaderField) {
 	// TODO: Optimize using reverse indexes.
@@ -136,6 +247,7 @@ func (hp *HPACK) shrink() {
 		}
 
 		hp.dynamic = append(hp.dynamic[:0], hp.dynamic[n:]...)
+		hp.evictions += uint64(n)
 	}
 }
 
@@ -395,19 +507,20 @@ func appendInt(dst []byte, bits uint8, index uint64) []byte {
 	}
 	b0 := uint64(1<<bits - 1)
 
-	if index <= b0 {
+	if index < b0 {
 		dst[len(dst)-1] |= byte(index)
 		return dst
 	}
 
+	// if index == b0 a zero byte must follow the prefix.
 	dst[len(dst)-1] |= byte(b0)
 	index -= b0
-	for index != 0 {
+	for index >= 128 {
 		dst = append(dst, 128|byte(index&127))
 		index >>= 7
 	}
 
-	dst[len(dst)-1] &= 127
+	dst = append(dst, byte(index))
 
 	return dst
 }
@@ -457,28 +570,23 @@ var (
 // appendString writes bytes slice to dst and returns it.
 // https://tools.ietf.org/html/rfc7541#section-5.2
 func appendString(dst, src []byte, encode bool) []byte {
-	var b []byte
-	if !encode {
-		b = src
-	} else {
-		b = bytePool.Get().([]byte)
-		b = HuffmanEncode(b[:0], src)
-	}
 	// TODO: Encode only if length is lower with the string encoded
-
-	n := uint64(len(b))
-	nn := len(dst) - 1 // peek last byte
-	if nn >= 0 && dst[nn] != 0 {
-		dst = append(dst, 0)
-		nn++
+	n := uint64(len(src))
+	if encode {
+		n = huffmanEncodedLen(src)
 	}
 
+	nn := len(dst) // the length prefix byte
+	dst = append(dst, 0)
+
 	dst = appendInt(dst, 7, n)
-	dst = append(dst, b...)
 
 	if encode {
-		bytePool.Put(b)
+		// encoding directly into dst avoids using an intermediate buffer.
+		dst = HuffmanEncode(dst, src)
 		dst[nn] |= 128 // setting H bit
+	} else {
+		dst = append(dst, src...)
 	}
 
 	return dst
@@ -496,33 +604,50 @@ func (hp *HPACK) AppendHeader(dst []byte, hf *HeaderField, store bool) []byte {
 		bits      uint8
 		index     uint64
 		fullMatch bool
+		start     = len(dst)
 	)
 
+	// Dynamic Table Size Update
+	// https://tools.ietf.org/html/rfc7541#section-6.3
+	if hp.tableSizeUpdate {
+		hp.tableSizeUpdate = false
+
+		dst = appendInt(append(dst, 32), 5, uint64(hp.maxTableSize))
+		hp.shrink()
+	}
+
 	c = !hp.DisableCompression
 	bits = 6
 
 	index, fullMatch = hp.search(hf)
 	if hf.sensible {
 		c = false
-		dst = append(dst, 16)
+		// the index of the key uses a 4-bit prefix, the same as the literals without indexing.
+		bits, dst = 4, append(dst, 16)
+		hp.trace(hf, RepresentationLiteralNeverIndexed)
 	} else {
 		if index > 0 { // key and/or value can be used as index
 			if fullMatch {
 				bits, dst = 7, append(dst, indexByte) // can be indexed
+				hp.trace(hf, RepresentationIndexed)
 			} else if !store { // must be used as literal index
 				bits, dst = 4, append(dst, 0)
+				hp.trace(hf, RepresentationLiteralWithoutIndexing)
 			} else {
 				dst = append(dst, literalByte)
 				// append this field to the dynamic table.
 				if index < maxIndex {
 					hp.addDynamic(hf)
 				}
+				hp.trace(hf, RepresentationLiteralWithIndexing)
 			}
 		} else if !store || hp.DisableDynamicTable { // with or without indexing
-			dst = append(dst, 0, 0)
+			dst = append(dst, 0)
+			hp.trace(hf, RepresentationLiteralWithoutIndexing)
 		} else {
 			dst = append(dst, literalByte)
 			hp.addDynamic(hf)
+			hp.trace(hf, RepresentationLiteralWithIndexing)
 		}
 	}
 
@@ -540,6 +665,9 @@ func (hp *HPACK) AppendHeader(dst []byte, hf *HeaderField, store bool) []byte {
 		dst = appendString(dst, hf.value, c)
 	}
 
+	hp.rawBytes += uint64(len(hf.key) + len(hf.value))
+	hp.encodedBytes += uint64(len(dst) - start)
+
 	return dst
 }
 
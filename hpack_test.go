@@ -52,6 +52,241 @@ func TestHPACKAppendInt(t *testing.T) {
 	}
 }
 
+func TestHPACKAppendIntPrefixMax(t *testing.T) {
+	dst := appendInt(nil, 7, 127)
+	if !bytes.Equal(dst, []byte{127, 0}) {
+		t.Fatalf("got %v. Expects %v", dst, []byte{127, 0})
+	}
+
+	b, n := readInt(7, dst)
+	checkInt(t, nil, n, 127, 0, b)
+}
+
+func TestHPACKDynamicIndexes(t *testing.T) {
+	enc := AcquireHPACK()
+	dec := AcquireHPACK()
+	defer ReleaseHPACK(enc)
+	defer ReleaseHPACK(dec)
+
+	hf := AcquireHeaderField()
+	defer ReleaseHeaderField(hf)
+
+	// enough fields to have dynamic indexes over 127 and evictions.
+	for i := 0; i < 300; i++ {
+		h := AcquireFrame(FrameHeaders).(*Headers)
+
+		fields := [][2]string{
+			{":path", fmt.Sprintf("/?id=%d", i)},
+			{":authority", "localhost"},
+		}
+
+		for _, f := range fields {
+			hf.Set(f[0], f[1])
+			enc.AppendHeaderField(h, hf, true)
+		}
+
+		b := h.rawHeaders
+		for _, f := range fields {
+			var err error
+
+			b, err = dec.Next(hf, b)
+			if err != nil {
+				t.Fatalf("%d: %s", i, err)
+			}
+
+			if hf.Key() != f[0] || hf.Value() != f[1] {
+				t.Fatalf("%d: unexpected field %s <> %s: %s", i, hf, f[0], f[1])
+			}
+		}
+
+		ReleaseFrame(h)
+	}
+}
+
+func TestHPACKTableSizeUpdate(t *testing.T) {
+	enc := AcquireHPACK()
+	dec := AcquireHPACK()
+	defer ReleaseHPACK(enc)
+	defer ReleaseHPACK(dec)
+
+	hf := AcquireHeaderField()
+	defer ReleaseHeaderField(hf)
+
+	hf.Set("x-custom", "value")
+
+	// the field is stored in the dynamic table of both endpoints
+	dst := enc.AppendHeader(nil, hf, true)
+	if _, err := dec.Next(hf, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	enc.SetMaxTableSize(0)
+
+	dst = enc.AppendHeader(dst[:0], hf, true)
+	if dst[0]&0xe0 != 32 {
+		t.Fatalf("expected a dynamic table size update, got %x", dst[0])
+	}
+
+	if _, n := readInt(5, dst); n != 0 {
+		t.Fatalf("unexpected table size: %d", n)
+	}
+
+	if len(enc.dynamic) != 0 {
+		t.Fatalf("expected an empty dynamic table, got %d fields", len(enc.dynamic))
+	}
+
+	if _, err := dec.Next(hf, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if dec.maxTableSize != 0 || len(dec.dynamic) != 0 {
+		t.Fatalf("the decoder didn't apply the table size update")
+	}
+
+	// only the first header block after the change carries the update
+	dst = enc.AppendHeader(dst[:0], hf, true)
+	if dst[0]&0xe0 == 32 {
+		t.Fatal("unexpected dynamic table size update")
+	}
+}
+
+func TestHPACKEvictions(t *testing.T) {
+	enc := AcquireHPACK()
+	dec := AcquireHPACK()
+	defer ReleaseHPACK(enc)
+	defer ReleaseHPACK(dec)
+
+	enc.Reset()
+	dec.Reset()
+
+	hf := AcquireHeaderField()
+	defer ReleaseHeaderField(hf)
+
+	// every field fills the table, evicting the previous one.
+	value := string(bytes.Repeat([]byte("a"), int(defaultHeaderTableSize)-64))
+
+	var dst []byte
+
+	for i := 0; i < 10; i++ {
+		hf.Set(fmt.Sprintf("x-churn-%d", i), value)
+
+		dst = enc.AppendHeader(dst[:0], hf, true)
+		if _, err := dec.Next(hf, dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := dec.Evictions(); n != 9 {
+		t.Fatalf("expected 9 evictions, got %d", n)
+	}
+
+	if n := enc.Evictions(); n != 9 {
+		t.Fatalf("expected 9 evictions in the encoder, got %d", n)
+	}
+
+	dec.Reset()
+
+	if n := dec.Evictions(); n != 0 {
+		t.Fatalf("unexpected evictions after Reset: %d", n)
+	}
+}
+
+func TestHPACKCompressionRatio(t *testing.T) {
+	hp := AcquireHPACK()
+	defer ReleaseHPACK(hp)
+
+	hp.Reset()
+
+	if r := hp.CompressionRatio(); r != 0 {
+		t.Fatalf("unexpected ratio without fields: %f", r)
+	}
+
+	hf := AcquireHeaderField()
+	defer ReleaseHeaderField(hf)
+
+	var dst []byte
+
+	block := func() {
+		for _, kv := range [][2]string{
+			{"user-agent", "Mozilla/5.0 (X11; Linux x86_64)"},
+			{"cookie", "session=4c9c2ba1-8e8d-4d3a-9f7e-5d4e0b2f1a6c"},
+			{"x-request-source", "checkout"},
+		} {
+			hf.Set(kv[0], kv[1])
+			dst = hp.AppendHeader(dst[:0], hf, true)
+		}
+	}
+
+	block()
+
+	first := hp.CompressionRatio()
+	if first <= 0 || first >= 1 {
+		t.Fatalf("unexpected ratio after the first block: %f", first)
+	}
+
+	for i := 0; i < 10; i++ {
+		block()
+	}
+
+	// the fields repeated are encoded as indexes of the dynamic table.
+	if r := hp.CompressionRatio(); r >= first/4 {
+		t.Fatalf("the ratio didn't improve: %f >= %f / 4", r, first)
+	}
+}
+
+func TestHPACKTrace(t *testing.T) {
+	hp := AcquireHPACK()
+	defer ReleaseHPACK(hp)
+
+	hp.Trace = true
+
+	hf := AcquireHeaderField()
+	defer ReleaseHeaderField(hf)
+
+	hf.Set("x-custom", "value")
+
+	dst := hp.AppendHeader(nil, hf, true)
+	hp.AppendHeader(dst, hf, true)
+
+	hf.Set("x-other", "value")
+	hp.AppendHeader(dst, hf, false)
+
+	expected := []Representation{
+		RepresentationLiteralWithIndexing,
+		RepresentationIndexed,
+		RepresentationLiteralWithoutIndexing,
+	}
+
+	traces := hp.Traces()
+	if len(traces) != len(expected) {
+		t.Fatalf("expected %d traces, got %d", len(expected), len(traces))
+	}
+
+	for i, r := range expected {
+		if traces[i].Representation != r {
+			t.Fatalf("%d: %s: expected %s, got %s", i, traces[i].Key, r, traces[i].Representation)
+		}
+	}
+
+	if traces[0].Key != "x-custom" || traces[0].Value != "value" {
+		t.Fatalf("unexpected field %s: %s", traces[0].Key, traces[0].Value)
+	}
+
+	hp.ResetTraces()
+
+	if len(hp.Traces()) != 0 {
+		t.Fatal("expected no traces")
+	}
+
+	// a pooled HPACK must not keep tracing for its next user.
+	hp.Reset()
+	hp.AppendHeader(nil, hf, true)
+
+	if hp.Trace || len(hp.Traces()) != 0 {
+		t.Fatal("expected the tracing to be disabled after Reset")
+	}
+}
+
 func checkInt(t *testing.T, err error, n, e uint64, elen int, b []byte) {
 	t.Helper()
 
@@ -605,6 +840,8 @@ func TestHPACKWriteResponseWithoutHuffman(t *testing.T) { // without huffman
 	hpack := AcquireHPACK()
 	hpack.DisableCompression = true
 	hpack.SetMaxTableSize(256)
+	// the RFC examples don't signal the initial table size.
+	hpack.tableSizeUpdate = false
 
 	writeHPACKAndCheck(t, hpack, r, []string{
 		":status", "302",
@@ -682,6 +919,9 @@ func TestHPACKWriteResponseWithHuffman(t *testing.T) { // WithHuffman
 
 	hpack := AcquireHPACK()
 	hpack.SetMaxTableSize(256)
+	// the RFC examples don't signal the initial table size.
+	hpack.tableSizeUpdate = false
+
 	writeHPACKAndCheck(t, hpack, r, []string{
 		":status", "302",
 		"cache-control", "private",
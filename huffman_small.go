@@ -0,0 +1,89 @@
+//go:build http2_smallhuffman
+
+package http2
+
+import (
+	"errors"
+)
+
+// The small Huffman decoder walks a binary tree a bit at a time.
+//
+// The tree takes around 1KB of memory, in exchange the decoding
+// is slower than the one using the lookup tables.
+
+// huffmanLeaf marks a child in huffmanTree as a leaf, the lower byte being the symbol.
+const huffmanLeaf = 1 << 15
+
+// huffmanTree contains the children (0 and 1 bits) of every internal node.
+// The root is the first node. A child with value 0 is not present.
+var huffmanTree = func() [][2]uint16 {
+	tree := make([][2]uint16, 1, 256)
+
+	for sym, code := range huffmanCodes {
+		node := 0
+
+		for n := huffmanCodeLen[sym]; n > 0; n-- {
+			bit := (code >> (n - 1)) & 1
+
+			if n == 1 {
+				tree[node][bit] = huffmanLeaf | uint16(sym)
+				break
+			}
+
+			if tree[node][bit] == 0 {
+				tree = append(tree, [2]uint16{})
+				tree[node][bit] = uint16(len(tree) - 1)
+			}
+
+			node = int(tree[node][bit])
+		}
+	}
+
+	return tree
+}()
+
+// HuffmanDecode decodes src into dst using Huffman codes.
+//
+// src and dst must not point to the same address.
+func HuffmanDecode(dst, src []byte) ([]byte, error) {
+	var (
+		node uint16
+		// bits read since the last symbol
+		bits int
+		// the bits since the last symbol are all ones
+		ones = true
+	)
+
+	for _, b := range src {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> i) & 1
+
+			next := huffmanTree[node][bit]
+			if next == 0 {
+				return nil, errors.New("invalid huffman code")
+			}
+
+			bits++
+			ones = ones && bit == 1
+
+			if next&huffmanLeaf == 0 {
+				node = next
+				continue
+			}
+
+			dst = append(dst, byte(next))
+			node, bits, ones = 0, 0, true
+		}
+	}
+
+	// the padding must be shorter than 8 bits and be the prefix of the EOS symbol.
+	if bits > 7 {
+		return nil, errors.New("bits left decoding huffman bytes")
+	}
+
+	if !ones {
+		return nil, errors.New("bits has a zero prefix")
+	}
+
+	return dst, nil
+}
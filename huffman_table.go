@@ -0,0 +1,132 @@
+//go:build !http2_smallhuffman
+
+package http2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The default Huffman decoder uses lookup tables of 256 entries to decode
+// the input a byte at a time.
+//
+// The tables take around 150KB of memory. Build with the `http2_smallhuffman` tag
+// to use a smaller (around 1KB) but slower decoder.
+
+// HuffmanDecode decodes src into dst using Huffman codes.
+//
+// src and dst must not point to the same address.
+func HuffmanDecode(dst, src []byte) ([]byte, error) {
+	var accBits uint32
+	var bits uint8
+	var bitsLeft uint8
+
+	root := rootHuffmanNode
+	for _, b := range src {
+		// accumulate bits until having more than or equal to 8
+		accBits = accBits<<8 | uint32(b)
+		bits += 8
+		bitsLeft += 8
+
+		for bits >= 8 {
+			// take the bits that were added first
+			idx := byte(accBits >> (bits - 8))
+
+			root = root.sub[idx]
+			if root == nil {
+				return nil, fmt.Errorf("invalid huffman index: %x", idx)
+			}
+
+			// if we have more to read, then just continue
+			if root.sub != nil {
+				bits -= 8
+			} else {
+				bits -= root.codeLen
+				dst = append(dst, root.sym)
+				root = rootHuffmanNode
+				bitsLeft = bits
+			}
+
+			// not needed:
+			// accBits &= 1<<bits - 1
+		}
+	}
+
+	// if we have bits left
+	for bits > 0 {
+		// as the last byte can contain some padding, we need to remove the padding
+		// by just shifting 8 - bits
+		idx := byte(accBits << (8 - bits))
+
+		root = root.sub[idx]
+		if root == nil {
+			return nil, fmt.Errorf("invalid huffman index: %x", idx)
+		}
+
+		if root.sub != nil || root.codeLen > bits {
+			break
+		}
+
+		dst = append(dst, root.sym)
+		bits -= root.codeLen
+		root = rootHuffmanNode
+		bitsLeft = bits
+	}
+
+	if bitsLeft > 7 {
+		return nil, errors.New("bits left decoding huffman bytes")
+	}
+
+	if mask := uint32(1<<bits - 1); accBits&mask != mask {
+		return nil, errors.New("bits has a zero prefix")
+	}
+
+	return dst, nil
+}
+
+var rootHuffmanNode = func() *huffmanNode {
+	node := &huffmanNode{
+		sub: make([]*huffmanNode, 256),
+	}
+
+	for i, code := range huffmanCodes {
+		node.add(byte(i), code, huffmanCodeLen[i])
+	}
+
+	return node
+}()
+
+type huffmanNode struct {
+	sub     []*huffmanNode
+	codeLen uint8
+	sym     byte
+}
+
+// This function is going to create a list of tables of 256 elements.
+//
+// If an element in the Huffman table takes more than 8 bits it'll be stored
+// in the `sub` table recursively, that means, if an element is 18 bits long,
+// 3 tables will be needed, the main table, a sub table and a sub-sub table.
+func (node *huffmanNode) add(sym byte, code uint32, length uint8) {
+	// if length is more than 8, then we need to recursively look for the table
+	// where we are going to insert the element.
+	for length > 8 {
+		length -= 8
+		i := uint8(code >> length)
+		if node.sub[i] == nil {
+			node.sub[i] = &huffmanNode{
+				sub: make([]*huffmanNode, 256),
+			}
+		}
+
+		node = node.sub[i]
+	}
+
+	n := 8 - length
+	// use a range to fill 8 bits because later we are going to index based on 8 bit index numbers.
+	start, end := int(uint8(code<<n)), 1<<n
+
+	for i := start; i < start+end; i++ {
+		node.sub[i] = &huffmanNode{sym: sym, codeLen: length}
+	}
+}
@@ -86,3 +86,55 @@ func TestHuffmanEncodeReusingLittle(t *testing.T) {
 	encodeHuffman(t, b, b, littleEncodedBytes)
 }
 */
+
+func TestHuffmanRoundTrip(t *testing.T) {
+	src := make([]byte, 0, 1024)
+	for i := 0; i < cap(src); i++ {
+		src = append(src, byte(i*7+i/256))
+	}
+
+	for i := 0; i <= len(src); i += 31 {
+		enc := HuffmanEncode(nil, src[:i])
+
+		dec, err := HuffmanDecode(nil, enc)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+
+		if err := compareBytes(dec, src[:i]); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+	}
+}
+
+func TestHuffmanDecodeInvalidPadding(t *testing.T) {
+	// 'a' is 00011 (5 bits), so the padding must be 111.
+	if _, err := HuffmanDecode(nil, []byte{0x18}); err == nil {
+		t.Fatal("expected an error decoding a zero padding")
+	}
+
+	// a whole byte of padding
+	if _, err := HuffmanDecode(nil, []byte{0x1f, 0xff}); err == nil {
+		t.Fatal("expected an error decoding a padding longer than 7 bits")
+	}
+
+	if b, err := HuffmanDecode(nil, []byte{0x1f}); err != nil || string(b) != "a" {
+		t.Fatalf("unexpected result: %q %v", b, err)
+	}
+}
+
+// BenchmarkHuffmanDecode measures the decoding throughput. Run it with
+// and without the `http2_smallhuffman` build tag to compare both decoders.
+func BenchmarkHuffmanDecode(b *testing.B) {
+	dst := make([]byte, 0, len(decodedBytes))
+
+	b.SetBytes(int64(len(decodedBytes)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		_, err := HuffmanDecode(dst[:0], encodedBytes)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package http2
 
 import (
 	"encoding/binary"
+	"fmt"
 	"time"
 )
 
@@ -27,12 +28,18 @@ func (p *Ping) Type() FrameType {
 	return FramePing
 }
 
+// String returns a readable representation of the frame, meant for debugging.
+func (p *Ping) String() string {
+	return fmt.Sprintf("PING[Ack=%v Data=%x]", p.ack, p.data)
+}
+
 func (p *Ping) Reset() {
 	p.ack = false
 }
 
 func (p *Ping) CopyTo(other *Ping) {
-	p.ack = other.ack
+	other.ack = p.ack
+	other.data = p.data
 }
 
 func (p *Ping) Write(b []byte) (n int, err error) {
@@ -1,6 +1,8 @@
 package http2
 
 import (
+	"fmt"
+
 	"github.com/dgrr/http2/http2utils"
 )
 
@@ -20,6 +22,11 @@ func (pry *Priority) Type() FrameType {
 	return FramePriority
 }
 
+// String returns a readable representation of the frame, meant for debugging.
+func (pry *Priority) String() string {
+	return fmt.Sprintf("PRIORITY[Dependency=%d Weight=%d]", pry.stream, pry.weight)
+}
+
 // Reset resets priority fields.
 func (pry *Priority) Reset() {
 	pry.stream = 0
@@ -0,0 +1,202 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// proxyV2Signature is the beginning of a PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLen is the maximum length of a PROXY protocol v1 header, including the CRLF.
+const proxyV1MaxLen = 107
+
+// Errors returned by ServeConn when ServerConfig.ProxyProtocol is set.
+var (
+	ErrMissingProxyHeader = errors.New("missing PROXY protocol header")
+	ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// proxyConn is a net.Conn whose remote address is the one
+// received in the PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+
+	// br contains the bytes read after the PROXY protocol header.
+	br     *bufio.Reader
+	remote net.Addr
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	return pc.br.Read(b)
+}
+
+// RemoteAddr returns the client's address sent by the proxy.
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+// CloseWrite closes the writing side of the underlying connection.
+func (pc *proxyConn) CloseWrite() error {
+	if cw, ok := pc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return errors.New("the connection doesn't support CloseWrite")
+}
+
+// canCloseWrite reports whether the writing side of `c` can be closed independently.
+func canCloseWrite(c net.Conn) bool {
+	// the wrappers implement CloseWrite, even if the connections they wrap don't.
+	for {
+		if pc, ok := c.(*proxyConn); ok {
+			c = pc.Conn
+		} else if bc, ok := c.(*bufferedConn); ok {
+			c = bc.Conn
+		} else {
+			break
+		}
+	}
+
+	_, ok := c.(interface{ CloseWrite() error })
+
+	return ok
+}
+
+// readProxyHeader reads the PROXY protocol header (v1 or v2) sent by a proxy
+// at the beginning of `c`, and returns a net.Conn reporting the client's address.
+//
+// If the header doesn't contain the client's address (like the health checks
+// of the proxy), the address of `c` is kept.
+//
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+func readProxyHeader(c net.Conn) (net.Conn, error) {
+	pc := &proxyConn{
+		Conn:   c,
+		br:     bufio.NewReader(c),
+		remote: c.RemoteAddr(),
+	}
+
+	b, err := pc.br.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	var addr net.Addr
+
+	switch {
+	case bytes.HasPrefix(b, []byte("PROXY ")):
+		addr, err = readProxyV1(pc.br)
+	case bytes.Equal(b, proxyV2Signature):
+		addr, err = readProxyV2(pc.br)
+	default:
+		return nil, ErrMissingProxyHeader
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if addr != nil {
+		pc.remote = addr
+	}
+
+	return pc, nil
+}
+
+// readProxyV1 reads a header like `PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n`.
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+
+	for len(line) < proxyV1MaxLen {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, c)
+
+		if c == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	// the receiver must ignore anything after UNKNOWN, as the proxy
+	// might send the addresses of a connection it can't describe.
+	fields := bytes.Split(line[:len(line)-2], []byte(" "))
+	if len(fields) >= 2 && string(fields[1]) == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (string(fields[1]) != "TCP4" && string(fields[1]) != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(string(fields[2]))
+	if ip == nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	port, err := strconv.ParseUint(string(fields[4]), 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header.
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, err
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	b := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(br, b); err != nil {
+		return nil, err
+	}
+
+	// the LOCAL command is sent by the proxy itself.
+	if header[12]&0xf == 0 {
+		return nil, nil
+	}
+
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(b) < 12 {
+			return nil, ErrInvalidProxyHeader
+		}
+
+		return &net.TCPAddr{
+			IP:   net.IP(b[:4]),
+			Port: int(binary.BigEndian.Uint16(b[8:])),
+		}, nil
+	case 0x21: // TCP over IPv6
+		if len(b) < 36 {
+			return nil, ErrInvalidProxyHeader
+		}
+
+		return &net.TCPAddr{
+			IP:   net.IP(b[:16]),
+			Port: int(binary.BigEndian.Uint16(b[32:])),
+		}, nil
+	}
+
+	// other address families are ignored.
+	return nil, nil
+}
@@ -1,6 +1,8 @@
 package http2
 
 import (
+	"fmt"
+
 	"github.com/dgrr/http2/http2utils"
 )
 
@@ -20,6 +22,12 @@ func (pp *PushPromise) Type() FrameType {
 	return FramePushPromise
 }
 
+// String returns a readable representation of the frame, meant for debugging.
+func (pp *PushPromise) String() string {
+	return fmt.Sprintf("PUSH_PROMISE[PromisedStream=%d EndHeaders=%v Padding=%v Length=%d]",
+		pp.stream, pp.ended, pp.pad, len(pp.header))
+}
+
 func (pp *PushPromise) Reset() {
 	pp.pad = false
 	pp.ended = false
@@ -27,6 +35,38 @@ func (pp *PushPromise) Reset() {
 	pp.header = pp.header[:0]
 }
 
+// CopyTo copies pp fields to other.
+func (pp *PushPromise) CopyTo(other *PushPromise) {
+	other.pad = pp.pad
+	other.ended = pp.ended
+	other.stream = pp.stream
+	other.header = append(other.header[:0], pp.header...)
+}
+
+// Stream returns the id of the promised stream.
+func (pp *PushPromise) Stream() uint32 {
+	return pp.stream
+}
+
+// SetStream sets the id of the promised stream.
+func (pp *PushPromise) SetStream(stream uint32) {
+	pp.stream = stream & (1<<31 - 1)
+}
+
+// EndHeaders reports whether the frame contains the whole header block.
+func (pp *PushPromise) EndHeaders() bool {
+	return pp.ended
+}
+
+func (pp *PushPromise) SetEndHeaders(value bool) {
+	pp.ended = value
+}
+
+// Headers returns the header block fragment.
+func (pp *PushPromise) Headers() []byte {
+	return pp.header
+}
+
 func (pp *PushPromise) SetHeader(h []byte) {
 	pp.header = append(pp.header[:0], h...)
 }
@@ -60,13 +100,11 @@ func (pp *PushPromise) Deserialize(fr *FrameHeader) error {
 }
 
 func (pp *PushPromise) Serialize(fr *FrameHeader) {
-	fr.payload = fr.payload[:0]
-
-	// if pp.pad {
-	// 	fr.Flags().Add(FlagPadded)
-	// 	// TODO: Write padding flag
-	// }
+	if pp.ended {
+		fr.SetFlags(
+			fr.Flags().Add(FlagEndHeaders))
+	}
 
+	fr.payload = http2utils.AppendUint32Bytes(fr.payload[:0], pp.stream)
 	fr.payload = append(fr.payload, pp.header...)
-	// TODO: write padding
 }
@@ -1,6 +1,8 @@
 package http2
 
 import (
+	"fmt"
+
 	"github.com/dgrr/http2/http2utils"
 )
 
@@ -17,6 +19,11 @@ func (rst *RstStream) Type() FrameType {
 	return FrameResetStream
 }
 
+// String returns a readable representation of the frame, meant for debugging.
+func (rst *RstStream) String() string {
+	return fmt.Sprintf("RST_STREAM[Code=%s]", rst.code.String())
+}
+
 func (rst *RstStream) Code() ErrorCode {
 	return rst.code
 }
@@ -2,8 +2,10 @@ package http2
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/valyala/fasthttp"
@@ -17,21 +19,230 @@ type ServerConfig struct {
 	// To disable pings set the PingInterval to a negative value.
 	PingInterval time.Duration
 
-	// ...
+	// MaxPingsPerSecond is the maximum number of PING frames a client can send per second.
+	//
+	// The pings above the limit are not acknowledged, and the connection is closed
+	// with ENHANCE_YOUR_CALM, as replying to a flood of pings keeps the writer busy.
+	// The default is 100. To disable the limit set a negative value.
+	MaxPingsPerSecond int
+
+	// MaxResetsPerMinute is the maximum number of streams a client can reset per minute
+	// before their responses are completed.
+	//
+	// Resetting the streams frees their slots of MaxConcurrentStreams while the server
+	// keeps handling the requests, so a client opening and resetting streams in a loop
+	// (the rapid reset attack, CVE-2023-44487) isn't limited by MaxConcurrentStreams.
+	// Once the limit is exceeded the connection is closed with ENHANCE_YOUR_CALM.
+	// The default is 1000. To disable the limit set a negative value.
+	MaxResetsPerMinute int
+
+	// MaxConcurrentStreams is the maximum number of streams a client can have open at the same time.
+	//
+	// It is used as the default for AdvertisedMaxStreams and EnforcedMaxStreams.
 	MaxConcurrentStreams int
 
+	// AdvertisedMaxStreams is the SETTINGS_MAX_CONCURRENT_STREAMS value sent to the client.
+	AdvertisedMaxStreams int
+
+	// EnforcedMaxStreams is the number of open streams above which the new streams are refused.
+	//
+	// It can be higher than AdvertisedMaxStreams to tolerate bursts from the clients,
+	// or lower to keep some margin while advertising a bigger limit.
+	EnforcedMaxStreams int
+
+	// ConnectionWindowSize is the flow-control window of the connection,
+	// which limits the data the client can send in all the streams.
+	//
+	// The default is 4MB, and the window is limited to 2^31-1 bytes.
+	// A bigger window avoids throttling the uploads on the links with
+	// a high bandwidth-delay product.
+	ConnectionWindowSize int
+
+	// StreamWindowSize is the flow-control window of every stream,
+	// advertised to the client as SETTINGS_INITIAL_WINDOW_SIZE.
+	//
+	// A window smaller than ConnectionWindowSize limits the memory a single stream
+	// can take while many streams are open. The default is ConnectionWindowSize.
+	// The window is limited to the fasthttp.Server's MaxRequestBodySize.
+	StreamWindowSize int
+
+	// FlowController decides when the connection's and the streams' windows are replenished.
+	//
+	// The default sends a WINDOW_UPDATE once less than half of the window is left.
+	FlowController FlowController
+
+	// CoalesceDataFrames buffers the response bodies streamed by the handlers
+	// (like with fasthttp.RequestCtx.SetBodyStreamWriter), so the small writes are sent
+	// in DATA frames filled up to the client's SETTINGS_MAX_FRAME_SIZE instead of one frame each.
+	//
+	// The buffered data is sent once a frame is filled, the body ends, or the handler
+	// stops writing for a millisecond (like after flushing the stream writer), so the
+	// responses streaming events, like Server-Sent Events, are not delayed.
+	CoalesceDataFrames bool
+
+	// IndexedResponseHeaders is the list of response header fields (like server or
+	// strict-transport-security) added to the HPACK dynamic table of the connection,
+	// so the responses after the first one send them as a single index.
+	//
+	// The dynamic table can't be seeded in advance, as the client's decoder only learns
+	// the entries from the header blocks it receives. The first response on each connection
+	// sends the fields as literals, and only the fields with the same value in every response
+	// benefit from being indexed. The other response fields aren't indexed.
+	IndexedResponseHeaders []string
+
+	// MaxHandlerWorkers defines the maximum number of handlers that
+	// can run concurrently on a single connection.
+	//
+	// If MaxHandlerWorkers is 0, the handlers run sequentially, so a slow handler
+	// delays the processing of the rest of the streams of the connection.
+	MaxHandlerWorkers int
+
+	// AllowedMethods defines the request methods the server accepts.
+	//
+	// Requests with a method not present in AllowedMethods are answered
+	// with 405 Method Not Allowed, listing AllowedMethods in the Allow header,
+	// without reaching the handler.
+	// If AllowedMethods is empty, any valid method is accepted.
+	//
+	// If the fasthttp.Server has GetOnly set, the requests other than GET are answered
+	// with 405 too, and fasthttp.ErrGetOnly as the body.
+	AllowedMethods []string
+
+	// MaxHeaderBlockEvictions is the maximum number of fields a header block
+	// can evict from the dynamic table of the HPACK decoder.
+	//
+	// Adding and evicting big fields repeatedly wastes CPU, so the connections
+	// exceeding the limit are closed with ENHANCE_YOUR_CALM.
+	// If MaxHeaderBlockEvictions is 0, the evictions are not limited.
+	MaxHeaderBlockEvictions int
+
+	// MaxHeaderListSize is the maximum size of the request header fields, computed as in
+	// SETTINGS_MAX_HEADER_LIST_SIZE: the length of the names and the values plus 32 bytes per field.
+	//
+	// The limit is advertised to the clients, and the connections sending
+	// larger header lists are closed with ENHANCE_YOUR_CALM.
+	// The default is the fasthttp.Server's ReadBufferSize if set, or 1MB otherwise.
+	// To disable the limit set a negative value.
+	//
+	// The size of the header blocks and the number of CONTINUATION frames are limited
+	// based on MaxHeaderListSize, or on the 1MB default if the limit is disabled.
+	MaxHeaderListSize int
+
+	// RequireAuthority makes the server reset the requests without an :authority
+	// pseudo-header, unless the :path is in absolute-form (RFC 7230 section 5.3.2).
+	RequireAuthority bool
+
+	// GoAwayGracePeriod is the maximum time the server waits for the client
+	// to close the connection after sending a GOAWAY.
+	//
+	// During the grace period the server stops writing and keeps reading (and discarding)
+	// the client's data, so the GOAWAY isn't lost when the connection gets closed.
+	// The default is 1 second. To close the connection right away set a negative value.
+	GoAwayGracePeriod time.Duration
+
+	// MaxConnAge is the maximum lifetime of a connection. Once it's reached the server sends a GOAWAY,
+	// so the client opens a new connection (possibly to another backend behind a load balancer),
+	// and the connection is closed once the streams in flight are completed.
+	//
+	// If MaxConnAge is 0, the connections are kept open.
+	MaxConnAge time.Duration
+
+	// EnableConnectProtocol advertises SETTINGS_ENABLE_CONNECT_PROTOCOL, allowing the clients
+	// to use the extended CONNECT method (RFC 8441), like for WebSockets over HTTP/2.
+	//
+	// The value of the :protocol pseudo-header is returned by the Protocol method
+	// of the request's Stream (see StreamFromCtx).
+	EnableConnectProtocol bool
+
+	// HeadersHandler, if set, is called once the headers of a request with a body are received,
+	// before the body, which is empty in the fasthttp.RequestCtx.
+	//
+	// If HeadersHandler returns false, the response set in the RequestCtx is sent right away
+	// without calling the Handler, and the stream is reset with NO_ERROR, so the client stops
+	// sending the body (RFC 7540 section 8.1). It allows rejecting the big uploads early.
+	// HeadersHandler runs in the goroutine handling the connection's streams, so it must not block.
+	HeadersHandler func(ctx *fasthttp.RequestCtx) bool
+
+	// ProxyProtocol makes the server read a PROXY protocol header (v1 or v2)
+	// before the HTTP/2 preface, as sent by the L4 load balancers.
+	//
+	// The client's address in the header is returned by the RemoteAddr of the
+	// handlers' fasthttp.RequestCtx. The connections without the header are closed.
+	// The header must be sent before the TLS handshake, so with TLS it must be handled by the listener.
+	ProxyProtocol bool
+
+	// LogLevel defines which messages are logged using the fasthttp.Server's Logger.
+	//
+	// The default LogLevelError only logs the errors, like the connections closed because of a protocol error.
+	LogLevel LogLevel
+
 	// Debug is a flag that will allow the library to print debugging information.
+	//
+	// Setting Debug is equivalent to setting LogLevel to LogLevelDebug.
 	Debug bool
 }
 
+// LogLevel defines the verbosity of the server logs.
+type LogLevel int8
+
+const (
+	// LogLevelError logs the errors.
+	LogLevelError LogLevel = iota
+	// LogLevelWarn also logs the conditions that might require some attention, like refused streams.
+	LogLevelWarn
+	// LogLevelInfo also logs the connection events, like idle connections being closed.
+	LogLevelInfo
+	// LogLevelDebug logs everything, including the events of every stream and frame.
+	LogLevelDebug
+)
+
 func (sc *ServerConfig) defaults() {
 	if sc.PingInterval == 0 {
 		sc.PingInterval = time.Second * 10
 	}
 
+	if sc.MaxPingsPerSecond == 0 {
+		sc.MaxPingsPerSecond = 100
+	}
+
+	if sc.MaxResetsPerMinute == 0 {
+		sc.MaxResetsPerMinute = 1000
+	}
+
+	if sc.GoAwayGracePeriod == 0 {
+		sc.GoAwayGracePeriod = time.Second
+	}
+
+	if sc.ConnectionWindowSize <= 0 {
+		sc.ConnectionWindowSize = 1 << 22
+	}
+
+	// RFC(6.9.1):
+	//
+	// A sender MUST NOT allow a flow-control window to exceed 2^31-1 octets.
+	if sc.ConnectionWindowSize > 1<<31-1 {
+		sc.ConnectionWindowSize = 1<<31 - 1
+	}
+
+	if sc.StreamWindowSize <= 0 || sc.StreamWindowSize > 1<<31-1 {
+		sc.StreamWindowSize = sc.ConnectionWindowSize
+	}
+
+	if sc.FlowController == nil {
+		sc.FlowController = halfWindow{}
+	}
+
 	if sc.MaxConcurrentStreams <= 0 {
 		sc.MaxConcurrentStreams = 1024
 	}
+
+	if sc.AdvertisedMaxStreams <= 0 {
+		sc.AdvertisedMaxStreams = sc.MaxConcurrentStreams
+	}
+
+	if sc.EnforcedMaxStreams <= 0 {
+		sc.EnforcedMaxStreams = sc.MaxConcurrentStreams
+	}
 }
 
 // Server defines an HTTP/2 entity that can handle HTTP/2 connections.
@@ -39,19 +250,93 @@ type Server struct {
 	s *fasthttp.Server
 
 	cnf ServerConfig
+
+	// schedule is used by the tests to choose the order of the frames written (see serverConn.schedule).
+	schedule func(pending []*FrameHeader) int
+}
+
+// defaultMaxHeaderListSize is the SETTINGS_MAX_HEADER_LIST_SIZE used if the
+// ServerConfig's MaxHeaderListSize and the fasthttp.Server's ReadBufferSize are not set.
+const defaultMaxHeaderListSize = 1 << 20
+
+// serverSettings derives the HTTP/2 settings from the fasthttp.Server configuration:
+//   - SETTINGS_INITIAL_WINDOW_SIZE is the stream window `maxWindow`,
+//     limited to the MaxRequestBodySize, as a stream can't send a larger body.
+//   - SETTINGS_MAX_HEADER_LIST_SIZE is the ReadBufferSize, if set,
+//     as it limits the size of the request headers in HTTP/1.1.
+//   - SETTINGS_MAX_FRAME_SIZE is the ReadBufferSize, if set and above the default frame size.
+func serverSettings(st *Settings, s *fasthttp.Server, maxWindow int32) {
+	window := int(maxWindow)
+
+	bodySize := s.MaxRequestBodySize
+	if bodySize <= 0 {
+		bodySize = fasthttp.DefaultMaxRequestBodySize
+	}
+
+	if bodySize < window {
+		window = bodySize
+	}
+
+	st.SetMaxWindowSize(uint32(window))
+
+	if s.ReadBufferSize > 0 {
+		st.SetMaxHeaderListSize(uint32(s.ReadBufferSize))
+
+		if s.ReadBufferSize > int(defaultDataFrameSize) {
+			frameSize := s.ReadBufferSize
+			if frameSize > maxFrameSize {
+				frameSize = maxFrameSize
+			}
+
+			st.SetMaxFrameSize(uint32(frameSize))
+		}
+	}
 }
 
 // ServeConn starts serving a net.Conn as HTTP/2.
 //
 // This function will fail if the connection does not support the HTTP/2 protocol.
 func (s *Server) ServeConn(c net.Conn) error {
+	return s.serveConn(c, s.cnf)
+}
+
+// ServeConnWithConfig is like ServeConn, but the connection is served
+// using `cnf` instead of the Server's ServerConfig.
+//
+// It allows serving the connections of different listeners with different limits.
+// The unset fields of `cnf` take the default values.
+func (s *Server) ServeConnWithConfig(c net.Conn, cnf ServerConfig) error {
+	cnf.defaults()
+
+	return s.serveConn(c, cnf)
+}
+
+func (s *Server) serveConn(c net.Conn, cnf ServerConfig) error {
 	defer func() { _ = c.Close() }()
 
+	if cnf.ProxyProtocol {
+		pc, err := readProxyHeader(c)
+		if err != nil {
+			return err
+		}
+
+		c = pc
+	}
+
+	return s.serveHTTP2(c, cnf, nil)
+}
+
+// serveHTTP2 reads the client's preface and serves `c` as HTTP/2.
+//
+// If `upgrade` is not nil, the connection was upgraded from HTTP/1.1
+// and the upgrade request is served as the stream 1.
+func (s *Server) serveHTTP2(c net.Conn, cnf ServerConfig, upgrade *h2cUpgrade) error {
 	if !ReadPreface(c) {
 		return errors.New("wrong preface")
 	}
 
 	sc := &serverConn{
+		id:             atomic.AddUint64(&lastConnID, 1),
 		c:              c,
 		h:              s.s.Handler,
 		br:             bufio.NewReader(c),
@@ -61,24 +346,95 @@ func (s *Server) ServeConn(c net.Conn) error {
 		reader:         make(chan *FrameHeader, 128),
 		maxRequestTime: s.s.ReadTimeout,
 		maxIdleTime:    s.s.IdleTimeout,
-		pingInterval:   s.cnf.PingInterval,
+		pingInterval:   int64(cnf.PingInterval),
+		maxPings:       cnf.MaxPingsPerSecond,
+		maxResets:      cnf.MaxResetsPerMinute,
+		goAwayGrace:    cnf.GoAwayGracePeriod,
+		maxConnAge:     cnf.MaxConnAge,
+		allowedMethods: cnf.AllowedMethods,
+		getOnly:        s.s.GetOnly,
+		coalesce:       cnf.CoalesceDataFrames,
+		indexedHeaders: cnf.IndexedResponseHeaders,
+		requireAuth:    cnf.RequireAuthority,
+		connectProto:   cnf.EnableConnectProtocol,
+		headersHandler: cnf.HeadersHandler,
+		maxEvictions:   uint64(cnf.MaxHeaderBlockEvictions),
+		maxStreams:     cnf.EnforcedMaxStreams,
+		maxFrameSize:   defaultDataFrameSize,
+		flow:           cnf.FlowController,
 		logger:         s.s.Logger,
-		debug:          s.cnf.Debug,
+		logLevel:       cnf.LogLevel,
+		schedule:       s.schedule,
+	}
+
+	if cnf.Debug {
+		sc.logLevel = LogLevelDebug
+	}
+
+	sc.maxRequestBodySize = s.s.MaxRequestBodySize
+	if sc.maxRequestBodySize <= 0 {
+		sc.maxRequestBodySize = fasthttp.DefaultMaxRequestBodySize
 	}
 
 	if sc.logger == nil {
 		sc.logger = logger
 	}
 
+	if cnf.MaxHandlerWorkers > 0 {
+		sc.workers = make(chan struct{}, cnf.MaxHandlerWorkers)
+	}
+
 	sc.enc.Reset()
 	sc.dec.Reset()
 
-	sc.maxWindow = 1 << 22
+	sc.maxWindow = int32(cnf.ConnectionWindowSize)
 	sc.currentWindow = sc.maxWindow
 
+	// the client's parameters are the default ones until its SETTINGS frames are received.
+	sc.clientS.Reset()
+	// RFC(6.5.2): the initial value of SETTINGS_ENABLE_PUSH is 1.
+	sc.clientS.SetPush(true)
+
+	if upgrade != nil {
+		// RFC(3.2.1):
+		//
+		// A server decodes and interprets these values as it would any other SETTINGS frame.
+		upgrade.settings.applyTo(&sc.clientS)
+		sc.enc.SetMaxTableSize(sc.clientS.HeaderTableSize())
+		sc.maxFrameSize = sc.clientS.MaxFrameSize()
+		sc.upgrade = upgrade.req
+	}
+
+	sc.storePushSettings()
+
 	sc.st.Reset()
-	sc.st.SetMaxWindowSize(uint32(sc.maxWindow))
-	sc.st.SetMaxConcurrentStreams(uint32(s.cnf.MaxConcurrentStreams))
+	serverSettings(&sc.st, s.s, int32(cnf.StreamWindowSize))
+
+	if cnf.MaxHeaderListSize > 0 {
+		sc.st.SetMaxHeaderListSize(uint32(cnf.MaxHeaderListSize))
+	} else if cnf.MaxHeaderListSize == 0 && sc.st.MaxHeaderListSize() == 0 {
+		sc.st.SetMaxHeaderListSize(defaultMaxHeaderListSize)
+	}
+
+	listSize := int(sc.st.MaxHeaderListSize())
+	if cnf.MaxHeaderListSize >= 0 {
+		sc.maxHeaderListSize = listSize
+	} else if listSize < defaultMaxHeaderListSize {
+		// the header list isn't limited, but the header blocks still are,
+		// otherwise a client could send CONTINUATION frames forever.
+		listSize = defaultMaxHeaderListSize
+	}
+
+	// the encoded fields are usually smaller than their size in the header list (with the overhead
+	// of 32 bytes per field), so the block can take at most one more frame.
+	// The CONTINUATION frames allowed are the ones needed to send the largest block,
+	// with some slack for the clients not filling the frames.
+	frameSize := int(sc.st.MaxFrameSize())
+	sc.maxHeaderBlockSize = listSize + frameSize
+	sc.maxContinuations = sc.maxHeaderBlockSize/frameSize + 8
+
+	sc.st.SetMaxConcurrentStreams(uint32(cnf.AdvertisedMaxStreams))
+	sc.st.SetConnectProtocol(cnf.EnableConnectProtocol)
 
 	if err := sc.Handshake(); err != nil {
 		return err
@@ -86,3 +442,42 @@ func (s *Server) ServeConn(c net.Conn) error {
 
 	return sc.Serve()
 }
+
+// ServeTLS accepts the connections from `ln` and serves them over TLS using `tlsConfig`.
+//
+// The protocol is negotiated using ALPN: the connections negotiating h2 are served
+// by ServeConn, while the rest are served by the fasthttp.Server as HTTP/1.1.
+// The h2 and http/1.1 protocols are added to a copy of tlsConfig if they are missing.
+//
+// HTTP/2 forbids the TLS renegotiation, which crypto/tls servers never perform:
+// if a client attempts it, the TLS connection fails and gets closed.
+//
+// ServeTLS blocks until `ln` returns an error.
+func (s *Server) ServeTLS(ln net.Listener, tlsConfig *tls.Config) error {
+	cfg := tlsConfig.Clone()
+	cfg.NextProtos = appendProtos(cfg.NextProtos, H2TLSProto, "http/1.1")
+
+	s.s.NextProto(H2TLSProto, s.ServeConn)
+
+	return s.s.Serve(tls.NewListener(ln, cfg))
+}
+
+// appendProtos appends the protocols not present in `dst`.
+func appendProtos(dst []string, protos ...string) []string {
+	for _, proto := range protos {
+		found := false
+
+		for _, p := range dst {
+			if p == proto {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			dst = append(dst, proto)
+		}
+	}
+
+	return dst
+}
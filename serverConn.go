@@ -11,6 +11,7 @@ import (
 	"os"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -25,10 +26,17 @@ const (
 	connStateClosed
 )
 
+// maxRefusedStreams is the number of refused stream ids remembered by the server
+// to ignore the frames the client sent before receiving the RST_STREAM.
+const maxRefusedStreams = 128
+
 type serverConn struct {
 	c net.Conn
 	h fasthttp.RequestHandler
 
+	// id identifies the connection in the requests' contexts.
+	id uint64
+
 	br *bufio.Reader
 	bw *bufio.Writer
 
@@ -38,9 +46,28 @@ type serverConn struct {
 	// last valid ID used as a reference for new IDs
 	lastID uint32
 
-	// client's window
+	// clientWindow is the client's SETTINGS_INITIAL_WINDOW_SIZE,
+	// the window the streams start with.
 	// should be int64 because the user can try to overflow it
 	clientWindow int64
+	// sendWindow is the connection's window, the number of bytes
+	// of DATA that can be sent before receiving a WINDOW_UPDATE.
+	sendWindow int64
+
+	// flowMu guards sendWindow, the streams' windows and the fields below.
+	// flowCond wakes up the writers waiting for a window when it changes.
+	flowMu   sync.Mutex
+	flowCond *sync.Cond
+	// sendStrms contains the streams whose response can still be sent.
+	// The window updates of these streams are applied by the readLoop, so
+	// the writers waiting for them are never blocked behind handleStreams.
+	sendStrms map[uint32]*Stream
+	// pendingWindows contains the window increments received for the streams
+	// read by the readLoop (up to readID) but not created by handleStreams yet (above openedID).
+	pendingWindows map[uint32]int64
+	openedID       uint32
+	readID         uint32
+	flowClosed     bool
 
 	// our values
 	maxWindow     int32
@@ -48,6 +75,8 @@ type serverConn struct {
 
 	writer chan *FrameHeader
 	reader chan *FrameHeader
+	// writeErr receives the error that stopped the writeLoop.
+	writeErr chan error
 
 	state connState
 	// closeRef stores the last stream that was valid before sending a GOAWAY.
@@ -57,12 +86,76 @@ type serverConn struct {
 
 	// maxRequestTime is the max time of a request over one single stream
 	maxRequestTime time.Duration
-	pingInterval   time.Duration
+	// pingInterval is accessed atomically, as it can be changed by the handlers.
+	pingInterval int64
+	// maxPings is the number of pings per second accepted from the client. <= 0 means no limit.
+	maxPings int
+	// pings is the number of pings received since pingsStart (only accessed by the readLoop).
+	pings      int
+	pingsStart time.Time
+	// maxResets is the number of streams per minute the client can reset
+	// before they are completed. <= 0 means no limit.
+	maxResets int
+	// resets is the number of streams reset since resetsStart (only accessed by handleStreams).
+	resets      int
+	resetsStart time.Time
 	// maxIdleTime is the max time a client can be connected without sending any REQUEST.
 	// As highlighted, PING/PONG frames are completely excluded.
 	//
 	// Therefore, a client that didn't send a request for more than `maxIdleTime` will see it's connection closed.
 	maxIdleTime time.Duration
+	// goAwayGrace is the time given to the client to close the connection after a GOAWAY.
+	goAwayGrace time.Duration
+	// maxConnAge is the lifetime of the connection, after which it's closed gracefully.
+	maxConnAge time.Duration
+
+	// maxRequestBodySize limits the request body allocated in advance.
+	maxRequestBodySize int
+
+	// maxFrameSize is the client's SETTINGS_MAX_FRAME_SIZE.
+	maxFrameSize uint32
+	// coalesce buffers the streamed response bodies into DATA frames of maxFrameSize.
+	coalesce bool
+	// indexedHeaders are the response fields stored in the encoder's dynamic table.
+	indexedHeaders []string
+
+	// pushEnabled is the client's SETTINGS_ENABLE_PUSH, and clientMaxStreams
+	// its SETTINGS_MAX_CONCURRENT_STREAMS, which limits the pushed streams.
+	pushEnabled      int32
+	clientMaxStreams uint32
+	// pushedStreams is the number of streams promised and not closed yet.
+	pushedStreams int32
+	// lastPushID is the id of the last promised stream.
+	lastPushID uint32
+
+	// allowedMethods is the list of methods accepted by the server. If empty, any method is accepted.
+	allowedMethods []string
+	// getOnly refuses the requests other than GET, like fasthttp.Server.GetOnly.
+	getOnly bool
+
+	// maxEvictions is the maximum number of dynamic table evictions per header block. 0 means no limit.
+	maxEvictions uint64
+	// maxHeaderListSize is the maximum size of the request header list. 0 means no limit.
+	maxHeaderListSize int
+	// maxHeaderBlockSize is the maximum size of the frames of a request header block,
+	// and maxContinuations the number of CONTINUATION frames allowed per block. 0 means no limit.
+	maxHeaderBlockSize int
+	maxContinuations   int
+	// blockEvictions is the number of decoder evictions before the current header block.
+	blockEvictions uint64
+
+	// requireAuth resets the requests without an :authority nor an absolute-form :path.
+	requireAuth bool
+	// connectProto allows the extended CONNECT requests (RFC 8441).
+	connectProto bool
+	// headersHandler decides whether the body of a request is accepted, see ServerConfig.HeadersHandler.
+	headersHandler func(ctx *fasthttp.RequestCtx) bool
+
+	// upgrade is the HTTP/1.1 request of a connection upgraded to h2c, served as the stream 1.
+	upgrade *fasthttp.Request
+
+	// maxStreams is the number of open streams above which the new streams are refused.
+	maxStreams int
 
 	st      Settings
 	clientS Settings
@@ -71,44 +164,98 @@ type serverConn struct {
 	pingTimer       *time.Timer
 	maxRequestTimer *time.Timer
 	maxIdleTimer    *time.Timer
+	maxAgeTimer     *time.Timer
 
 	closer chan struct{}
 
-	debug  bool
-	logger fasthttp.Logger
+	// workers limits the number of handlers running concurrently.
+	// If nil, the handlers are executed by handleStreams.
+	workers chan struct{}
+	// handlers keeps track of the running handlers.
+	handlers sync.WaitGroup
+	// handled receives the streams whose handler finished.
+	handled chan *Stream
+	// streamsDone is closed once handleStreams returns.
+	streamsDone chan struct{}
+	// encMu serializes the response headers encoding and
+	// sending when the handlers run concurrently.
+	encMu sync.Mutex
+
+	logLevel LogLevel
+	logger   fasthttp.Logger
+
+	// flow decides when the windows are replenished.
+	flow FlowController
+
+	// schedule, if set, chooses the next frame to write among the pending ones,
+	// returning its index or -1 to wait for more frames.
+	//
+	// It makes the interleaving of the streams deterministic in the tests.
+	// The header frames must be written in the order they were queued,
+	// as the HPACK state depends on it.
+	schedule func(pending []*FrameHeader) int
+}
+
+// logf logs the message if the server's LogLevel is at least `level`.
+func (sc *serverConn) logf(level LogLevel, format string, args ...interface{}) {
+	if sc.logLevel >= level {
+		sc.logger.Printf(format, args...)
+	}
 }
 
 func (sc *serverConn) closeIdleConn() {
 	sc.writeGoAway(0, NoError, "connection has been idle for a long time")
-	if sc.debug {
-		sc.logger.Printf("Connection is idle. Closing\n")
-	}
+	sc.logf(LogLevelInfo, "Connection is idle. Closing\n")
 	close(sc.closer)
 }
 
 func (sc *serverConn) Handshake() error {
-	return Handshake(false, sc.bw, &sc.st, sc.maxWindow)
+	err := Handshake(false, sc.bw, &sc.st, sc.maxWindow)
+	if err == nil {
+		sc.maxWindow = connWindow(sc.maxWindow)
+		sc.currentWindow = sc.maxWindow
+	}
+
+	return err
 }
 
 func (sc *serverConn) Serve() error {
 	sc.closer = make(chan struct{}, 1)
+	sc.handled = make(chan *Stream, 16)
+	sc.streamsDone = make(chan struct{})
+	sc.writeErr = make(chan error, 1)
 	sc.maxRequestTimer = time.NewTimer(0)
 	sc.clientWindow = int64(sc.clientS.MaxWindowSize())
+	sc.sendWindow = int64(defaultWindowSize)
+	sc.flowCond = sync.NewCond(&sc.flowMu)
 
 	if sc.maxIdleTime > 0 {
 		sc.maxIdleTimer = time.AfterFunc(sc.maxIdleTime, sc.closeIdleConn)
 	}
 
+	if sc.maxConnAge > 0 {
+		sc.maxAgeTimer = time.NewTimer(sc.maxConnAge)
+	}
+
+	// the timer is created here and not in the writeLoop because the goroutine
+	// closing the writer stops it, and it might run before the writeLoop starts.
+	if sc.pingInterval > 0 {
+		sc.pingTimer = time.AfterFunc(time.Duration(sc.pingInterval), sc.sendPingAndSchedule)
+	}
+
 	defer func() {
 		if err := recover(); err != nil {
-			sc.logger.Printf("Serve panicked: %s:\n%s\n", err, debug.Stack())
+			sc.logf(LogLevelError, "Serve panicked: %s:\n%s\n", err, debug.Stack())
 		}
 	}()
 
+	writerDone := make(chan struct{})
+
 	go func() {
 		// defer closing the connection in the writeLoop in case the writeLoop panics
 		defer func() {
-			_ = sc.c.Close()
+			sc.closeWriter()
+			close(writerDone)
 		}()
 
 		sc.writeLoop()
@@ -116,38 +263,99 @@ func (sc *serverConn) Serve() error {
 
 	go func() {
 		sc.handleStreams()
+		close(sc.streamsDone)
+		// wait for the running handlers before closing the writer.
+		sc.handlers.Wait()
+
+		sc.encMu.Lock()
+		sc.logf(LogLevelInfo, "Connection closed. Header compression ratio: %.2f\n", sc.enc.CompressionRatio())
+		sc.encMu.Unlock()
+
 		// Fix #55: The pingTimer fired while we were closing the connection.
-		sc.pingTimer.Stop()
+		if sc.pingTimer != nil {
+			sc.pingTimer.Stop()
+		}
 		// close the writer here to ensure that no pending requests
 		// are writing to a closed channel
 		close(sc.writer)
 	}()
 
-	defer func() {
-		// close the reader here so we can stop handling stream updates
-		close(sc.reader)
-	}()
-
 	var err error
 
-	// unset any deadline
+	// unset any deadline. If it fails, the connection is still shut down below
+	// so the goroutines started above finish.
 	if err = sc.c.SetWriteDeadline(time.Time{}); err == nil {
 		err = sc.c.SetReadDeadline(time.Time{})
 	}
-	if err != nil {
-		return err
+
+	if err == nil {
+		err = sc.readLoop()
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
 	}
 
-	err = sc.readLoop()
-	if errors.Is(err, io.EOF) {
-		err = nil
+	// the readLoop fails because the writeLoop closed the connection.
+	select {
+	case werr := <-sc.writeErr:
+		err = werr
+	default:
 	}
 
 	sc.close()
 
+	// close the reader here so we can stop handling stream updates.
+	// It must happen before waiting for the writeLoop, which only ends
+	// after handleStreams returns and closes the writer.
+	close(sc.reader)
+
+	// after a GOAWAY keep reading until the client closes the connection or the grace period expires.
+	// Closing the connection with unread data might make the client lose the GOAWAY.
+	if sc.lingers() {
+		_, _ = io.Copy(io.Discard, sc.br)
+	}
+
+	// give the writeLoop some time to send the frames already queued (like a GOAWAY)
+	// before the connection gets closed, without blocking on a client not reading.
+	select {
+	case <-writerDone:
+	case <-time.After(writerCloseTimeout):
+	}
+
 	return err
 }
 
+// writerCloseTimeout is how long Serve waits for the queued frames to be written.
+const writerCloseTimeout = time.Second
+
+// lingers reports whether the connection is kept open after sending a GOAWAY.
+func (sc *serverConn) lingers() bool {
+	if sc.goAwayGrace <= 0 || atomic.LoadInt32((*int32)(&sc.state)) != int32(connStateClosed) {
+		return false
+	}
+
+	return canCloseWrite(sc.c)
+}
+
+// closeWriter is called once all the frames have been written.
+//
+// If the connection lingers only the writing side gets closed, so the client
+// reads the GOAWAY followed by an EOF. The reading side is closed
+// when the grace period expires.
+func (sc *serverConn) closeWriter() {
+	if !sc.lingers() {
+		_ = sc.c.Close()
+		return
+	}
+
+	if err := sc.c.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		_ = sc.c.Close()
+		return
+	}
+
+	_ = sc.c.SetReadDeadline(time.Now().Add(sc.goAwayGrace))
+}
+
 func (sc *serverConn) close() {
 	if sc.pingTimer != nil {
 		sc.pingTimer.Stop()
@@ -157,17 +365,58 @@ func (sc *serverConn) close() {
 		sc.maxIdleTimer.Stop()
 	}
 
+	if sc.maxAgeTimer != nil {
+		sc.maxAgeTimer.Stop()
+	}
+
 	sc.maxRequestTimer.Stop()
+
+	sc.closeWindows()
 }
 
 func (sc *serverConn) handlePing(ping *Ping) {
+	// the received ping is released along with its frame header,
+	// so the reply needs its own frame.
+	pong := AcquireFrame(FramePing).(*Ping)
+	ping.CopyTo(pong)
+	pong.SetAck(true)
+
 	fr := AcquireFrameHeader()
-	ping.SetAck(true)
-	fr.SetBody(ping)
+	fr.SetBody(pong)
 
 	sc.writer <- fr
 }
 
+// allowPing reports whether the client is below the limit of pings per second.
+func (sc *serverConn) allowPing() bool {
+	if sc.maxPings <= 0 {
+		return true
+	}
+
+	if now := time.Now(); now.Sub(sc.pingsStart) >= time.Second {
+		sc.pingsStart, sc.pings = now, 0
+	}
+
+	sc.pings++
+
+	return sc.pings <= sc.maxPings
+}
+
+// allowReset reports whether the client is below the limit of streams reset per minute.
+func (sc *serverConn) allowReset() bool {
+	if sc.maxResets <= 0 {
+		return true
+	}
+
+	if now := time.Now(); now.Sub(sc.resetsStart) >= time.Minute {
+		sc.resetsStart, sc.resets = now, 0
+	}
+
+	sc.resets++
+
+	return sc.resets <= sc.maxResets
+}
+
 func (sc *serverConn) writePing() {
 	fr := AcquireFrameHeader()
 
@@ -180,13 +429,30 @@ func (sc *serverConn) writePing() {
 }
 
 func (sc *serverConn) checkFrameWithStream(fr *FrameHeader) error {
-	if fr.Stream()&1 == 0 {
+	// RFC(5.1.1):
+	//
+	// Streams initiated by a client MUST use odd-numbered stream identifiers.
+	// The even streams above the last promised stream are idle.
+	if fr.Stream()&1 == 0 && fr.Stream() > atomic.LoadUint32(&sc.lastPushID) {
 		return NewGoAwayError(ProtocolError, "invalid stream id")
 	}
 
 	switch fr.Type() {
 	case FramePing:
 		return NewGoAwayError(ProtocolError, "ping is carrying a stream id")
+	case FrameSettings:
+		// RFC(6.5):
+		//
+		// If an endpoint receives a SETTINGS frame whose stream identifier
+		// field is anything other than 0x0, the endpoint MUST respond with a
+		// connection error (Section 5.4.1) of type PROTOCOL_ERROR.
+		return NewGoAwayError(ProtocolError, "settings is carrying a stream id")
+	case FrameGoAway:
+		// RFC(6.8):
+		//
+		// An endpoint MUST treat a GOAWAY frame with a stream identifier other
+		// than 0x0 as a connection error (Section 5.4.1) of type PROTOCOL_ERROR.
+		return NewGoAwayError(ProtocolError, "goaway is carrying a stream id")
 	case FramePushPromise:
 		return NewGoAwayError(ProtocolError, "clients can't send push_promise frames")
 	}
@@ -197,14 +463,18 @@ func (sc *serverConn) checkFrameWithStream(fr *FrameHeader) error {
 func (sc *serverConn) readLoop() (err error) {
 	defer func() {
 		if err := recover(); err != nil {
-			sc.logger.Printf("readLoop panicked: %s\n%s\n", err, debug.Stack())
+			sc.logf(LogLevelError, "readLoop panicked: %s\n%s\n", err, debug.Stack())
 		}
 	}()
 
 	var fr *FrameHeader
 
+	// prefaceDone is set once the SETTINGS frame of the client's preface is received.
+	prefaceDone := false
+
 	for err == nil {
-		fr, err = ReadFrameFromWithSize(sc.br, sc.clientS.frameSize)
+		// the frames can't be larger than our SETTINGS_MAX_FRAME_SIZE.
+		fr, err = ReadFrameFromWithSize(sc.br, sc.st.MaxFrameSize())
 		if err != nil {
 			if errors.Is(err, ErrUnknownFrameType) {
 				sc.writeGoAway(0, ProtocolError, "unknown frame type")
@@ -212,17 +482,60 @@ func (sc *serverConn) readLoop() (err error) {
 				continue
 			}
 
+			if errors.Is(err, ErrPayloadExceeds) {
+				sc.writeGoAway(0, FrameSizeError, "frame exceeds SETTINGS_MAX_FRAME_SIZE")
+			}
+
 			break
 		}
 
+		// RFC(3.5):
+		//
+		// That is, the connection preface starts with the string "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n".
+		// This sequence MUST be followed by a SETTINGS frame, which MAY be empty.
+		// ...
+		// Clients and servers MUST treat an invalid connection preface as a
+		// connection error of type PROTOCOL_ERROR.
+		if !prefaceDone {
+			prefaceDone = true
+
+			if st, ok := fr.Body().(*Settings); !ok || st.IsAck() {
+				sc.writeGoAway(0, ProtocolError, "invalid connection preface")
+				ReleaseFrameHeader(fr)
+
+				continue
+			}
+		}
+
 		if fr.Stream() != 0 {
+			// the invalid frames never reach handleStreams, so no stream is created for them.
 			err := sc.checkFrameWithStream(fr)
 			if err != nil {
 				sc.writeError(nil, err)
-			} else {
-				sc.reader <- fr
+				ReleaseFrameHeader(fr)
+
+				continue
 			}
 
+			switch fr.Type() {
+			case FrameHeaders:
+				if fr.Stream()&1 != 0 && fr.Stream() > sc.readID {
+					sc.flowMu.Lock()
+					sc.readID = fr.Stream()
+					sc.flowMu.Unlock()
+				}
+			case FrameWindowUpdate:
+				if sc.updateWindow(fr.Stream(), fr.Body().(*WindowUpdate).Increment()) {
+					ReleaseFrameHeader(fr)
+					continue
+				}
+			case FrameResetStream:
+				// wake up the handler writing the response, as it won't be sent.
+				sc.closeWindow(fr.Stream())
+			}
+
+			sc.reader <- fr
+
 			continue
 		}
 
@@ -241,14 +554,29 @@ func (sc *serverConn) readLoop() (err error) {
 				continue
 			}
 
-			if atomic.AddInt64(&sc.clientWindow, win) >= 1<<31-1 {
+			sc.flowMu.Lock()
+			sc.sendWindow += win
+			overflow := sc.sendWindow >= 1<<31-1
+			sc.flowCond.Broadcast()
+			sc.flowMu.Unlock()
+
+			if overflow {
 				sc.writeGoAway(0, FlowControlError, "window is above limits")
 			}
 		case FramePing:
 			ping := fr.Body().(*Ping)
-			if !ping.IsAck() {
-				sc.handlePing(ping)
+			if ping.IsAck() {
+				break
+			}
+
+			if !sc.allowPing() {
+				err = NewGoAwayError(EnhanceYourCalm, "too many pings")
+				sc.writeError(nil, err)
+
+				break
 			}
+
+			sc.handlePing(ping)
 		case FrameGoAway:
 			ga := fr.Body().(*GoAway)
 			if ga.Code() == NoError {
@@ -256,6 +584,10 @@ func (sc *serverConn) readLoop() (err error) {
 			} else {
 				err = fmt.Errorf("goaway: %s: %s", ga.Code(), ga.Data())
 			}
+		case FrameHeaders, FrameContinuation, FrameData, FrameResetStream, FramePriority, FramePushPromise:
+			// these frames are always associated with a stream (RFC 7540, sections 6.1 to 6.4, 6.6 and 6.10),
+			// so receiving them on stream 0 is a connection error of type PROTOCOL_ERROR.
+			sc.writeGoAway(0, ProtocolError, fr.Type().String()+" frame on stream 0")
 		default:
 			sc.writeGoAway(0, ProtocolError, "invalid frame")
 		}
@@ -271,7 +603,7 @@ func (sc *serverConn) readLoop() (err error) {
 func (sc *serverConn) handleStreams() {
 	defer func() {
 		if err := recover(); err != nil {
-			sc.logger.Printf("handleStreams panicked: %s\n%s\n", err, debug.Stack())
+			sc.logf(LogLevelError, "handleStreams panicked: %s\n%s\n", err, debug.Stack())
 		}
 	}()
 
@@ -279,36 +611,200 @@ func (sc *serverConn) handleStreams() {
 	var reqTimerArmed bool
 	var openStreams int
 
+	defer func() {
+		// let the running handlers know their streams won't be processed anymore.
+		for _, strm := range strms {
+			strm.SetState(StreamStateClosed)
+		}
+
+		sc.closeWindows()
+	}()
+
 	closedStrms := make(map[uint32]struct{})
 
-	closeStream := func(strm *Stream) {
-		if strm.origType == FrameHeaders {
-			openStreams--
+	// refusedStrms contains the latest stream ids reset before handling the requests,
+	// because the streams were refused or their bodies rejected.
+	var refusedStrms []uint32
+
+	refuseStream := func(id uint32, code ErrorCode) {
+		sc.writeReset(id, code)
+		sc.closeWindow(id)
+
+		if len(refusedStrms) == maxRefusedStreams {
+			refusedStrms = append(refusedStrms[:0], refusedStrms[1:]...)
+		}
+
+		refusedStrms = append(refusedStrms, id)
+
+		// the stream id is used, even if the stream was refused.
+		if id > sc.lastID {
+			sc.lastID = id
+		}
+	}
+
+	isRefused := func(id uint32) bool {
+		for _, refusedID := range refusedStrms {
+			if refusedID == id {
+				return true
+			}
 		}
 
+		return false
+	}
+
+	// servePushed handles the streams promised by the handler of `parent`.
+	var servePushed func(parent *Stream)
+
+	closeStream := func(strm *Stream) {
 		strmID := strm.ID()
 
+		// the stream might be closed from different paths (timeouts, resets, the handler finishing...),
+		// but only the first close must release it.
+		if _, ok := closedStrms[strmID]; ok {
+			return
+		}
+
+		switch strm.origType {
+		case FrameHeaders:
+			openStreams--
+		case FramePushPromise:
+			atomic.AddInt32(&sc.pushedStreams, -1)
+		}
+
+		strm.SetState(StreamStateClosed)
 		closedStrms[strm.ID()] = struct{}{}
 		strms.Del(strm.ID())
+		sc.closeWindow(strmID)
+
+		// if the handler is still running, the stream is released once it finishes.
+		if !strm.handling {
+			servePushed(strm)
+
+			ctxPool.Put(strm.ctx)
+			streamPool.Put(strm)
+		}
+
+		sc.logf(LogLevelDebug, "Stream destroyed %d. Open streams: %d\n", strmID, openStreams)
+	}
+
+	servePushed = func(parent *Stream) {
+		for _, strm := range parent.pushed {
+			// the client might have reset the promised stream before the handler returned.
+			if _, ok := closedStrms[strm.ID()]; ok {
+				atomic.AddInt32(&sc.pushedStreams, -1)
+
+				ctxPool.Put(strm.ctx)
+				streamPool.Put(strm)
+
+				continue
+			}
+
+			// RFC(8.2.2):
+			//
+			// Once a client receives a PUSH_PROMISE frame and chooses to accept the
+			// pushed response, the client SHOULD NOT issue any requests for the
+			// promised response until after the promised stream has closed.
+			//
+			// The promised streams are half-closed (remote) once the response is sent,
+			// as the client can't send a request body.
+			strm.SetState(StreamStateHalfClosed)
+			strms = append(strms, strm)
+
+			sc.logf(LogLevelDebug, "Stream %d pushed\n", strm.ID())
+
+			if sc.workers != nil {
+				sc.dispatch(strm)
+				continue
+			}
+
+			sc.handleEndRequest(strm)
+			closeStream(strm)
+		}
+
+		parent.pushed = parent.pushed[:0]
+	}
+
+	// canClose reports whether all the streams previous to closeRef are closed.
+	canClose := func() bool {
+		ref := atomic.LoadUint32(&sc.closeRef)
+		// if there's no reference, then just close the connection
+		if ref == 0 {
+			return true
+		}
+
+		// if we have a ref, then check that all streams previous to that ref are closed
+		for _, strm := range strms {
+			// if the stream is here, then it's not closed yet.
+			// The pushed streams are always completed.
+			if (strm.origType == FrameHeaders && strm.ID() <= ref) || strm.origType == FramePushPromise {
+				return false
+			}
+		}
 
-		ctxPool.Put(strm.ctx)
-		streamPool.Put(strm)
+		return true
+	}
 
-		if sc.debug {
-			sc.logger.Printf("Stream destroyed %d. Open streams: %d\n", strmID, openStreams)
+	if sc.upgrade != nil {
+		// RFC(3.2):
+		//
+		// The HTTP/1.1 request that is sent prior to upgrade is assigned a stream
+		// identifier of 1 with default priority values. Stream 1 is implicitly
+		// "half-closed" from the client toward the server, since the request is
+		// completed as an HTTP/1.1 request.
+		strm := NewStream(1, 0)
+		sc.createStream(sc.c, FrameHeaders, strm)
+
+		sc.upgrade.CopyTo(&strm.ctx.Request)
+		fasthttp.ReleaseRequest(sc.upgrade)
+		sc.upgrade = nil
+
+		strm.scheme = append(strm.scheme[:0], "http"...)
+		strm.ctx.Request.URI().SetSchemeBytes(strm.scheme)
+		strm.headersFinished = true
+		strm.SetState(StreamStateHalfClosed)
+
+		strms = append(strms, strm)
+		openStreams++
+		sc.lastID = 1
+
+		if sc.workers != nil {
+			sc.dispatch(strm)
+		} else {
+			sc.handleEndRequest(strm)
+			closeStream(strm)
 		}
 	}
 
+	var maxAge <-chan time.Time
+	if sc.maxAgeTimer != nil {
+		maxAge = sc.maxAgeTimer.C
+	}
+
 loop:
 	for {
 		select {
 		case <-sc.closer:
 			break loop
+		case <-maxAge:
+			maxAge = nil
+
+			// the streams already opened by the client are completed before closing.
+			sc.writeGoAway(sc.lastID, NoError, "max connection age reached")
+
+			if canClose() {
+				break loop
+			}
 		case <-sc.maxRequestTimer.C:
 			reqTimerArmed = false
 
-			deleteUntil := 0
-			for _, strm := range strms {
+			// the timer fires once after being created, even if the requests can't time out.
+			if sc.maxRequestTime <= 0 {
+				continue
+			}
+
+			for i := 0; i < len(strms); {
+				strm := strms[i]
+
 				// the request is due if the startedAt time + maxRequestTime is in the past
 				isDue := time.Now().After(
 					strm.startedAt.Add(sc.maxRequestTime))
@@ -316,27 +812,30 @@ loop:
 					break
 				}
 
-				deleteUntil++
-			}
-
-			for deleteUntil > 0 {
-				strm := strms[0]
-
-				if sc.debug {
-					sc.logger.Printf("Stream timed out: %d\n", strm.ID())
+				// the request has been received, the handler is processing it.
+				if strm.handling {
+					i++
+					continue
 				}
+
+				sc.logf(LogLevelInfo, "Stream timed out: %d\n", strm.ID())
 				sc.writeReset(strm.ID(), StreamCanceled)
 
 				// set the state to closed in case it comes back to life later
 				strm.SetState(StreamStateClosed)
 				closeStream(strm)
-
-				deleteUntil--
 			}
 
 			if len(strms) != 0 && sc.maxRequestTime > 0 {
 				// the first in the stream list might have started with a PushPromise
-				strm := strms.GetFirstOf(FrameHeaders)
+				var strm *Stream
+				for _, s := range strms {
+					if s.origType == FrameHeaders && !s.handling {
+						strm = s
+						break
+					}
+				}
+
 				if strm != nil {
 					reqTimerArmed = true
 					// try to arm the timer
@@ -344,11 +843,25 @@ loop:
 					// if the time is negative or zero it triggers imm
 					sc.maxRequestTimer.Reset(when)
 
-					if sc.debug {
-						sc.logger.Printf("Next request will timeout in %f seconds\n", when.Seconds())
-					}
+					sc.logf(LogLevelDebug, "Next request will timeout in %f seconds\n", when.Seconds())
 				}
 			}
+		case strm := <-sc.handled:
+			strm.handling = false
+
+			// the stream could have been closed while the handler was running.
+			if _, ok := closedStrms[strm.ID()]; ok {
+				servePushed(strm)
+
+				ctxPool.Put(strm.ctx)
+				streamPool.Put(strm)
+			} else {
+				closeStream(strm)
+			}
+
+			if atomic.LoadInt32((*int32)(&sc.state)) == int32(connStateClosed) && canClose() {
+				break loop
+			}
 		case fr, ok := <-sc.reader:
 			if !ok {
 				return
@@ -356,14 +869,64 @@ loop:
 
 			isClosing := atomic.LoadInt32((*int32)(&sc.state)) == int32(connStateClosed)
 
-			var strm *Stream
-			if fr.Stream() <= sc.lastID {
-				strm = strms.Search(fr.Stream())
+			// streams created by a PRIORITY frame don't update the lastID,
+			// so the stream needs to be searched even if the id is above lastID.
+			strm := strms.Search(fr.Stream())
+
+			if strm != nil && strm.origType != FrameHeaders && fr.Type() == FrameHeaders {
+				// the stream is opened now, so it must be counted and released as any other.
+				if fr.Stream() < sc.lastID {
+					sc.writeGoAway(fr.Stream(), ProtocolError, "stream ID is lower than the latest")
+					continue
+				}
+
+				if openStreams >= sc.maxStreams || isClosing {
+					closeStream(strm)
+					refuseStream(fr.Stream(), RefusedStreamError)
+
+					continue
+				}
+
+				strm.origType = FrameHeaders
+				strm.startedAt = time.Now()
+
+				// keep the streams sorted by the time they were opened.
+				strms.Del(strm.ID())
+				strms = append(strms, strm)
+
+				openStreams++
+				sc.lastID = fr.Stream()
 			}
 
 			if strm == nil {
 				// if the stream doesn't exist, create it
 
+				// the promised streams are added once the handler that pushed them returns,
+				// so the frames received before are ignored, except the resets.
+				if fr.Stream()&1 == 0 {
+					if fr.Type() == FrameResetStream {
+						closedStrms[fr.Stream()] = struct{}{}
+					}
+
+					continue
+				}
+
+				// RFC(5.4.2):
+				//
+				// After sending the RST_STREAM, the sending endpoint MUST be prepared to
+				// receive and handle additional frames sent on the stream that might have
+				// been sent by the peer prior to the arrival of the RST_STREAM.
+				if isRefused(fr.Stream()) {
+					sc.logf(LogLevelDebug, "Ignoring %s frame on refused stream %d\n", fr.Type(), fr.Stream())
+
+					// the ignored data still counts towards the connection's window.
+					if fr.Type() == FrameData {
+						sc.consumeData(nil, fr)
+					}
+
+					continue
+				}
+
 				if fr.Type() == FrameResetStream {
 					// only send go away on idle stream not on an already-closed stream
 					if _, ok := closedStrms[fr.Stream()]; !ok {
@@ -374,26 +937,42 @@ loop:
 				}
 
 				if _, ok := closedStrms[fr.Stream()]; ok {
-					if fr.Type() != FramePriority {
+					// RFC(5.1):
+					//
+					// WINDOW_UPDATE or RST_STREAM frames can be received in this state
+					// for a short period after a DATA or HEADERS frame containing an
+					// END_STREAM flag is sent.
+					if fr.Type() != FramePriority && fr.Type() != FrameWindowUpdate {
 						sc.writeGoAway(fr.Stream(), StreamClosedError, "frame on closed stream")
 					}
 
 					continue
 				}
 
+				// RFC(5.1):
+				//
+				// Receiving any frame other than HEADERS or PRIORITY on a stream
+				// in this state MUST be treated as a connection error of type PROTOCOL_ERROR.
+				if fr.Stream() > sc.lastID && fr.Type() != FrameHeaders && fr.Type() != FramePriority {
+					sc.writeGoAway(fr.Stream(), ProtocolError, fr.Type().String()+" frame on idle stream")
+					continue
+				}
+
 				// if the client has more open streams than the maximum allowed OR
 				//   the connection is closing, then refuse the stream
-				if openStreams >= int(sc.st.maxStreams) || isClosing {
-					if sc.debug {
-						if isClosing {
-							sc.logger.Printf("Closing the connection. Rejecting stream %d\n", fr.Stream())
-						} else {
-							sc.logger.Printf("Max open streams reached: %d >= %d\n",
-								openStreams, sc.st.maxStreams)
-						}
+				if openStreams >= sc.maxStreams || isClosing {
+					if isClosing {
+						sc.logf(LogLevelInfo, "Closing the connection. Rejecting stream %d\n", fr.Stream())
+					} else {
+						sc.logf(LogLevelWarn, "Max open streams reached: %d >= %d\n",
+							openStreams, sc.maxStreams)
 					}
 
-					sc.writeReset(fr.Stream(), RefusedStreamError)
+					if fr.Type() == FrameHeaders {
+						refuseStream(fr.Stream(), RefusedStreamError)
+					} else {
+						sc.writeReset(fr.Stream(), RefusedStreamError)
+					}
 
 					continue
 				}
@@ -403,7 +982,7 @@ loop:
 					continue
 				}
 
-				strm = NewStream(fr.Stream(), int32(sc.clientWindow))
+				strm = NewStream(fr.Stream(), 0)
 				strms = append(strms, strm)
 
 				// RFC(5.1.1):
@@ -419,17 +998,13 @@ loop:
 
 				sc.createStream(sc.c, fr.Type(), strm)
 
-				if sc.debug {
-					sc.logger.Printf("Stream %d created. Open streams: %d\n", strm.ID(), openStreams)
-				}
+				sc.logf(LogLevelDebug, "Stream %d created. Open streams: %d\n", strm.ID(), openStreams)
 
 				if !reqTimerArmed && sc.maxRequestTime > 0 {
 					reqTimerArmed = true
 					sc.maxRequestTimer.Reset(sc.maxRequestTime)
 
-					if sc.debug {
-						sc.logger.Printf("Next request will timeout in %f seconds\n", sc.maxRequestTime.Seconds())
-					}
+					sc.logf(LogLevelDebug, "Next request will timeout in %f seconds\n", sc.maxRequestTime.Seconds())
 				}
 			}
 
@@ -441,30 +1016,23 @@ loop:
 					continue
 				}
 
-				for len(strms) != 0 {
-					nstrm := strms[0]
+				for i := 0; i < len(strms); {
+					nstrm := strms[i]
 					// RFC(5.1.1):
 					//
 					// The first use of a new stream identifier implicitly
 					// closes all streams in the "idle" state that might
 					// have been initiated by that peer with a lower-valued stream identifier
-					if nstrm.ID() < strm.ID() &&
-						nstrm.State() == StreamStateIdle &&
-						nstrm.origType == FrameHeaders {
-
-						nstrm.SetState(StreamStateClosed)
-						closeStream(strm)
-
-						if sc.debug {
-							sc.logger.Printf("Cancelling stream in idle state: %d\n", nstrm.ID())
-						}
-
-						sc.writeReset(nstrm.ID(), StreamCanceled)
-
+					if nstrm.ID() >= strm.ID() || nstrm.State() != StreamStateIdle {
+						i++
 						continue
 					}
 
-					break
+					sc.logf(LogLevelDebug, "Closing stream in idle state: %d\n", nstrm.ID())
+
+					// the client already considers the stream closed, so no RST_STREAM is sent.
+					// closeStream removes nstrm from strms.
+					closeStream(nstrm)
 				}
 
 				if sc.maxIdleTimer != nil {
@@ -472,6 +1040,15 @@ loop:
 				}
 			}
 
+			// the streams reset before completing their response don't count towards
+			// the concurrent streams, while their requests might still be handled.
+			if fr.Type() == FrameResetStream && strm.State() != StreamStateIdle && !sc.allowReset() {
+				sc.writeError(strm, NewGoAwayError(EnhanceYourCalm, "too many stream resets"))
+				closeStream(strm)
+
+				continue
+			}
+
 			if err := sc.handleFrame(strm, fr); err != nil {
 				sc.writeError(strm, err)
 				strm.SetState(StreamStateClosed)
@@ -479,8 +1056,58 @@ loop:
 
 			handleState(fr, strm)
 
+			// the requests with a method the server doesn't accept are answered
+			// without calling the handler once the header block is complete.
+			// REFUSED_STREAM can't be used, as it tells the client the request can be retried.
+			if strm.methodErr != nil && strm.headersFinished && fr.Type() != FrameData && fr.Flags().Has(FlagEndHeaders) &&
+				(strm.State() == StreamStateOpen || strm.State() == StreamStateHalfClosed) {
+				sc.logf(LogLevelDebug, "Stream %d: %s: %s\n", strm.ID(), strm.ctx.Method(), strm.methodErr)
+
+				sc.writeMethodNotAllowed(strm)
+
+				// the request body is not needed.
+				if strm.State() == StreamStateOpen {
+					refuseStream(strm.ID(), NoError)
+				}
+
+				closeStream(strm)
+
+				continue
+			}
+
+			// RFC(8.1):
+			//
+			// A server can send a complete response prior to the client sending an entire
+			// request if the response does not depend on any portion of the request
+			// that has not been sent and received. When this is true, a server MAY
+			// request that the client abort transmission of a request without error
+			// by sending a RST_STREAM with an error code of NO_ERROR.
+			if sc.headersHandler != nil && strm.State() == StreamStateOpen && strm.headersFinished &&
+				fr.Type() != FrameData && fr.Flags().Has(FlagEndHeaders) {
+				strm.ctx.Request.Header.SetProtocolBytes(StringHTTP2)
+
+				if !sc.headersHandler(strm.ctx) {
+					sc.logf(LogLevelDebug, "Stream %d: request body rejected\n", strm.ID())
+
+					sc.writeResponse(strm)
+					refuseStream(strm.ID(), NoError)
+					closeStream(strm)
+				}
+			}
+
 			switch strm.State() {
 			case StreamStateHalfClosed:
+				// the request has already been dispatched, or the END_STREAM
+				// was received before the END_HEADERS (RFC 7540 section 8.1).
+				if strm.handling || !strm.headersFinished {
+					break
+				}
+
+				if sc.workers != nil {
+					sc.dispatch(strm)
+					break
+				}
+
 				sc.handleEndRequest(strm)
 				// we fallthrough because once we send the response
 				// the stream is already consumed and thus finished
@@ -489,46 +1116,75 @@ loop:
 				closeStream(strm)
 			}
 
-			if isClosing {
-				ref := atomic.LoadUint32(&sc.closeRef)
-				// if there's no reference, then just close the connection
-				if ref == 0 {
-					break
-				}
-
-				// if we have a ref, then check that all streams previous to that ref are closed
-				for _, strm := range strms {
-					// if the stream is here, then it's not closed yet
-					if strm.origType == FrameHeaders && strm.ID() <= ref {
-						continue loop
-					}
-				}
-
+			if isClosing && canClose() {
 				break loop
 			}
 		}
 	}
 }
 
-func (sc *serverConn) writeReset(strm uint32, code ErrorCode) {
-	r := AcquireFrame(FrameResetStream).(*RstStream)
+// consumeData updates the flow control windows after receiving the DATA frame `fr`.
+//
+// The windows are replenished once the client used half of them,
+// so the client can keep sending the request bodies.
+func (sc *serverConn) consumeData(strm *Stream, fr *FrameHeader) {
+	n := int32(fr.Len())
+	if n == 0 {
+		return
+	}
 
-	fr := AcquireFrameHeader()
-	fr.SetStream(strm)
-	fr.SetBody(r)
+	sc.currentWindow -= n
+	sc.flow.Consumed(0, n)
 
-	r.SetCode(code)
+	if inc := windowIncrement(sc.flow, 0, sc.currentWindow, sc.maxWindow); inc > 0 {
+		sc.writeWindowUpdate(0, int(inc))
+		sc.currentWindow += inc
+	}
 
-	sc.writer <- fr
+	// the client can't send more data once the stream is ended.
+	if strm == nil || fr.Flags().Has(FlagEndStream) {
+		return
+	}
+
+	maxWindow := int32(sc.st.MaxWindowSize())
+
+	strm.recvWindow -= n
+	sc.flow.Consumed(strm.ID(), n)
 
-	if sc.debug {
-		sc.logger.Printf(
-			"%s: Reset(stream=%d, code=%s)\n",
-			sc.c.RemoteAddr(), strm, code,
-		)
+	if inc := windowIncrement(sc.flow, strm.ID(), strm.recvWindow, maxWindow); inc > 0 {
+		sc.writeWindowUpdate(strm.ID(), int(inc))
+		strm.recvWindow += inc
 	}
 }
 
+func (sc *serverConn) writeWindowUpdate(strm uint32, increment int) {
+	wu := AcquireFrame(FrameWindowUpdate).(*WindowUpdate)
+	wu.SetIncrement(increment)
+
+	fr := AcquireFrameHeader()
+	fr.SetStream(strm)
+	fr.SetBody(wu)
+
+	sc.writer <- fr
+}
+
+func (sc *serverConn) writeReset(strm uint32, code ErrorCode) {
+	r := AcquireFrame(FrameResetStream).(*RstStream)
+
+	fr := AcquireFrameHeader()
+	fr.SetStream(strm)
+	fr.SetBody(r)
+
+	r.SetCode(code)
+
+	sc.writer <- fr
+
+	sc.logf(LogLevelDebug,
+		"%s: Reset(stream=%d, code=%s)\n",
+		sc.c.RemoteAddr(), strm, code,
+	)
+}
+
 func (sc *serverConn) writeGoAway(strm uint32, code ErrorCode, message string) {
 	ga := AcquireFrame(FrameGoAway).(*GoAway)
 
@@ -548,12 +1204,16 @@ func (sc *serverConn) writeGoAway(strm uint32, code ErrorCode, message string) {
 
 	atomic.StoreInt32((*int32)(&sc.state), int32(connStateClosed))
 
-	if sc.debug {
-		sc.logger.Printf(
-			"%s: GoAway(stream=%d, code=%s): %s\n",
-			sc.c.RemoteAddr(), strm, code, message,
-		)
+	// closing the connection because of an error is always relevant.
+	level := LogLevelError
+	if code == NoError {
+		level = LogLevelInfo
 	}
+
+	sc.logf(level,
+		"%s: GoAway(stream=%d, code=%s): %s\n",
+		sc.c.RemoteAddr(), strm, code, message,
+	)
 }
 
 func (sc *serverConn) writeError(strm *Stream, err error) {
@@ -619,6 +1279,22 @@ var ctxPool = sync.Pool{
 	},
 }
 
+// lastConnID is the id of the last connection served.
+var lastConnID uint64
+
+// connIDKey is the user value key under which the connection id is stored in the fasthttp.RequestCtx.
+type connIDKey struct{}
+
+// ConnIDFromCtx returns the id of the HTTP/2 connection serving `ctx`,
+// or 0 if the request wasn't received over HTTP/2.
+//
+// All the streams of a connection share the same id, so it can be used
+// to correlate the logs of the requests received over the same connection.
+func ConnIDFromCtx(ctx *fasthttp.RequestCtx) uint64 {
+	id, _ := ctx.UserValue(connIDKey{}).(uint64)
+	return id
+}
+
 func (sc *serverConn) createStream(c net.Conn, frameType FrameType, strm *Stream) {
 	ctx := ctxPool.Get().(*fasthttp.RequestCtx)
 	ctx.Request.Reset()
@@ -628,7 +1304,230 @@ func (sc *serverConn) createStream(c net.Conn, frameType FrameType, strm *Stream
 
 	strm.origType = frameType
 	strm.startedAt = time.Now()
+	strm.recvWindow = int32(sc.st.MaxWindowSize())
 	strm.SetData(ctx)
+
+	ctx.SetUserValue(streamKey{}, strm)
+	ctx.SetUserValue(connIDKey{}, sc.id)
+
+	strm.sc = sc
+
+	// the promised streams are registered once their id is assigned.
+	if frameType != FramePushPromise {
+		sc.openWindow(strm)
+	}
+}
+
+// openWindow sets the initial window of `strm` and registers it,
+// so the window updates received are applied by the readLoop.
+func (sc *serverConn) openWindow(strm *Stream) {
+	sc.flowMu.Lock()
+	strm.window = sc.clientWindow + sc.pendingWindows[strm.ID()]
+	delete(sc.pendingWindows, strm.ID())
+
+	if strm.ID()&1 != 0 && strm.ID() > sc.openedID {
+		sc.openedID = strm.ID()
+	}
+
+	if !sc.flowClosed {
+		if sc.sendStrms == nil {
+			sc.sendStrms = make(map[uint32]*Stream)
+		}
+
+		sc.sendStrms[strm.ID()] = strm
+	}
+	sc.flowMu.Unlock()
+}
+
+// closeWindow unregisters the stream `id`, waking up the writer waiting for its window.
+func (sc *serverConn) closeWindow(id uint32) {
+	sc.flowMu.Lock()
+	delete(sc.sendStrms, id)
+	delete(sc.pendingWindows, id)
+	sc.flowCond.Broadcast()
+	sc.flowMu.Unlock()
+}
+
+// closeWindows wakes up all the writers once the connection is closed.
+func (sc *serverConn) closeWindows() {
+	sc.flowMu.Lock()
+	sc.flowClosed = true
+	sc.sendStrms = make(map[uint32]*Stream)
+	sc.pendingWindows = nil
+	sc.flowCond.Broadcast()
+	sc.flowMu.Unlock()
+}
+
+// updateWindow increments the window of the stream `id`, or keeps the increment
+// until the stream is created if its HEADERS frame is still queued to handleStreams.
+//
+// It returns false if the stream is closed or idle, or the increment is invalid,
+// leaving the frame to handleStreams.
+func (sc *serverConn) updateWindow(id uint32, increment int) bool {
+	sc.flowMu.Lock()
+	defer sc.flowMu.Unlock()
+
+	if increment == 0 {
+		return false
+	}
+
+	if strm, ok := sc.sendStrms[id]; ok {
+		if strm.window+int64(increment) >= 1<<31-1 {
+			return false
+		}
+
+		strm.window += int64(increment)
+		sc.flowCond.Broadcast()
+
+		return true
+	}
+
+	if id&1 == 0 || id <= sc.openedID || id > sc.readID || sc.flowClosed ||
+		sc.clientWindow+sc.pendingWindows[id]+int64(increment) >= 1<<31-1 {
+		return false
+	}
+
+	if sc.pendingWindows == nil {
+		sc.pendingWindows = make(map[uint32]int64)
+	}
+
+	sc.pendingWindows[id] += int64(increment)
+
+	return true
+}
+
+// reserveWindow waits until the stream and connection windows allow sending
+// DATA on `strm`, and consumes up to `n` bytes from them.
+//
+// It returns 0 if the stream or the connection is closed while waiting.
+func (sc *serverConn) reserveWindow(strm *Stream, n int) int {
+	sc.flowMu.Lock()
+	defer sc.flowMu.Unlock()
+
+	for {
+		if sc.sendStrms[strm.ID()] != strm {
+			return 0
+		}
+
+		win := strm.window
+		if sc.sendWindow < win {
+			win = sc.sendWindow
+		}
+
+		if win > 0 {
+			if int64(n) > win {
+				n = int(win)
+			}
+
+			strm.window -= int64(n)
+			sc.sendWindow -= int64(n)
+
+			return n
+		}
+
+		sc.flowCond.Wait()
+	}
+}
+
+// push sends a PUSH_PROMISE frame on `parent` reserving a new stream for the request,
+// see Stream.Push. The promised stream is handled by handleStreams once the parent's handler returns.
+func (sc *serverConn) push(parent *Stream, method, path string, header map[string][]byte) error {
+	// RFC(8.2):
+	//
+	// PUSH_PROMISE frames MUST only be sent on a peer-initiated stream that
+	// is in either the "open" or "half-closed (remote)" state.
+	if parent.ID()&1 == 0 || atomic.LoadInt32(&sc.pushEnabled) == 0 {
+		return ErrPushDisabled
+	}
+
+	// RFC(8.2):
+	//
+	// Promised requests MUST be cacheable (see [RFC7231], Section 4.2.3),
+	// MUST be safe (see [RFC7231], Section 4.2.1), and MUST NOT include a request body.
+	if method != fasthttp.MethodGet && method != fasthttp.MethodHead {
+		return ErrPushNotCacheable
+	}
+
+	if parent.closed() || atomic.LoadInt32((*int32)(&sc.state)) == int32(connStateClosed) {
+		return ErrStreamClosed
+	}
+
+	if atomic.AddInt32(&sc.pushedStreams, 1) > int32(atomic.LoadUint32(&sc.clientMaxStreams)) {
+		atomic.AddInt32(&sc.pushedStreams, -1)
+		return ErrPushLimit
+	}
+
+	strm := NewStream(0, 0)
+	strm.SetState(StreamStateReserved)
+	strm.headersFinished = true
+	strm.scheme = append(strm.scheme[:0], parent.scheme...)
+
+	sc.createStream(sc.c, FramePushPromise, strm)
+
+	req := &strm.ctx.Request
+	req.Header.SetMethod(method)
+	req.Header.SetRequestURI(path)
+	req.Header.SetHostBytes(parent.ctx.Request.Header.Host())
+
+	for k, v := range header {
+		req.Header.SetBytesV(k, v)
+	}
+
+	req.URI().SetSchemeBytes(strm.scheme)
+
+	pp := AcquireFrame(FramePushPromise).(*PushPromise)
+	pp.SetEndHeaders(true)
+
+	fr := AcquireFrameHeader()
+	fr.SetStream(parent.ID())
+	fr.SetBody(pp)
+
+	// the ids of the promised streams must increase in the order the frames are sent.
+	sc.encMu.Lock()
+	strm.SetID(atomic.AddUint32(&sc.lastPushID, 2))
+	sc.openWindow(strm)
+	pp.SetStream(strm.ID())
+	pp.header = appendPushHeaders(pp.header[:0], &sc.enc, req, strm.scheme)
+	sc.writeHeaders(fr)
+	sc.encMu.Unlock()
+
+	sc.logf(LogLevelDebug, "Stream %d promised on stream %d\n", strm.ID(), parent.ID())
+
+	parent.pushed = append(parent.pushed, strm)
+
+	return nil
+}
+
+// appendPushHeaders appends the header block of the promised request `req` to dst.
+func appendPushHeaders(dst []byte, hp *HPACK, req *fasthttp.Request, scheme []byte) []byte {
+	hf := AcquireHeaderField()
+	defer ReleaseHeaderField(hf)
+
+	hf.SetBytes(StringMethod, req.Header.Method())
+	dst = hp.AppendHeader(dst, hf, true)
+
+	hf.SetBytes(StringScheme, scheme)
+	dst = hp.AppendHeader(dst, hf, true)
+
+	hf.SetBytes(StringAuthority, req.Header.Host())
+	dst = hp.AppendHeader(dst, hf, true)
+
+	hf.SetBytes(StringPath, req.Header.RequestURI())
+	dst = hp.AppendHeader(dst, hf, true)
+
+	req.Header.VisitAll(func(k, v []byte) {
+		if bytes.EqualFold(k, []byte(fasthttp.HeaderHost)) {
+			return
+		}
+
+		// k must not be modified, lowercase the copy instead.
+		hf.SetBytes(k, v)
+		ToLower(hf.key)
+
+		dst = hp.AppendHeader(dst, hf, false)
+	})
+
+	return dst
 }
 
 func (sc *serverConn) handleFrame(strm *Stream, fr *FrameHeader) error {
@@ -639,10 +1538,25 @@ func (sc *serverConn) handleFrame(strm *Stream, fr *FrameHeader) error {
 
 	switch fr.Type() {
 	case FrameHeaders, FrameContinuation:
-		if strm.State() >= StreamStateHalfClosed {
+		if strm.State() >= StreamStateHalfClosed && (fr.Type() == FrameHeaders || strm.headersFinished) {
 			return NewGoAwayError(ProtocolError, "received headers on a finished stream")
 		}
 
+		// RFC(8.1):
+		//
+		// An HTTP request/response exchange consists of: ... optionally, one HEADERS frame,
+		// followed by zero or more CONTINUATION frames containing the trailer-part, if present.
+		// ... A HEADERS frame (and associated CONTINUATION frames) can only appear at the
+		// start or end of a stream.
+		if fr.Type() == FrameHeaders && strm.headersFinished {
+			if !fr.Flags().Has(FlagEndStream) {
+				return NewGoAwayError(ProtocolError, "trailers without END_STREAM")
+			}
+
+			strm.inTrailers = true
+			strm.headersFinished = false
+		}
+
 		err = sc.handleHeaderFrame(strm, fr)
 		if err != nil {
 			return err
@@ -655,6 +1569,37 @@ func (sc *serverConn) handleFrame(strm *Stream, fr *FrameHeader) error {
 				return NewGoAwayError(ProtocolError, "END_HEADERS received on an incomplete stream")
 			}
 
+			if strm.inTrailers {
+				strm.inTrailers = false
+				break
+			}
+
+			if err := checkPseudoHeaders(strm); err != nil {
+				return err
+			}
+
+			if sc.requireAuth && !hasAuthority(strm) {
+				return NewResetStreamError(ProtocolError, "missing :authority")
+			}
+
+			if len(strm.cookies) > 0 {
+				strm.ctx.Request.Header.SetBytesKV(StringCookie, strm.cookies)
+			}
+
+			sc.presizeBody(strm)
+
+			// RFC(7230, section 5.4):
+			//
+			// When a proxy receives a request with an absolute-form of request-target,
+			// the proxy MUST ignore the received Host header field (if any) and instead
+			// replace it with the host information of the request-target.
+			if scheme, host, ok := splitAbsoluteForm(strm.ctx.Request.Header.RequestURI()); ok {
+				strm.scheme = append(strm.scheme[:0], scheme...)
+				if len(host) > 0 {
+					strm.ctx.Request.Header.SetHostBytes(host)
+				}
+			}
+
 			// calling req.URI() triggers a URL parsing, so because of that we need to delay the URL parsing.
 			strm.ctx.Request.URI().SetSchemeBytes(strm.scheme)
 		}
@@ -667,8 +1612,19 @@ func (sc *serverConn) handleFrame(strm *Stream, fr *FrameHeader) error {
 			return NewGoAwayError(StreamClosedError, "stream closed")
 		}
 
-		strm.ctx.Request.AppendBody(
-			fr.Body().(*Data).Data())
+		// RFC(6.9.1):
+		//
+		// A receiver MAY respond with a stream error or connection error of type
+		// FLOW_CONTROL_ERROR if it is unable to accept a frame.
+		if n := int32(fr.Len()); n > sc.currentWindow || n > strm.recvWindow {
+			return NewGoAwayError(FlowControlError, "window exceeded")
+		}
+
+		b := fr.Body().(*Data).Data()
+		strm.ctx.Request.AppendBody(b)
+		atomic.AddInt64(&strm.bytesReceived, int64(len(b)))
+
+		sc.consumeData(strm, fr)
 	case FrameResetStream:
 		if strm.State() == StreamStateIdle {
 			return NewGoAwayError(ProtocolError, "RST_STREAM on idle stream")
@@ -691,7 +1647,13 @@ func (sc *serverConn) handleFrame(strm *Stream, fr *FrameHeader) error {
 			return NewGoAwayError(ProtocolError, "window increment of 0")
 		}
 
-		if atomic.AddInt64(&strm.window, win) >= 1<<31-1 {
+		sc.flowMu.Lock()
+		strm.window += win
+		overflow := strm.window >= 1<<31-1
+		sc.flowCond.Broadcast()
+		sc.flowMu.Unlock()
+
+		if overflow {
 			return NewResetStreamError(FlowControlError, "window is above limits")
 		}
 	default:
@@ -701,21 +1663,64 @@ func (sc *serverConn) handleFrame(strm *Stream, fr *FrameHeader) error {
 	return err
 }
 
-func (sc *serverConn) handleHeaderFrame(strm *Stream, fr *FrameHeader) error {
-	if strm.headersFinished && !fr.Flags().Has(FlagEndStream|FlagEndHeaders) {
-		// TODO handle trailers
-		return NewGoAwayError(ProtocolError, "stream not open")
+// presizeBody allocates the request body using the content-length,
+// so the DATA frames don't reallocate the body as it grows.
+//
+// The size allocated in advance is limited by the server's MaxRequestBodySize.
+func (sc *serverConn) presizeBody(strm *Stream) {
+	req := &strm.ctx.Request
+
+	n := req.Header.ContentLength()
+	if n <= 0 {
+		return
 	}
 
+	if n > sc.maxRequestBodySize {
+		n = sc.maxRequestBodySize
+	}
+
+	if cap(req.Body()) < n {
+		req.SwapBody(make([]byte, 0, n))
+	}
+}
+
+func (sc *serverConn) handleHeaderFrame(strm *Stream, fr *FrameHeader) error {
 	if headerFrame, ok := fr.Body().(*Headers); ok && headerFrame.Stream() == strm.ID() {
 		return NewGoAwayError(ProtocolError, "stream that depends on itself")
 	}
 
+	// the trailers are a new header block.
+	if fr.Type() == FrameHeaders {
+		strm.headerListSize = 0
+		strm.headerBlockSize = 0
+		strm.continuations = 0
+	} else {
+		strm.continuations++
+	}
+
+	// the fields split across CONTINUATION frames are buffered until they're complete,
+	// and the frames not adding fields (like the empty ones) still need to be processed.
+	strm.headerBlockSize += fr.Len()
+	if sc.maxHeaderBlockSize > 0 {
+		if strm.headerBlockSize > sc.maxHeaderBlockSize {
+			return NewGoAwayError(EnhanceYourCalm, "header block too large")
+		}
+
+		if strm.continuations > sc.maxContinuations {
+			return NewGoAwayError(EnhanceYourCalm, "too many CONTINUATION frames")
+		}
+	}
+
 	b := append(strm.previousHeaderBytes, fr.Body().(FrameWithHeaders).Headers()...)
 	hf := AcquireHeaderField()
+	defer ReleaseHeaderField(hf)
+
 	req := &strm.ctx.Request
 
 	var err error
+	// strmErr is returned once the whole block has been decoded,
+	// otherwise the HPACK state would be out of sync with the peer.
+	var strmErr error
 
 	strm.previousHeaderBytes = strm.previousHeaderBytes[:0]
 	fieldsProcessed := 0
@@ -736,20 +1741,120 @@ func (sc *serverConn) handleHeaderFrame(strm *Stream, fr *FrameHeader) error {
 		}
 
 		k, v := hf.KeyBytes(), hf.ValueBytes()
+
+		// RFC(6.5.2):
+		//
+		// The value is based on the uncompressed size of header fields,
+		// including the length of the name and value in octets plus an
+		// overhead of 32 octets for each header field.
+		strm.headerListSize += len(k) + len(v) + 32
+		if sc.maxHeaderListSize > 0 && strm.headerListSize > sc.maxHeaderListSize {
+			return NewGoAwayError(EnhanceYourCalm, "header list too large")
+		}
+
+		if strm.inTrailers {
+			// RFC(8.1.2.1):
+			//
+			// Pseudo-header fields MUST NOT appear in trailers.
+			if hf.IsPseudo() {
+				if strmErr == nil {
+					strmErr = NewResetStreamError(ProtocolError, "pseudo-header in trailers")
+				}
+			} else if req.Header.AddTrailerBytes(k) == nil {
+				// the fields not allowed in a trailer (like content-length) are ignored.
+				req.Header.AddBytesKV(k, v)
+			}
+
+			fieldsProcessed++
+			continue
+		}
+
 		if !hf.IsPseudo() &&
 			!bytes.Equal(k, StringUserAgent) &&
 			!bytes.Equal(k, StringContentType) {
 
+			// RFC(8.1.2.2):
+			//
+			// The only exception to this is the TE header field, which MAY be
+			// present in an HTTP/2 request; when it is, it MUST NOT contain any
+			// value other than "trailers".
+			if bytes.Equal(k, StringTE) {
+				if bytes.Equal(v, StringTrailers) {
+					strm.acceptTrailers = true
+				} else if strmErr == nil {
+					strmErr = NewResetStreamError(ProtocolError, "te header with a value other than trailers")
+				}
+			}
+
+			// RFC(8.1.2.5):
+			//
+			// If there are multiple Cookie header fields after decompression, these
+			// MUST be concatenated into a single octet string using the two-octet
+			// delimiter of 0x3B, 0x20 (the ASCII string "; ").
+			if bytes.Equal(k, StringCookie) {
+				if len(strm.cookies) > 0 {
+					strm.cookies = append(strm.cookies, "; "...)
+				}
+
+				strm.cookies = append(strm.cookies, v...)
+				continue
+			}
+
 			req.Header.AddBytesKV(k, v)
 			continue
 		}
 
 		if hf.IsPseudo() {
 			k = k[1:]
+
+			// RFC(8441, section 4):
+			//
+			// A new pseudo-header field :protocol MAY be included on request HEADERS
+			// indicating the desired protocol to be spoken on the tunnel created by CONNECT.
+			if bytes.Equal(k, StringProtocol[1:]) {
+				if strmErr == nil {
+					if !sc.connectProto {
+						strmErr = NewResetStreamError(ProtocolError, ":protocol without SETTINGS_ENABLE_CONNECT_PROTOCOL")
+					} else if strm.pseudoHeaders&pseudoHeaderProtocol != 0 {
+						strmErr = NewResetStreamError(ProtocolError, "duplicated pseudo-header")
+					}
+				}
+
+				strm.pseudoHeaders |= pseudoHeaderProtocol
+				strm.protocol = append(strm.protocol[:0], v...)
+
+				fieldsProcessed++
+				continue
+			}
+
+			// RFC(8.1.2.3):
+			//
+			// All HTTP/2 requests MUST include exactly one valid value for the
+			// ":method", ":scheme", and ":path" pseudo-header fields, unless it is
+			// a CONNECT request.
+			if bit := pseudoHeaderBit(k); bit != 0 && strmErr == nil {
+				if strm.pseudoHeaders&bit != 0 {
+					strmErr = NewResetStreamError(ProtocolError, "duplicated pseudo-header")
+				} else if bit == pseudoHeaderPath && len(v) == 0 {
+					strmErr = NewResetStreamError(ProtocolError, "empty :path")
+				} else if bit == pseudoHeaderPath && !isValidPath(v) {
+					strmErr = NewResetStreamError(ProtocolError, "invalid :path")
+				}
+
+				strm.pseudoHeaders |= bit
+			}
 		}
 
 		switch k[0] {
 		case 'm': // method
+			if strmErr == nil {
+				if !isToken(v) {
+					strmErr = NewResetStreamError(ProtocolError, "invalid method")
+				} else {
+					strm.methodErr = sc.checkMethod(v)
+				}
+			}
+
 			req.Header.SetMethodBytes(v)
 		case 'p': // path
 			req.Header.SetRequestURIBytes(v)
@@ -775,9 +1880,140 @@ func (sc *serverConn) handleHeaderFrame(strm *Stream, fr *FrameHeader) error {
 
 	strm.headerBlockNum++
 
+	if err == nil && sc.maxEvictions > 0 && sc.dec.Evictions()-sc.blockEvictions > sc.maxEvictions {
+		err = NewGoAwayError(EnhanceYourCalm, "too many dynamic table evictions")
+	}
+
+	if fr.Flags().Has(FlagEndHeaders) {
+		sc.blockEvictions = sc.dec.Evictions()
+	}
+
+	if err == nil {
+		err = strmErr
+	}
+
 	return err
 }
 
+const (
+	pseudoHeaderMethod uint8 = 1 << iota
+	pseudoHeaderPath
+	pseudoHeaderScheme
+	pseudoHeaderAuthority
+	pseudoHeaderProtocol
+)
+
+// pseudoHeaderBit returns the bit identifying the pseudo-header `k` (without the colon),
+// or 0 if `k` is not a request pseudo-header.
+func pseudoHeaderBit(k []byte) uint8 {
+	switch string(k) {
+	case "method":
+		return pseudoHeaderMethod
+	case "path":
+		return pseudoHeaderPath
+	case "scheme":
+		return pseudoHeaderScheme
+	case "authority":
+		return pseudoHeaderAuthority
+	}
+
+	return 0
+}
+
+// checkPseudoHeaders returns an error if the request is missing any required pseudo-header.
+func checkPseudoHeaders(strm *Stream) error {
+	required := pseudoHeaderMethod | pseudoHeaderPath | pseudoHeaderScheme
+
+	isConnect := strm.pseudoHeaders&pseudoHeaderMethod != 0 && strm.ctx.Request.Header.IsConnect()
+
+	// RFC(8441, section 4):
+	//
+	// On requests bearing the :protocol pseudo-header field, the :scheme and :path
+	// pseudo-header fields MUST be included.
+	if strm.pseudoHeaders&pseudoHeaderProtocol != 0 {
+		if !isConnect {
+			return NewResetStreamError(ProtocolError, ":protocol on a request other than CONNECT")
+		}
+
+		required |= pseudoHeaderAuthority
+	} else if isConnect {
+		// RFC(8.3):
+		//
+		// The ":scheme" and ":path" pseudo-header fields MUST be omitted (for CONNECT requests).
+		if strm.pseudoHeaders&(pseudoHeaderPath|pseudoHeaderScheme) != 0 {
+			return NewResetStreamError(ProtocolError, "CONNECT with :scheme or :path")
+		}
+
+		required = pseudoHeaderMethod | pseudoHeaderAuthority
+	}
+
+	if strm.pseudoHeaders&required != required {
+		return NewResetStreamError(ProtocolError, "missing required pseudo-headers")
+	}
+
+	return nil
+}
+
+// hasAuthority reports whether the request has a non-empty :authority,
+// or a :path in absolute-form which already includes the host.
+func hasAuthority(strm *Stream) bool {
+	if strm.pseudoHeaders&pseudoHeaderAuthority != 0 && len(strm.ctx.Request.Header.Host()) > 0 {
+		return true
+	}
+
+	return isAbsoluteForm(strm.ctx.Request.Header.RequestURI())
+}
+
+// writeMethodNotAllowed answers the request of `strm` with 405 Method Not Allowed,
+// listing the methods accepted in the Allow header.
+func (sc *serverConn) writeMethodNotAllowed(strm *Stream) {
+	ctx := strm.ctx
+	ctx.Request.Header.SetProtocolBytes(StringHTTP2)
+
+	ctx.Error(strm.methodErr.Error(), fasthttp.StatusMethodNotAllowed)
+	ctx.Response.Header.Set("Allow", sc.allowHeader())
+
+	sc.writeResponse(strm)
+}
+
+// errMethodNotAllowed is the reason of the requests refused because of ServerConfig.AllowedMethods.
+var errMethodNotAllowed = errors.New("method not allowed")
+
+// checkMethod returns why the request `method` is not accepted by the server, or nil if it is.
+//
+// The servers with fasthttp.Server.GetOnly set refuse the requests other than GET with fasthttp.ErrGetOnly.
+func (sc *serverConn) checkMethod(method []byte) error {
+	if sc.getOnly && string(method) != fasthttp.MethodGet {
+		return fasthttp.ErrGetOnly
+	}
+
+	if len(sc.allowedMethods) == 0 {
+		return nil
+	}
+
+	for _, m := range sc.allowedMethods {
+		if m == string(method) {
+			return nil
+		}
+	}
+
+	return errMethodNotAllowed
+}
+
+// allowHeader returns the value of the Allow header sent with 405 Method Not Allowed.
+func (sc *serverConn) allowHeader() string {
+	if !sc.getOnly {
+		return strings.Join(sc.allowedMethods, ", ")
+	}
+
+	// an empty Allow header means that no method is accepted.
+	if sc.checkMethod([]byte(fasthttp.MethodGet)) != nil {
+		return ""
+	}
+
+	return fasthttp.MethodGet
+}
+
 func (sc *serverConn) verifyState(strm *Stream, fr *FrameHeader) error {
 	switch strm.State() {
 	case StreamStateIdle:
@@ -785,6 +2021,11 @@ func (sc *serverConn) verifyState(strm *Stream, fr *FrameHeader) error {
 			return NewGoAwayError(ProtocolError, "wrong frame on idle stream")
 		}
 	case StreamStateHalfClosed:
+		// a HEADERS with END_STREAM can still be followed by its CONTINUATION frames.
+		if fr.Type() == FrameContinuation && !strm.headersFinished {
+			break
+		}
+
 		if fr.Type() != FrameWindowUpdate && fr.Type() != FramePriority && fr.Type() != FrameResetStream {
 			return NewGoAwayError(StreamClosedError, "wrong frame on half-closed stream")
 		}
@@ -794,6 +2035,29 @@ func (sc *serverConn) verifyState(strm *Stream, fr *FrameHeader) error {
 	return nil
 }
 
+// dispatch runs the handler of `strm` in a different goroutine.
+//
+// The number of handlers running at the same time is limited by sc.workers.
+// Once the handler finishes, the stream is sent back to handleStreams through sc.handled.
+func (sc *serverConn) dispatch(strm *Stream) {
+	strm.handling = true
+
+	sc.handlers.Add(1)
+
+	go func() {
+		defer sc.handlers.Done()
+
+		sc.workers <- struct{}{}
+		sc.handleEndRequest(strm)
+		<-sc.workers
+
+		select {
+		case sc.handled <- strm:
+		case <-sc.streamsDone:
+		}
+	}()
+}
+
 // handleEndRequest dispatches the finished request to the handler.
 func (sc *serverConn) handleEndRequest(strm *Stream) {
 	ctx := strm.ctx
@@ -801,39 +2065,98 @@ func (sc *serverConn) handleEndRequest(strm *Stream) {
 
 	sc.h(ctx)
 
-	hasBody := ctx.Response.IsBodyStream() || len(ctx.Response.Body()) > 0
+	// the client might have reset the stream while the handler was running.
+	if strm.closed() {
+		sc.logf(LogLevelDebug, "Stream %d closed before the response was sent\n", strm.ID())
+		return
+	}
+
+	sc.writeResponse(strm)
+}
+
+// writeResponse sends the response of the stream's RequestCtx.
+func (sc *serverConn) writeResponse(strm *Stream) {
+	ctx := strm.ctx
+
+	if ctx.IsHead() {
+		ctx.Response.SkipBody = true
+	}
+
+	// Body() must not be called on streamed bodies, as it reads the whole stream.
+	// A streamed body with a known length of 0 ends with the headers.
+	var hasBody bool
+	if skipsBody(&ctx.Response) {
+		hasBody = false
+	} else if ctx.Response.IsBodyStream() {
+		hasBody = ctx.Response.Header.ContentLength() != 0
+	} else {
+		hasBody = len(ctx.Response.Body()) > 0
+	}
+
+	// the trailers declared with ResponseHeader.SetTrailer are sent after the body,
+	// in a HEADERS frame ending the stream, if the client sent `te: trailers`.
+	hasTrailers := !skipsBody(&ctx.Response) && len(ctx.Response.Header.PeekTrailerKeys()) > 0 &&
+		strm.AcceptTrailers()
 
 	fr := AcquireFrameHeader()
 	fr.SetStream(strm.ID())
 
 	h := AcquireFrame(FrameHeaders).(*Headers)
 	h.SetEndHeaders(true)
-	h.SetEndStream(!hasBody)
+	h.SetEndStream(!hasBody && !hasTrailers)
 
 	fr.SetBody(h)
 
-	fasthttpResponseHeaders(h, &sc.enc, &ctx.Response)
-
-	sc.writer <- fr
+	// the HPACK state depends on the order in which the headers are sent,
+	// so the encoding and the sending must happen atomically.
+	sc.encMu.Lock()
+	fasthttpResponseHeaders(h, &sc.enc, &ctx.Response, sc.indexedHeaders)
+	sc.writeHeaders(fr)
+	sc.encMu.Unlock()
 
 	if hasBody {
 		if ctx.Response.IsBodyStream() {
 			streamWriter := acquireStreamWrite()
 			streamWriter.strm = strm
-			streamWriter.writer = sc.writer
+			streamWriter.sc = sc
 			streamWriter.size = int64(ctx.Response.Header.ContentLength())
+			streamWriter.trailers = hasTrailers
+			streamWriter.coalesce = sc.coalesce
 			_ = ctx.Response.BodyWriteTo(streamWriter)
 			releaseStreamWrite(streamWriter)
 		} else {
-			sc.writeData(strm, ctx.Response.Body())
+			_ = sc.writeData(strm, ctx.Response.Body(), !hasTrailers)
 		}
 	}
+
+	if hasTrailers && !strm.closed() {
+		sc.writeTrailers(strm, &ctx.Response)
+	}
+}
+
+// writeTrailers sends the trailers of `res` ending the stream.
+func (sc *serverConn) writeTrailers(strm *Stream, res *fasthttp.Response) {
+	fr := AcquireFrameHeader()
+	fr.SetStream(strm.ID())
+
+	h := AcquireFrame(FrameHeaders).(*Headers)
+	h.SetEndHeaders(true)
+	h.SetEndStream(true)
+
+	fr.SetBody(h)
+
+	sc.encMu.Lock()
+	fasthttpResponseTrailers(h, &sc.enc, res)
+	sc.writeHeaders(fr)
+	sc.encMu.Unlock()
 }
 
 var (
 	copyBufPool = sync.Pool{
 		New: func() interface{} {
-			return make([]byte, 1<<14) // max frame size 16384
+			// the frames read from an io.Reader are never larger than the minimum
+			// SETTINGS_MAX_FRAME_SIZE (16384), so they fit any client's limit.
+			return make([]byte, 1<<14)
 		},
 	}
 	streamWritePool = sync.Pool{
@@ -847,7 +2170,12 @@ type streamWrite struct {
 	size    int64
 	written int64
 	strm    *Stream
-	writer  chan<- *FrameHeader
+	sc      *serverConn
+	// trailers is set when the stream is ended by the trailers instead of the last DATA frame.
+	trailers bool
+	// coalesce buffers the small writes in buf until a frame is filled, see ServerConfig.CoalesceDataFrames.
+	coalesce bool
+	buf      []byte
 }
 
 func acquireStreamWrite() *streamWrite {
@@ -867,7 +2195,10 @@ func (s *streamWrite) Reset() {
 	s.size = 0
 	s.written = 0
 	s.strm = nil
-	s.writer = nil
+	s.sc = nil
+	s.trailers = false
+	s.coalesce = false
+	s.buf = s.buf[:0]
 }
 
 func (s *streamWrite) Write(body []byte) (n int, err error) {
@@ -875,31 +2206,65 @@ func (s *streamWrite) Write(body []byte) (n int, err error) {
 		return 0, errors.New("writer closed")
 	}
 
-	step := 1 << 14 // max frame size 16384
+	if s.strm.closed() {
+		return 0, ErrStreamClosed
+	}
 
-	n = len(body)
-	s.written += int64(n)
+	s.written += int64(len(body))
 
-	end := s.size < 0 || s.written >= s.size
-	for i := 0; i < n; i += step {
-		if i+step >= n {
-			step = n - i
+	if err = s.write(body, s.size < 0 || s.written >= s.size, false); err != nil {
+		return 0, err
+	}
+
+	return len(body), nil
+}
+
+// write sends `b` on the stream. `last` is set when no data follows `b`,
+// so the stream is ended, unless the trailers end it.
+//
+// If the DATA frames are coalesced, `b` is buffered until a frame is filled, the body ends
+// or `flush` is set.
+func (s *streamWrite) write(b []byte, last, flush bool) error {
+	endStream := last && !s.trailers
+
+	if s.coalesce {
+		s.buf = append(s.buf, b...)
+
+		b = s.buf
+		if !last && !flush {
+			max := int(atomic.LoadUint32(&s.sc.maxFrameSize))
+			b = b[:len(b)-len(b)%max]
 		}
+	}
 
-		fr := AcquireFrameHeader()
-		fr.SetStream(s.strm.ID())
+	if len(b) == 0 {
+		if endStream {
+			s.writeEndStream()
+		}
 
-		data := AcquireFrame(FrameData).(*Data)
-		data.SetEndStream(end && i+step == n)
-		data.SetPadding(false)
-		data.SetData(body[i : step+i])
+		return nil
+	}
 
-		fr.SetBody(data)
+	sent := s.sc.writeData(s.strm, b, endStream)
+	if s.coalesce {
+		s.buf = append(s.buf[:0], s.buf[sent:]...)
+	}
 
-		s.writer <- fr
+	if sent < len(b) {
+		return ErrStreamClosed
 	}
 
-	return len(body), nil
+	return nil
+}
+
+// coalesceIdleTime is how long the coalesced data waits for the handler to write more,
+// before being sent. See ServerConfig.CoalesceDataFrames.
+const coalesceIdleTime = time.Millisecond
+
+// readDeadliner is implemented by the body streams which reads can time out,
+// like the ones of fasthttp.RequestCtx.SetBodyStreamWriter.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
 }
 
 func (s *streamWrite) ReadFrom(r io.Reader) (num int64, err error) {
@@ -912,10 +2277,41 @@ func (s *streamWrite) ReadFrom(r io.Reader) (num int64, err error) {
 		}
 	}
 
+	// the coalesced data is flushed once the handler stops writing (like after flushing the
+	// stream writer): when no data is read for coalesceIdleTime, or if the reads can't time out,
+	// when the read returns less data than requested.
+	dr, _ := r.(readDeadliner)
+	if !s.coalesce {
+		dr = nil
+	}
+
+	waiting := false
+
 	var n int
 	for {
+		if dr != nil && (waiting || len(s.buf) > 0) {
+			waiting = len(s.buf) > 0
+
+			var deadline time.Time
+			if waiting {
+				deadline = time.Now().Add(coalesceIdleTime)
+			}
+
+			_ = dr.SetReadDeadline(deadline)
+		}
+
 		n, err = r.Read(buf[0:])
-		if n <= 0 && err == nil {
+
+		// the errors of fasthttputil's pipes only implement the Timeout method of net.Error.
+		idle := false
+		if err != nil && waiting {
+			var terr interface{ Timeout() bool }
+			if errors.As(err, &terr) && terr.Timeout() {
+				idle, err = true, nil
+			}
+		}
+
+		if n <= 0 && err == nil && !idle {
 			err = errors.New("BUG: io.Reader returned 0, nil")
 		}
 
@@ -923,65 +2319,198 @@ func (s *streamWrite) ReadFrom(r io.Reader) (num int64, err error) {
 			break
 		}
 
-		fr := AcquireFrameHeader()
-		fr.SetStream(s.strm.ID())
+		if s.strm.closed() {
+			err = ErrStreamClosed
+			break
+		}
 
-		data := AcquireFrame(FrameData).(*Data)
-		data.SetEndStream(err != nil || (s.size >= 0 && num+int64(n) >= s.size))
-		data.SetPadding(false)
-		data.SetData(buf[:n])
-		fr.SetBody(data)
+		last := s.size >= 0 && num+int64(n) >= s.size
+		flush := idle || (s.coalesce && dr == nil && n < len(buf))
 
-		s.writer <- fr
+		if err = s.write(buf[:n], last, flush); err != nil {
+			break
+		}
 
 		num += int64(n)
-		if s.size >= 0 && num >= s.size {
+		if last {
 			break
 		}
 	}
 
+	if waiting {
+		_ = dr.SetReadDeadline(time.Time{})
+	}
+
 	copyBufPool.Put(buf)
 	if errors.Is(err, io.EOF) {
+		// the stream must be ended with the data left or with an empty DATA frame,
+		// even if the body is shorter than its Content-Length.
+		_ = s.write(nil, true, true)
+
 		return num, nil
 	}
 
 	return num, err
 }
 
-func (sc *serverConn) writeData(strm *Stream, body []byte) {
-	step := 1 << 14 // max frame size 16384
-	if strm.window > 0 && step > int(strm.window) {
-		step = int(strm.window)
-	}
+func (s *streamWrite) writeEndStream() {
+	fr := AcquireFrameHeader()
+	fr.SetStream(s.strm.ID())
+
+	data := AcquireFrame(FrameData).(*Data)
+	data.SetEndStream(true)
+	data.SetPadding(false)
+
+	fr.SetBody(data)
 
-	for i := 0; i < len(body); i += step {
-		if i+step >= len(body) {
-			step = len(body) - i
+	s.sc.writer <- fr
+}
+
+// writeData sends `body` in DATA frames, setting END_STREAM on the last one if `endStream` is true.
+//
+// The frames are sent as the client's windows allow it, waiting for its WINDOW_UPDATE frames
+// when they are exhausted. writeData returns the number of bytes sent, which is less than
+// len(body) if the stream or the connection was closed.
+func (sc *serverConn) writeData(strm *Stream, body []byte, endStream bool) int {
+	sent := 0
+
+	for sent < len(body) {
+		// the client's SETTINGS_MAX_FRAME_SIZE might change while the body is being sent.
+		step := int(atomic.LoadUint32(&sc.maxFrameSize))
+		if step > len(body)-sent {
+			step = len(body) - sent
+		}
+
+		step = sc.reserveWindow(strm, step)
+		if step == 0 {
+			break
 		}
 
 		fr := AcquireFrameHeader()
 		fr.SetStream(strm.ID())
 
 		data := AcquireFrame(FrameData).(*Data)
-		data.SetEndStream(i+step == len(body))
+		data.SetEndStream(endStream && sent+step == len(body))
 		data.SetPadding(false)
-		data.SetData(body[i : step+i])
+		data.SetData(body[sent : sent+step])
 
 		fr.SetBody(data)
 
+		atomic.AddInt64(&strm.bytesSent, int64(step))
+
 		sc.writer <- fr
+
+		sent += step
+	}
+
+	return sent
+}
+
+// writeHeaders sends the HEADERS or PUSH_PROMISE frame `fr`, splitting the header block
+// into CONTINUATION frames if it doesn't fit in the client's SETTINGS_MAX_FRAME_SIZE.
+func (sc *serverConn) writeHeaders(fr *FrameHeader) {
+	max := int(atomic.LoadUint32(&sc.maxFrameSize))
+
+	var block *[]byte
+
+	h := fr.Body().(interface {
+		EndHeaders() bool
+		SetEndHeaders(bool)
+	})
+
+	switch body := fr.Body().(type) {
+	case *Headers:
+		block = &body.rawHeaders
+	case *PushPromise:
+		block = &body.header
+		// the payload starts with the promised stream id.
+		max -= 4
+	}
+
+	if len(*block) <= max {
+		sc.writer <- fr
+		return
+	}
+
+	var frames []*FrameHeader
+
+	// the continuations copy the rest of the block before fr gets written and released.
+	for b := (*block)[max:]; len(b) > 0; {
+		n := max
+		if n > len(b) {
+			n = len(b)
+		}
+
+		cfr := AcquireFrameHeader()
+		cfr.SetStream(fr.Stream())
+
+		c := AcquireFrame(FrameContinuation).(*Continuation)
+		c.SetHeader(b[:n])
+		c.SetEndHeaders(h.EndHeaders() && n == len(b))
+
+		cfr.SetBody(c)
+
+		frames = append(frames, cfr)
+		b = b[n:]
+	}
+
+	*block = (*block)[:max]
+	h.SetEndHeaders(false)
+
+	sc.writer <- fr
+
+	for _, cfr := range frames {
+		sc.writer <- cfr
 	}
 }
 
 func (sc *serverConn) sendPingAndSchedule() {
 	sc.writePing()
 
-	sc.pingTimer.Reset(sc.pingInterval)
+	// the pings might have been disabled by setPingInterval while sending this one.
+	if d := time.Duration(atomic.LoadInt64(&sc.pingInterval)); d > 0 {
+		sc.pingTimer.Reset(d)
+	}
+}
+
+// setPingInterval changes the ping interval, sending the next ping `d` after now.
+// An interval <= 0 stops the pings.
+func (sc *serverConn) setPingInterval(d time.Duration) bool {
+	// the timer is only created if the pings were enabled when the connection started.
+	if sc.pingTimer == nil {
+		return false
+	}
+
+	atomic.StoreInt64(&sc.pingInterval, int64(d))
+
+	if d > 0 {
+		sc.pingTimer.Reset(d)
+	} else {
+		sc.pingTimer.Stop()
+	}
+
+	return true
+}
+
+// SetPingInterval changes the interval at which the server pings the client
+// of the HTTP/2 connection serving `ctx`, overriding ServerConfig.PingInterval.
+// The next ping is sent `d` after SetPingInterval is called, and an interval <= 0 stops the pings.
+//
+// SetPingInterval returns false if the request wasn't received over HTTP/2, or
+// if the pings were disabled by ServerConfig.PingInterval when the connection was served.
+func SetPingInterval(ctx *fasthttp.RequestCtx, d time.Duration) bool {
+	strm := StreamFromCtx(ctx)
+	if strm == nil || strm.sc == nil {
+		return false
+	}
+
+	return strm.sc.setPingInterval(d)
 }
 
 func (sc *serverConn) writeLoop() {
-	if sc.pingInterval > 0 {
-		sc.pingTimer = time.AfterFunc(sc.pingInterval, sc.sendPingAndSchedule)
+	if sc.schedule != nil {
+		sc.scheduledWriteLoop()
+		return
 	}
 
 	buffered := 0
@@ -998,19 +2527,112 @@ func (sc *serverConn) writeLoop() {
 		ReleaseFrameHeader(fr)
 
 		if err != nil {
-			sc.logger.Printf("ERROR: writeLoop: %s\n", err)
-			// TODO: sc.writer.err <- err
+			sc.writeFailed(err)
+			return
+		}
+	}
+}
+
+// writeFailed closes the connection after a write error, so the readLoop stops
+// and Serve returns `err`.
+//
+// The frames queued until the writer is closed are discarded, so the handlers
+// sending their responses don't block.
+func (sc *serverConn) writeFailed(err error) {
+	sc.logf(LogLevelError, "ERROR: writeLoop: %s\n", err)
+
+	sc.writeErr <- err
+
+	_ = sc.c.Close()
+
+	for fr := range sc.writer {
+		ReleaseFrameHeader(fr)
+	}
+}
+
+// scheduledWriteLoop writes the frames in the order chosen by sc.schedule.
+func (sc *serverConn) scheduledWriteLoop() {
+	var pending []*FrameHeader
+
+	for {
+		i := -1
+		if len(pending) > 0 {
+			i = sc.schedule(pending)
+		}
+
+		if i < 0 {
+			fr, ok := <-sc.writer
+			if ok {
+				pending = append(pending, fr)
+				continue
+			}
+
+			// the writer is closed, so the rest of the frames are written in order.
+			if len(pending) == 0 {
+				return
+			}
+
+			i = 0
+		}
+
+		fr := pending[i]
+		pending = append(pending[:i], pending[i+1:]...)
+
+		_, err := fr.WriteTo(sc.bw)
+		if err == nil {
+			err = sc.bw.Flush()
+		}
+
+		ReleaseFrameHeader(fr)
+
+		if err != nil {
+			for _, fr := range pending {
+				ReleaseFrameHeader(fr)
+			}
+
+			sc.writeFailed(err)
+
 			return
 		}
 	}
 }
 
 func (sc *serverConn) handleSettings(st *Settings) {
-	st.CopyTo(&sc.clientS)
+	sc.logf(LogLevelDebug, "%s: received %s\n", sc.c.RemoteAddr(), st)
+
+	// the frames only include the parameters that changed, and they are applied in the order received.
+	st.applyTo(&sc.clientS)
+
+	// the handlers might be encoding headers concurrently.
+	sc.encMu.Lock()
 	sc.enc.SetMaxTableSize(sc.clientS.HeaderTableSize())
+	sc.encMu.Unlock()
+
+	// RFC(6.9.2):
+	//
+	// When the value of SETTINGS_INITIAL_WINDOW_SIZE changes, a receiver MUST
+	// adjust the size of all stream flow-control windows that it maintains by
+	// the difference between the new value and the old value.
+	sc.flowMu.Lock()
+	delta := int64(sc.clientS.MaxWindowSize()) - sc.clientWindow
+	sc.clientWindow += delta
+
+	overflow := false
+	for _, strm := range sc.sendStrms {
+		strm.window += delta
+		overflow = overflow || strm.window >= 1<<31-1
+	}
+
+	sc.flowCond.Broadcast()
+	sc.flowMu.Unlock()
 
-	// atomically update the new window
-	atomic.StoreInt64(&sc.clientWindow, int64(sc.clientS.MaxWindowSize()))
+	if overflow {
+		sc.writeGoAway(0, FlowControlError, "window is above limits")
+	}
+
+	atomic.StoreUint32(&sc.maxFrameSize, sc.clientS.MaxFrameSize())
+
+	sc.storePushSettings()
 
 	fr := AcquireFrameHeader()
 
@@ -1022,20 +2644,37 @@ func (sc *serverConn) handleSettings(st *Settings) {
 	sc.writer <- fr
 }
 
-func fasthttpResponseHeaders(dst *Headers, hp *HPACK, res *fasthttp.Response) {
+// storePushSettings stores the client's settings used by the handlers to push.
+func (sc *serverConn) storePushSettings() {
+	push := int32(0)
+	if sc.clientS.Push() {
+		push = 1
+	}
+
+	atomic.StoreInt32(&sc.pushEnabled, push)
+	atomic.StoreUint32(&sc.clientMaxStreams, sc.clientS.MaxConcurrentStreams())
+}
+
+// fasthttpResponseHeaders appends the headers of `res` to `dst`. The fields named
+// in `indexed` are added to the dynamic table of `hp`, see ServerConfig.IndexedResponseHeaders.
+func fasthttpResponseHeaders(dst *Headers, hp *HPACK, res *fasthttp.Response, indexed []string) {
 	hf := AcquireHeaderField()
 	defer ReleaseHeaderField(hf)
 
 	hf.SetKeyBytes(StringStatus)
-	hf.SetValue(
-		strconv.FormatInt(
-			int64(res.Header.StatusCode()), 10,
-		),
+	hf.value = strconv.AppendInt(
+		hf.value[:0], int64(res.Header.StatusCode()), 10,
 	)
 
 	dst.AppendHeaderField(hp, hf, true)
 
-	if !res.IsBodyStream() {
+	// the length of a streamed body is known if it was passed to SetBodyStream,
+	// in which case the content-length is kept. Otherwise the header is not sent.
+	//
+	// The responses without a body (like the ones to HEAD requests) keep the content-length
+	// set by the handler, as it describes the resource instead of the body sent.
+	explicitLength := skipsBody(res) && len(res.Header.Peek(fasthttp.HeaderContentLength)) > 0
+	if !res.IsBodyStream() && !explicitLength {
 		res.Header.SetContentLength(len(res.Body()))
 	}
 	// Remove the Connection field
@@ -1043,12 +2682,65 @@ func fasthttpResponseHeaders(dst *Headers, hp *HPACK, res *fasthttp.Response) {
 	// Remove the Transfer-Encoding field
 	res.Header.Del("Transfer-Encoding")
 
+	trailers := res.Header.PeekTrailerKeys()
+
+	// VisitAll calls f once per cookie, so every set-cookie is sent as a separate field
+	// (RFC 7540 section 8.1.2.5 only allows joining the request cookies).
 	res.Header.VisitAll(func(k, v []byte) {
-		hf.SetBytes(ToLower(k), v)
-		dst.AppendHeaderField(hp, hf, false)
+		// the trailers are sent after the body by fasthttpResponseTrailers.
+		for _, t := range trailers {
+			if bytes.EqualFold(k, t) {
+				return
+			}
+		}
+
+		// k must not be modified, lowercase the copy instead.
+		hf.SetBytes(k, v)
+		ToLower(hf.key)
+
+		dst.AppendHeaderField(hp, hf, isIndexedHeader(hf.key, indexed))
 	})
 }
 
+// isIndexedHeader reports whether `k` is one of the `indexed` field names.
+func isIndexedHeader(k []byte, indexed []string) bool {
+	for _, name := range indexed {
+		if strings.EqualFold(string(k), name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fasthttpResponseTrailers appends the trailers declared in `res` to `dst`.
+//
+// Unlike the headers, the trailers can't contain pseudo-header fields (RFC 7540 section 8.1).
+func fasthttpResponseTrailers(dst *Headers, hp *HPACK, res *fasthttp.Response) {
+	hf := AcquireHeaderField()
+	defer ReleaseHeaderField(hf)
+
+	for _, k := range res.Header.PeekTrailerKeys() {
+		v := res.Header.PeekBytes(k)
+		if len(v) == 0 {
+			continue
+		}
+
+		hf.SetBytes(k, v)
+		ToLower(hf.key)
+
+		dst.AppendHeaderField(hp, hf, false)
+	}
+}
+
+// skipsBody reports whether the body of `res` must not be sent,
+// as for the responses to HEAD requests and the 204 and 304 responses.
+func skipsBody(res *fasthttp.Response) bool {
+	code := res.StatusCode()
+
+	return res.SkipBody || code == fasthttp.StatusNoContent || code == fasthttp.StatusNotModified
+}
+
 func limitedReaderSize(r io.Reader) int64 {
 	lr, ok := r.(*io.LimitedReader)
 	if !ok {
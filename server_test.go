@@ -1,9 +1,18 @@
 package http2
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -122,7 +131,7 @@ func testIssue52(t *testing.T) {
 	c.writeFrame(h4)
 
 	for _, h := range []*FrameHeader{h1, h2} {
-		err = writeData(c.bw, h, msg)
+		err = writeData(c.bw, h.Stream(), msg, true)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -304,3 +313,4728 @@ func TestIdleConnection(t *testing.T) {
 		t.Fatal("Expecting error")
 	}
 }
+
+func TestTETrailers(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				io.WriteString(ctx, "Hello world")
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	h1 := makeHeaders(3, c.enc, true, true, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/hello/world",
+		string(StringScheme):    "https",
+		"te":                    "trailers",
+	})
+	h2 := makeHeaders(5, c.enc, true, true, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/hello/world",
+		string(StringScheme):    "https",
+		"te":                    "gzip",
+	})
+
+	c.writeFrame(h1)
+	c.writeFrame(h2)
+
+	expect := []FrameType{
+		FrameHeaders, FrameData, FrameResetStream,
+	}
+
+	for _, next := range expect {
+		fr, err := c.readNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.Type() != next {
+			t.Fatalf("unexpected frame type: %s <> %s", next, fr.Type())
+		}
+
+		if fr.Type() == FrameResetStream {
+			if fr.Stream() != 5 {
+				t.Fatalf("expected reset on stream 5, got %d", fr.Stream())
+			}
+
+			rst := fr.Body().(*RstStream)
+			if rst.Code() != ProtocolError {
+				t.Fatalf("expected ProtocolError, got %s", rst.Code())
+			}
+		}
+	}
+}
+
+func TestTETrailersDetection(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.Response.Header.SetTrailer("X-Checksum")
+				ctx.Response.Header.Set("X-Checksum", "abc")
+				ctx.WriteString("hello")
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	for i, te := range []bool{true, false} {
+		id := uint32(i*2 + 1)
+
+		request := map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    "GET",
+			string(StringPath):      "/",
+			string(StringScheme):    "https",
+		}
+
+		if te {
+			request["te"] = "trailers"
+		}
+
+		c.writeFrame(makeHeaders(id, c.enc, true, true, request))
+
+		headers := 0
+
+		for end := false; !end; {
+			fr, err := c.readNext()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fr.Stream() == id {
+				if fr.Type() == FrameHeaders {
+					headers++
+
+					// the header blocks must be decoded to keep the HPACK state.
+					hf := AcquireHeaderField()
+					for b := fr.Body().(*Headers).Headers(); len(b) > 0; {
+						if b, err = c.dec.Next(hf, b); err != nil {
+							t.Fatal(err)
+						}
+					}
+					ReleaseHeaderField(hf)
+				}
+
+				end = fr.Flags().Has(FlagEndStream)
+			}
+
+			ReleaseFrameHeader(fr)
+		}
+
+		// the trailers are sent in a second HEADERS frame.
+		if expected := map[bool]int{true: 2, false: 1}[te]; headers != expected {
+			t.Fatalf("te=%v: expected %d HEADERS frames, got %d", te, expected, headers)
+		}
+	}
+}
+
+func TestHandlerWorkers(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				if string(ctx.Path()) == "/slow" {
+					time.Sleep(time.Millisecond * 500)
+				}
+
+				io.WriteString(ctx, "Hello world")
+			},
+		},
+		cnf: ServerConfig{
+			MaxHandlerWorkers: 4,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	h1 := makeHeaders(3, c.enc, true, true, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/slow",
+		string(StringScheme):    "https",
+	})
+	h2 := makeHeaders(5, c.enc, true, true, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/fast",
+		string(StringScheme):    "https",
+	})
+
+	c.writeFrame(h1)
+	c.writeFrame(h2)
+
+	expect := []uint32{5, 5, 3, 3}
+
+	for _, id := range expect {
+		fr, err := c.readNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.Stream() != id {
+			t.Fatalf("expected %s on stream %d, got %d", fr.Type(), id, fr.Stream())
+		}
+	}
+}
+
+func TestHandlerWorkersHeaders(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				id := string(ctx.QueryArgs().Peek("id"))
+
+				// a value per request to make the encoder update the dynamic table
+				ctx.Response.Header.Set("X-Request-Id", id)
+				ctx.Response.Header.Set("X-Common", "common-value")
+
+				io.WriteString(ctx, id)
+			},
+		},
+		cnf: ServerConfig{
+			MaxHandlerWorkers: 16,
+		},
+	}
+
+	c, ln, err := getClientConn(s, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			req := fasthttp.AcquireRequest()
+			res := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseRequest(req)
+			defer fasthttp.ReleaseResponse(res)
+
+			id := strconv.Itoa(i)
+
+			req.Header.SetMethod("GET")
+			req.SetRequestURI("https://localhost/?id=" + id)
+
+			if err := doRequest(c, req, res); err != nil {
+				errs <- err
+				return
+			}
+
+			if v := string(res.Header.Peek("X-Request-Id")); v != id {
+				errs <- fmt.Errorf("unexpected X-Request-Id: %q <> %q", v, id)
+			} else if v := string(res.Header.Peek("X-Common")); v != "common-value" {
+				errs <- fmt.Errorf("unexpected X-Common: %q", v)
+			} else if string(res.Body()) != id {
+				errs <- fmt.Errorf("unexpected body: %q <> %q", res.Body(), id)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestMethodValidation(t *testing.T) {
+	var called int32
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				atomic.AddInt32(&called, 1)
+				io.WriteString(ctx, "Hello world")
+			},
+		},
+		cnf: ServerConfig{
+			AllowedMethods: []string{"GET", "POST"},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	request := func(id uint32, method string, endStream bool) {
+		c.writeFrame(makeHeaders(id, c.enc, true, endStream, map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    method,
+			string(StringPath):      "/hello/world",
+			string(StringScheme):    "https",
+		}))
+	}
+
+	request(3, "", true)
+	expectReset(t, c, 3, ProtocolError)
+
+	// a disallowed method is not retryable, so it can't be refused with REFUSED_STREAM.
+	request(5, "TRACE", true)
+
+	hfs, _ := readResponse(t, c, 5)
+	if hfs[":status"] != "405" || hfs["allow"] != "GET, POST" {
+		t.Fatalf("expected 405 with the allowed methods for a disallowed method, got %v", hfs)
+	}
+
+	request(7, "GET", true)
+
+	if hfs, body := readResponse(t, c, 7); hfs[":status"] != "200" || string(body) != "Hello world" {
+		t.Fatalf("unexpected response for an allowed method: %v %q", hfs, body)
+	}
+
+	// the client doesn't need to send the body once the request is answered.
+	request(9, "DELETE", false)
+
+	if hfs, _ := readResponse(t, c, 9); hfs[":status"] != "405" {
+		t.Fatalf("expected 405 for a disallowed method, got %v", hfs)
+	}
+
+	expectReset(t, c, 9, NoError)
+
+	if n := atomic.LoadInt32(&called); n != 1 {
+		t.Fatalf("expected only the GET request to be handled, got %d", n)
+	}
+}
+
+func TestGetOnly(t *testing.T) {
+	var called int32
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				atomic.AddInt32(&called, 1)
+			},
+			GetOnly: true,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	for i, method := range []string{"POST", "HEAD", "GET"} {
+		id := uint32(i*2 + 1)
+
+		c.writeFrame(makeHeaders(id, c.enc, true, true, map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    method,
+			string(StringPath):      "/",
+			string(StringScheme):    "https",
+		}))
+
+		hfs, body := readResponse(t, c, id)
+
+		if method == "GET" {
+			if hfs[":status"] != "200" {
+				t.Fatalf("expected 200 for GET, got %v", hfs)
+			}
+
+			continue
+		}
+
+		// like fasthttp, the non-GET requests get an error status instead of being retryable.
+		if hfs[":status"] != "405" || hfs["allow"] != "GET" {
+			t.Fatalf("expected 405 for %s, got %v", method, hfs)
+		}
+
+		if method == "POST" && string(body) != fasthttp.ErrGetOnly.Error() {
+			t.Fatalf("unexpected body: %q", body)
+		}
+	}
+
+	if n := atomic.LoadInt32(&called); n != 1 {
+		t.Fatalf("expected only the GET request to be handled, got %d", n)
+	}
+
+	// no method is accepted if AllowedMethods doesn't include GET.
+	sc := &serverConn{getOnly: true, allowedMethods: []string{"POST"}}
+	if err := sc.checkMethod([]byte("GET")); err != errMethodNotAllowed {
+		t.Fatalf("expected GET not to be allowed, got %v", err)
+	}
+
+	if allow := sc.allowHeader(); allow != "" {
+		t.Fatalf("expected an empty Allow header, got %q", allow)
+	}
+}
+
+// BenchmarkResponseHeadersEncode encodes a response with a status and 6 headers.
+//
+// Allocations per response:
+//   - before: 171 B/op, 8 allocs/op (status formatting and huffman buffers).
+//   - after: 0 B/op, 0 allocs/op.
+func BenchmarkResponseHeadersEncode(b *testing.B) {
+	var (
+		res fasthttp.Response
+		enc HPACK
+	)
+
+	enc.Reset()
+
+	res.SetStatusCode(200)
+	res.Header.SetContentType("text/plain; charset=utf-8")
+	res.Header.Set("Cache-Control", "no-cache")
+	res.Header.Set("Server", "fasthttp")
+	res.Header.Set("X-Request-Id", "ab0b3a2c-3bfb-4b82-a8e3-ffd0e1a8e9a6")
+	res.Header.Set("Vary", "Accept-Encoding")
+	res.SetBodyString("Hello world")
+
+	h := AcquireFrame(FrameHeaders).(*Headers)
+	defer ReleaseFrame(h)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		h.rawHeaders = h.rawHeaders[:0]
+		fasthttpResponseHeaders(h, &enc, &res, nil)
+	}
+}
+
+// BenchmarkRequestBodyUpload receives a 10MB body in 16KB DATA frames.
+//
+// Allocations per upload:
+//   - without content-length: 55625155 B/op, 52 allocs/op (the body is reallocated as it grows).
+//   - with content-length: 10495024 B/op, 21 allocs/op.
+func BenchmarkRequestBodyUpload(b *testing.B) {
+	b.Run("NoContentLength", func(b *testing.B) {
+		benchmarkRequestBodyUpload(b, false)
+	})
+
+	b.Run("ContentLength", func(b *testing.B) {
+		benchmarkRequestBodyUpload(b, true)
+	})
+}
+
+func benchmarkRequestBodyUpload(b *testing.B, contentLength bool) {
+	const (
+		size      = 10 << 20
+		frameSize = 1 << 14
+	)
+
+	sc := &serverConn{
+		logger:             logger,
+		maxRequestBodySize: size,
+	}
+
+	var enc HPACK
+
+	enc.Reset()
+	sc.dec.Reset()
+
+	hs := map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "POST",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}
+
+	if contentLength {
+		hs[string(StringContentLength)] = strconv.Itoa(size)
+	}
+
+	chunk := make([]byte, frameSize)
+
+	data := AcquireFrameHeader()
+	data.SetStream(1)
+	data.SetBody(AcquireFrame(FrameData))
+	data.Body().(*Data).SetData(chunk)
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		strm := NewStream(1, 1<<20)
+		sc.createStream(nil, FrameHeaders, strm)
+
+		// the flags are set when the frame is serialized.
+		var bb bytes.Buffer
+
+		bw := bufio.NewWriter(&bb)
+
+		fr := makeHeaders(1, &enc, true, false, hs)
+		fr.WriteTo(bw)
+		bw.Flush()
+		ReleaseFrameHeader(fr)
+
+		fr, err := ReadFrameFrom(bufio.NewReader(&bb))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if err := sc.handleFrame(strm, fr); err != nil {
+			b.Fatal(err)
+		}
+
+		handleState(fr, strm)
+		ReleaseFrameHeader(fr)
+
+		for n := 0; n < size; n += frameSize {
+			if err := sc.handleFrame(strm, data); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		if len(strm.ctx.Request.Body()) != size {
+			b.Fatalf("unexpected body size %d", len(strm.ctx.Request.Body()))
+		}
+
+		// drop the body, so the next upload doesn't reuse the grown buffer.
+		strm.ctx.Request.SwapBody(nil)
+
+		ctxPool.Put(strm.ctx)
+		streamPool.Put(strm)
+	}
+}
+
+func TestStreamedBodyContentLength(t *testing.T) {
+	const body = "hello world"
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				switch string(ctx.Path()) {
+				case "/known":
+					ctx.SetBodyStream(strings.NewReader(body), len(body))
+					return
+				case "/empty":
+					ctx.SetBodyStream(strings.NewReader(""), 0)
+					return
+				}
+
+				ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+					io.WriteString(w, body)
+				})
+			},
+		},
+	}
+
+	c, ln, err := getClientConn(s, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	for path, contentLength := range map[string]string{
+		"/known":   strconv.Itoa(len(body)),
+		"/empty":   "0",
+		"/unknown": "",
+	} {
+		req := fasthttp.AcquireRequest()
+		res := fasthttp.AcquireResponse()
+
+		req.Header.SetMethod("GET")
+		req.SetRequestURI("http://localhost" + path)
+
+		if err := doRequest(c, req, res); err != nil {
+			t.Fatal(err)
+		}
+
+		if v := res.Header.Peek("Content-Length"); string(v) != contentLength {
+			t.Fatalf("%s: expected content-length %q, got %q", path, contentLength, v)
+		}
+
+		if path != "/empty" && string(res.Body()) != body {
+			t.Fatalf("%s: unexpected body %q", path, res.Body())
+		}
+
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(res)
+	}
+}
+
+func TestInterleavedUploadAndDownload(t *testing.T) {
+	const (
+		chunks    = 16
+		chunkSize = 1 << 14
+	)
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				if ctx.IsPost() {
+					io.WriteString(ctx, strconv.Itoa(len(ctx.Request.Body())))
+					return
+				}
+
+				ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+					chunk := make([]byte, chunkSize)
+					for i := 0; i < chunks; i++ {
+						w.Write(chunk)
+						w.Flush()
+
+						// the download lasts longer than the upload
+						time.Sleep(time.Millisecond * 20)
+					}
+				})
+			},
+		},
+		cnf: ServerConfig{
+			MaxHandlerWorkers: 2,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	c.writeFrame(makeHeaders(3, c.enc, true, false, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "POST",
+		string(StringPath):      "/upload",
+		string(StringScheme):    "https",
+	}))
+	c.writeFrame(makeHeaders(5, c.enc, true, true, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/download",
+		string(StringScheme):    "https",
+	}))
+
+	var uploaded int32
+
+	go func() {
+		chunk := make([]byte, chunkSize)
+
+		for i := 0; i < chunks; i++ {
+			fr := AcquireFrameHeader()
+			fr.SetStream(3)
+
+			data := AcquireFrame(FrameData).(*Data)
+			data.SetEndStream(i == chunks-1)
+			data.SetData(chunk)
+
+			fr.SetBody(data)
+
+			c.writeFrame(fr)
+			ReleaseFrameHeader(fr)
+
+			atomic.AddInt32(&uploaded, 1)
+
+			time.Sleep(time.Millisecond * 10)
+		}
+	}()
+
+	var (
+		downloaded    int
+		uploadedAtDL  int32 = -1
+		uploadResult  []byte
+		downloadEnded bool
+	)
+
+	for uploadResult == nil || !downloadEnded {
+		fr, err := c.readNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.Type() == FrameData {
+			data := fr.Body().(*Data)
+
+			switch fr.Stream() {
+			case 3:
+				// the request's DATA must not wait for the download to finish
+				if downloadEnded {
+					t.Fatal("the upload was blocked by the download")
+				}
+
+				uploadResult = append([]byte{}, data.Data()...)
+			case 5:
+				// the upload must still be in progress when the download starts
+				if uploadedAtDL < 0 {
+					uploadedAtDL = atomic.LoadInt32(&uploaded)
+				}
+
+				downloaded += len(data.Data())
+				downloadEnded = data.EndStream()
+			}
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+
+	if uploadedAtDL >= chunks {
+		t.Fatal("the download didn't progress during the upload")
+	}
+
+	if string(uploadResult) != strconv.Itoa(chunks*chunkSize) {
+		t.Fatalf("unexpected upload size: %s", uploadResult)
+	}
+
+	if downloaded != chunks*chunkSize {
+		t.Fatalf("unexpected download size: %d", downloaded)
+	}
+}
+
+func TestOpenStreamsAccounting(t *testing.T) {
+	for _, workers := range []int{0, 2} {
+		testOpenStreamsAccounting(t, workers)
+	}
+}
+
+func testOpenStreamsAccounting(t *testing.T, workers int) {
+	const maxStreams = 4
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				io.WriteString(ctx, "Hello world")
+			},
+		},
+		cnf: ServerConfig{
+			MaxConcurrentStreams: maxStreams,
+			MaxHandlerWorkers:    workers,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	ended := make(chan uint32, 16)
+	resets := make(chan uint32, 16)
+
+	go func() {
+		for {
+			fr, err := c.readNext()
+			if err != nil {
+				return
+			}
+
+			switch {
+			case fr.Type() == FrameResetStream:
+				if fr.Body().(*RstStream).Code() == RefusedStreamError {
+					resets <- fr.Stream()
+				}
+			case fr.Flags().Has(FlagEndStream):
+				ended <- fr.Stream()
+			}
+
+			ReleaseFrameHeader(fr)
+		}
+	}()
+
+	headers := func(id uint32, endStream bool) *FrameHeader {
+		return makeHeaders(id, c.enc, true, endStream, map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    "POST",
+			string(StringPath):      "/",
+			string(StringScheme):    "https",
+		})
+	}
+
+	waitEnd := func(id uint32) {
+		select {
+		case n := <-ended:
+			if n != id {
+				t.Fatalf("unexpected response on stream %d, expected %d", n, id)
+			}
+		case n := <-resets:
+			t.Fatalf("stream %d refused", n)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timeout waiting for the stream %d", id)
+		}
+	}
+
+	id := uint32(1)
+
+	// close the streams using all the possible paths.
+	for i := 0; i < 100; i++ {
+		switch i % 4 {
+		case 0: // the request is complete
+			c.writeFrame(headers(id, true))
+			waitEnd(id)
+		case 1: // the client resets the stream
+			c.writeFrame(headers(id, false))
+
+			fr := AcquireFrameHeader()
+			fr.SetStream(id)
+
+			rst := AcquireFrame(FrameResetStream).(*RstStream)
+			rst.SetCode(StreamCanceled)
+			fr.SetBody(rst)
+
+			c.writeFrame(fr)
+		case 2: // the stream is created by a PRIORITY frame
+			fr := AcquireFrameHeader()
+			fr.SetStream(id)
+			fr.SetBody(AcquireFrame(FramePriority))
+
+			c.writeFrame(fr)
+			c.writeFrame(headers(id, true))
+			waitEnd(id)
+		case 3: // the request has a body
+			c.writeFrame(headers(id, false))
+
+			fr := AcquireFrameHeader()
+			fr.SetStream(id)
+
+			data := AcquireFrame(FrameData).(*Data)
+			data.SetEndStream(true)
+			data.SetData([]byte("hello"))
+			fr.SetBody(data)
+
+			c.writeFrame(fr)
+			waitEnd(id)
+		}
+
+		id += 2
+	}
+
+	// if all the streams have been released, maxStreams streams can be opened again.
+	for i := 0; i <= maxStreams; i++ {
+		c.writeFrame(headers(id, false))
+		id += 2
+	}
+
+	select {
+	case n := <-resets:
+		if n != id-2 {
+			t.Fatalf("stream %d refused, expected %d", n, id-2)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected the last stream to be refused")
+	}
+}
+
+func TestIdleStreamsClosedByHigherStream(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				io.WriteString(ctx, "Hello world")
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	headers := func(id uint32, endStream bool) *FrameHeader {
+		return makeHeaders(id, c.enc, true, endStream, map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    "POST",
+			string(StringPath):      "/",
+			string(StringScheme):    "https",
+		})
+	}
+
+	// stream 1 is active, 3 and 5 are idle.
+	c.writeFrame(headers(1, false))
+
+	for _, id := range []uint32{3, 5} {
+		fr := AcquireFrameHeader()
+		fr.SetStream(id)
+		fr.SetBody(AcquireFrame(FramePriority))
+
+		c.writeFrame(fr)
+	}
+
+	c.writeFrame(headers(7, true))
+
+	fr := AcquireFrameHeader()
+	fr.SetStream(1)
+
+	data := AcquireFrame(FrameData).(*Data)
+	data.SetEndStream(true)
+	data.SetData([]byte("hello"))
+	fr.SetBody(data)
+
+	c.writeFrame(fr)
+
+	ended := map[uint32]bool{}
+
+	readUntilEnded := func(ids ...uint32) {
+		t.Helper()
+
+		for _, id := range ids {
+			for !ended[id] {
+				fr, err := c.readNext()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				switch {
+				case fr.Type() == FrameResetStream:
+					t.Fatalf("unexpected RST_STREAM on stream %d: %s", fr.Stream(), fr.Body().(*RstStream).Code())
+				case fr.Type() == FrameGoAway:
+					t.Fatalf("unexpected GOAWAY: %s", fr.Body().(*GoAway).Code())
+				case fr.Flags().Has(FlagEndStream):
+					ended[fr.Stream()] = true
+				}
+
+				ReleaseFrameHeader(fr)
+			}
+		}
+	}
+
+	readUntilEnded(1, 7)
+
+	// the idle streams were closed, so resetting them is ignored
+	// instead of being treated as a RST_STREAM on an idle stream.
+	for _, id := range []uint32{3, 5} {
+		fr := AcquireFrameHeader()
+		fr.SetStream(id)
+
+		rst := AcquireFrame(FrameResetStream).(*RstStream)
+		rst.SetCode(StreamCanceled)
+		fr.SetBody(rst)
+
+		c.writeFrame(fr)
+	}
+
+	c.writeFrame(headers(9, true))
+
+	readUntilEnded(9)
+}
+
+func TestStreamDone(t *testing.T) {
+	started := make(chan struct{}, 1)
+	results := make(chan string, 2)
+
+	wait := func(done <-chan struct{}, result string) {
+		select {
+		case <-done:
+			results <- result
+		case <-time.After(time.Second * 5):
+			results <- "timeout"
+		}
+	}
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				done := StreamFromCtx(ctx).Done()
+
+				switch string(ctx.Path()) {
+				case "/reset":
+					started <- struct{}{}
+					wait(done, "reset")
+				case "/complete":
+					go wait(done, "complete")
+				}
+			},
+		},
+		cnf: ServerConfig{
+			MaxHandlerWorkers: 2,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	go func() {
+		for {
+			fr, err := c.readNext()
+			if err != nil {
+				return
+			}
+
+			ReleaseFrameHeader(fr)
+		}
+	}()
+
+	headers := func(id uint32, path string) *FrameHeader {
+		return makeHeaders(id, c.enc, true, true, map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    "GET",
+			string(StringPath):      path,
+			string(StringScheme):    "https",
+		})
+	}
+
+	c.writeFrame(headers(1, "/reset"))
+	<-started
+
+	fr := AcquireFrameHeader()
+	fr.SetStream(1)
+
+	rst := AcquireFrame(FrameResetStream).(*RstStream)
+	rst.SetCode(StreamCanceled)
+	fr.SetBody(rst)
+
+	c.writeFrame(fr)
+
+	if res := <-results; res != "reset" {
+		t.Fatalf("expected Done to fire on RST_STREAM, got %s", res)
+	}
+
+	c.writeFrame(headers(3, "/complete"))
+
+	if res := <-results; res != "complete" {
+		t.Fatalf("expected Done to fire on completion, got %s", res)
+	}
+}
+
+func TestAdvertisedAndEnforcedMaxStreams(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+		},
+		cnf: ServerConfig{
+			AdvertisedMaxStreams: 10,
+			EnforcedMaxStreams:   2,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	if n := c.serverS.MaxConcurrentStreams(); n != 10 {
+		t.Fatalf("expected SETTINGS_MAX_CONCURRENT_STREAMS to be 10, got %d", n)
+	}
+
+	for id := uint32(1); id <= 5; id += 2 {
+		c.writeFrame(makeHeaders(id, c.enc, true, false, map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    "POST",
+			string(StringPath):      "/",
+			string(StringScheme):    "https",
+		}))
+	}
+
+	fr, err := c.readNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ReleaseFrameHeader(fr)
+
+	if fr.Type() != FrameResetStream || fr.Stream() != 5 {
+		t.Fatalf("expected the stream 5 to be reset, got %s on stream %d", fr.Type(), fr.Stream())
+	}
+
+	if code := fr.Body().(*RstStream).Code(); code != RefusedStreamError {
+		t.Fatalf("expected RefusedStreamError, got %s", code)
+	}
+}
+
+func TestFrameSizeExceeded(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	c.writeFrame(makeHeaders(1, c.enc, true, false, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "POST",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}))
+
+	fr := AcquireFrameHeader()
+	fr.SetStream(1)
+
+	data := AcquireFrame(FrameData).(*Data)
+	data.SetData(make([]byte, defaultDataFrameSize+1))
+	fr.SetBody(data)
+
+	c.writeFrame(fr)
+
+	for {
+		fr, err := c.readNext()
+		if err == nil {
+			ReleaseFrameHeader(fr)
+			continue
+		}
+
+		// readNext returns the GOAWAY frames as errors.
+		ga, ok := err.(*GoAway)
+		if !ok {
+			t.Fatal(err)
+		}
+
+		if ga.Code() != FrameSizeError {
+			t.Fatalf("expected FrameSizeError, got %s", ga.Code())
+		}
+
+		break
+	}
+}
+
+func TestLargeResponseHeaders(t *testing.T) {
+	value := strings.Repeat("a", 3<<14)
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.Response.Header.Set("X-Large", value)
+			},
+		},
+	}
+
+	c, ln, err := getClientConn(s, ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.Header.SetMethod("GET")
+	req.SetRequestURI("https://localhost/")
+
+	if err := doRequest(c, req, res); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := string(res.Header.Peek("X-Large")); v != value {
+		t.Fatalf("unexpected header value of %d bytes, expected %d", len(v), len(value))
+	}
+}
+
+type testLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, args ...interface{}) {
+	l.mu.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+	l.mu.Unlock()
+}
+
+func (l *testLogger) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestLogLevel(t *testing.T) {
+	for _, level := range []LogLevel{LogLevelError, LogLevelDebug} {
+		testLogLevel(t, level)
+	}
+}
+
+func testLogLevel(t *testing.T, level LogLevel) {
+	lg := &testLogger{}
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+			Logger:  lg,
+		},
+		cnf: ServerConfig{
+			LogLevel: level,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	hs := map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}
+
+	c.writeFrame(makeHeaders(1, c.enc, true, true, hs))
+
+	for {
+		fr, err := c.readNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ended := fr.Stream() == 1 && fr.Flags().Has(FlagEndStream)
+		ReleaseFrameHeader(fr)
+
+		if ended {
+			break
+		}
+	}
+
+	// the clients can't use even stream ids.
+	c.writeFrame(makeHeaders(2, c.enc, true, true, hs))
+
+	for {
+		fr, err := c.readNext()
+		if err != nil {
+			break
+		}
+		ReleaseFrameHeader(fr)
+	}
+
+	if !lg.contains("GoAway") {
+		t.Fatalf("expected the protocol error to be logged at %d", level)
+	}
+
+	if created := lg.contains("Stream 1 created"); created != (level == LogLevelDebug) {
+		t.Fatalf("unexpected stream created log at %d: %v", level, lg.lines)
+	}
+}
+
+func TestGoAwayGracePeriod(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+		},
+	}
+	s.cnf.defaults()
+
+	// the grace period matters on TCP, where closing a socket with unread data resets the connection.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go serve(s, ln)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConn(nc, ConnOpts{})
+	defer c.Close()
+
+	if err := c.doHandshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a frame exceeding SETTINGS_MAX_FRAME_SIZE followed by data the server won't read.
+	b := make([]byte, 9+1<<16)
+	b[0], b[8] = 1<<4, 1
+
+	if _, err := nc.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// slow reader
+	time.Sleep(time.Millisecond * 200)
+
+	for {
+		fr, err := ReadFrameFrom(c.br)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ga, ok := fr.Body().(*GoAway)
+		if !ok {
+			ReleaseFrameHeader(fr)
+			continue
+		}
+
+		code := ga.Code()
+		ReleaseFrameHeader(fr)
+
+		if code != FrameSizeError {
+			t.Fatalf("unexpected code %s", code)
+		}
+
+		break
+	}
+
+	// the server closed gracefully instead of resetting the connection.
+	for {
+		fr, err := ReadFrameFrom(c.br)
+		if err != nil {
+			if err != io.EOF {
+				t.Fatalf("expected EOF, got %v", err)
+			}
+
+			break
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+}
+
+// expectGoAway reads frames until a GOAWAY is received and checks its error code.
+func expectGoAway(t *testing.T, c *Conn, code ErrorCode) {
+	t.Helper()
+
+	for {
+		fr, err := c.readNext()
+		if err != nil {
+			// readNext returns the GOAWAY frames as errors when the last stream id is 0.
+			ga, ok := err.(*GoAway)
+			if !ok {
+				t.Fatal(err)
+			}
+
+			if ga.Code() != code {
+				t.Fatalf("expected %s, got %s", code, ga.Code())
+			}
+
+			return
+		}
+
+		if ga, ok := fr.Body().(*GoAway); ok {
+			if ga.Code() != code {
+				t.Fatalf("expected %s, got %s", code, ga.Code())
+			}
+
+			ReleaseFrameHeader(fr)
+
+			return
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+}
+
+func TestDataOnIdleStream(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				t.Fatal("the handler must not be called")
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	fr := AcquireFrameHeader()
+	fr.SetStream(1)
+
+	data := AcquireFrame(FrameData).(*Data)
+	data.SetData([]byte("hello"))
+	data.SetEndStream(true)
+	fr.SetBody(data)
+
+	c.writeFrame(fr)
+
+	expectGoAway(t, c, ProtocolError)
+}
+
+func TestDataBeforeEndHeaders(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				t.Fatal("the handler must not be called")
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	// the header block is not finished, so a CONTINUATION frame is expected.
+	c.writeFrame(makeHeaders(1, c.enc, false, false, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "POST",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}))
+
+	fr := AcquireFrameHeader()
+	fr.SetStream(1)
+
+	data := AcquireFrame(FrameData).(*Data)
+	data.SetData([]byte("hello"))
+	data.SetEndStream(true)
+	fr.SetBody(data)
+
+	c.writeFrame(fr)
+
+	expectGoAway(t, c, ProtocolError)
+}
+
+func TestServerHandshakeConnectionWindow(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	// every connection starts with a window of 65535 bytes.
+	window := int64(defaultWindowSize)
+
+	for {
+		fr, err := ReadFrameFrom(c.br)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wu, ok := fr.Body().(*WindowUpdate)
+		if ok && fr.Stream() == 0 {
+			window += int64(wu.Increment())
+		}
+
+		ReleaseFrameHeader(fr)
+
+		if ok {
+			break
+		}
+	}
+
+	if window != 1<<22 {
+		t.Fatalf("expected a window of %d, got %d", 1<<22, window)
+	}
+}
+
+// expectReset reads frames until the stream `id` is reset and checks the error code.
+func expectReset(t *testing.T, c *Conn, id uint32, code ErrorCode) {
+	t.Helper()
+
+	for {
+		fr, err := c.readNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rst, ok := fr.Body().(*RstStream)
+		if !ok {
+			if fr.Stream() == id {
+				t.Fatalf("unexpected %s frame", fr.Type())
+			}
+
+			ReleaseFrameHeader(fr)
+
+			continue
+		}
+
+		if fr.Stream() != id || rst.Code() != code {
+			t.Fatalf("unexpected reset on stream %d: %s", fr.Stream(), rst.Code())
+		}
+
+		ReleaseFrameHeader(fr)
+
+		return
+	}
+}
+
+func TestEmptyHeaders(t *testing.T) {
+	var called int32
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				atomic.StoreInt32(&called, 1)
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	c.writeFrame(makeHeaders(1, c.enc, true, true, nil))
+
+	expectReset(t, c, 1, ProtocolError)
+
+	if atomic.LoadInt32(&called) != 0 {
+		t.Fatal("the handler must not be called")
+	}
+}
+
+func TestConnIDFromCtx(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				fmt.Fprintf(ctx, "%d", ConnIDFromCtx(ctx))
+			},
+		},
+	}
+
+	ids := make([]string, 0, 4)
+
+	for i := 0; i < 2; i++ {
+		c, ln, err := getClientConn(s, ConnOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for j := 0; j < 2; j++ {
+			req := fasthttp.AcquireRequest()
+			res := fasthttp.AcquireResponse()
+
+			req.Header.SetMethod("GET")
+			req.SetRequestURI("https://localhost/")
+
+			if err := doRequest(c, req, res); err != nil {
+				t.Fatal(err)
+			}
+
+			ids = append(ids, string(res.Body()))
+
+			fasthttp.ReleaseRequest(req)
+			fasthttp.ReleaseResponse(res)
+		}
+
+		c.Close()
+		ln.Close()
+	}
+
+	if ids[0] == "0" || ids[0] != ids[1] {
+		t.Fatalf("the streams of the connection have different ids: %v", ids)
+	}
+
+	if ids[2] != ids[3] || ids[0] == ids[2] {
+		t.Fatalf("unexpected connection ids: %v", ids)
+	}
+}
+
+func TestSettingsString(t *testing.T) {
+	var st Settings
+	st.Reset()
+
+	st.SetMaxConcurrentStreams(250)
+	st.SetMaxWindowSize(1 << 20)
+	st.SetMaxHeaderListSize(8192)
+
+	s := st.String()
+
+	for _, field := range []string{
+		"HeaderTableSize=4096",
+		"EnablePush=false",
+		"MaxConcurrentStreams=250",
+		"InitialWindowSize=1048576",
+		"MaxFrameSize=16384",
+		"MaxHeaderListSize=8192",
+	} {
+		if !strings.Contains(s, field) {
+			t.Fatalf("%q doesn't contain %q", s, field)
+		}
+	}
+
+	st.SetAck(true)
+
+	if s := st.String(); s != "SETTINGS[ACK]" {
+		t.Fatalf("unexpected ack: %q", s)
+	}
+}
+
+func TestSettingsConnectProtocol(t *testing.T) {
+	var st Settings
+	st.Reset()
+
+	st.SetConnectProtocol(true)
+
+	fr := AcquireFrameHeader()
+	fr.SetBody(&st)
+
+	var bf bytes.Buffer
+
+	bw := bufio.NewWriter(&bf)
+	if _, err := fr.WriteTo(bw); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := ReadFrameFrom(bufio.NewReader(&bf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ReleaseFrameHeader(fr)
+
+	if !fr.Body().(*Settings).ConnectProtocol() {
+		t.Fatal("expected SETTINGS_ENABLE_CONNECT_PROTOCOL to be decoded")
+	}
+
+	if err := st.Read([]byte{0, byte(EnableConnectProtocol), 0, 0, 0, 2}); err == nil {
+		t.Fatal("expected an error decoding a value other than 0 or 1")
+	}
+}
+
+func TestServerSettings(t *testing.T) {
+	tcs := []struct {
+		s          *fasthttp.Server
+		window     uint32
+		headerSize uint32
+		frameSize  uint32
+	}{
+		{
+			s:          &fasthttp.Server{},
+			window:     1 << 22,
+			headerSize: 0,
+			frameSize:  defaultDataFrameSize,
+		},
+		{
+			s: &fasthttp.Server{
+				MaxRequestBodySize: 1 << 20,
+				ReadBufferSize:     8 << 10,
+			},
+			window:     1 << 20,
+			headerSize: 8 << 10,
+			frameSize:  defaultDataFrameSize,
+		},
+		{
+			s: &fasthttp.Server{
+				MaxRequestBodySize: 64 << 20,
+				ReadBufferSize:     64 << 10,
+			},
+			window:     1 << 22,
+			headerSize: 64 << 10,
+			frameSize:  64 << 10,
+		},
+	}
+
+	for i, tc := range tcs {
+		var st Settings
+
+		st.Reset()
+		serverSettings(&st, tc.s, 1<<22)
+
+		if st.MaxWindowSize() != tc.window {
+			t.Fatalf("%d: expected a window of %d, got %d", i, tc.window, st.MaxWindowSize())
+		}
+
+		if st.MaxHeaderListSize() != tc.headerSize {
+			t.Fatalf("%d: expected a header list size of %d, got %d", i, tc.headerSize, st.MaxHeaderListSize())
+		}
+
+		if st.MaxFrameSize() != tc.frameSize {
+			t.Fatalf("%d: expected a frame size of %d, got %d", i, tc.frameSize, st.MaxFrameSize())
+		}
+	}
+}
+
+func TestStreamFramesOnStreamZero(t *testing.T) {
+	frames := []func(c *Conn) *FrameHeader{
+		func(c *Conn) *FrameHeader {
+			return makeHeaders(0, c.enc, true, true, map[string]string{
+				string(StringAuthority): "localhost",
+				string(StringMethod):    "GET",
+				string(StringPath):      "/",
+				string(StringScheme):    "https",
+			})
+		},
+		func(c *Conn) *FrameHeader {
+			fr := AcquireFrameHeader()
+			fr.SetBody(AcquireFrame(FrameData))
+			fr.Body().(*Data).SetData([]byte("hello"))
+
+			return fr
+		},
+		func(c *Conn) *FrameHeader {
+			fr := AcquireFrameHeader()
+			fr.SetBody(AcquireFrame(FrameResetStream))
+
+			return fr
+		},
+		func(c *Conn) *FrameHeader {
+			fr := AcquireFrameHeader()
+			fr.SetBody(AcquireFrame(FramePriority))
+
+			return fr
+		},
+	}
+
+	for _, frame := range frames {
+		s := &Server{
+			s: &fasthttp.Server{
+				Handler: func(ctx *fasthttp.RequestCtx) {},
+			},
+		}
+
+		c, ln, err := getConn(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.writeFrame(frame(c))
+
+		expectGoAway(t, c, ProtocolError)
+
+		c.Close()
+		ln.Close()
+	}
+}
+
+func TestInvalidPath(t *testing.T) {
+	var called int32
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				atomic.StoreInt32(&called, 1)
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	for i, path := range []string{"/with space", "/with\x01control", "/with\x00nul"} {
+		id := uint32(i*2 + 1)
+
+		c.writeFrame(makeHeaders(id, c.enc, true, true, map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    "GET",
+			string(StringPath):      path,
+			string(StringScheme):    "https",
+		}))
+
+		expectReset(t, c, id, ProtocolError)
+	}
+
+	if atomic.LoadInt32(&called) != 0 {
+		t.Fatal("the handler must not be called")
+	}
+}
+
+func TestRequireAuthority(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.Write(ctx.Host())
+			},
+		},
+		cnf: ServerConfig{
+			RequireAuthority: true,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	c.writeFrame(makeHeaders(1, c.enc, true, true, map[string]string{
+		string(StringMethod): "GET",
+		string(StringPath):   "/",
+		string(StringScheme): "https",
+	}))
+
+	expectReset(t, c, 1, ProtocolError)
+
+	for i, hs := range []map[string]string{
+		{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    "GET",
+			string(StringPath):      "/",
+			string(StringScheme):    "https",
+		},
+		{
+			string(StringMethod): "GET",
+			string(StringPath):   "https://localhost/",
+			string(StringScheme): "https",
+		},
+	} {
+		id := uint32(i*2 + 3)
+
+		c.writeFrame(makeHeaders(id, c.enc, true, true, hs))
+
+		for {
+			fr, err := c.readNext()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fr.Stream() != id {
+				ReleaseFrameHeader(fr)
+				continue
+			}
+
+			if fr.Type() != FrameHeaders {
+				t.Fatalf("unexpected %s frame on stream %d", fr.Type(), id)
+			}
+
+			ReleaseFrameHeader(fr)
+
+			break
+		}
+	}
+}
+
+func TestMaxHeaderBlockEvictions(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+		},
+		cnf: ServerConfig{
+			MaxHeaderBlockEvictions: 8,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	hs := map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}
+
+	hf := AcquireHeaderField()
+	defer ReleaseHeaderField(hf)
+
+	value := strings.Repeat("a", 1000)
+
+	// a few evictions are allowed, while a block which keeps
+	// replacing the table contents is not.
+	for i, fields := range []int{6, 14} {
+		id := uint32(i*2 + 1)
+
+		fr := makeHeaders(id, c.enc, true, true, hs)
+		h := fr.Body().(*Headers)
+
+		for j := 0; j < fields; j++ {
+			hf.Set(fmt.Sprintf("x-churn-%d-%d", i, j), value)
+			c.enc.AppendHeaderField(h, hf, true)
+		}
+
+		c.writeFrame(fr)
+
+		if fields > 8 {
+			expectGoAway(t, c, EnhanceYourCalm)
+			break
+		}
+
+		for {
+			fr, err := c.readNext()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fr.Stream() == id {
+				if fr.Type() != FrameHeaders {
+					t.Fatalf("unexpected %s frame", fr.Type())
+				}
+
+				ReleaseFrameHeader(fr)
+
+				break
+			}
+
+			ReleaseFrameHeader(fr)
+		}
+	}
+}
+
+func TestEndStreamBeforeEndHeaders(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.Write(ctx.Path())
+				ctx.Write(ctx.Request.Header.Peek("X-Continued"))
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	// the stream is half-closed by the HEADERS, but the request
+	// must not be dispatched until the CONTINUATION ends the headers.
+	c.writeFrame(makeHeaders(1, c.enc, false, true, map[string]string{
+		string(StringMethod): "GET",
+		string(StringScheme): "https",
+	}))
+
+	hf := AcquireHeaderField()
+	defer ReleaseHeaderField(hf)
+
+	var b []byte
+
+	for _, kv := range [][2]string{
+		{string(StringAuthority), "localhost"},
+		{string(StringPath), "/continued"},
+		{"x-continued", "yes"},
+	} {
+		hf.Set(kv[0], kv[1])
+		b = c.enc.AppendHeader(b, hf, false)
+	}
+
+	fr := AcquireFrameHeader()
+	fr.SetStream(1)
+
+	cont := AcquireFrame(FrameContinuation).(*Continuation)
+	cont.SetHeader(b)
+	cont.SetEndHeaders(true)
+
+	fr.SetBody(cont)
+
+	c.writeFrame(fr)
+
+	if body := readResponseBody(t, c, 1); string(body) != "/continuedyes" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
+
+// readResponseBody reads the response of the stream `id` and returns its body.
+func readResponseBody(t *testing.T, c *Conn, id uint32) []byte {
+	t.Helper()
+
+	var body []byte
+
+	for {
+		fr, err := c.readNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.Stream() != id {
+			ReleaseFrameHeader(fr)
+			continue
+		}
+
+		switch fr.Type() {
+		case FrameHeaders:
+		case FrameData:
+			body = append(body, fr.Body().(*Data).Data()...)
+		default:
+			t.Fatalf("unexpected %s frame", fr.Type())
+		}
+
+		end := fr.Flags().Has(FlagEndStream)
+		ReleaseFrameHeader(fr)
+
+		if end {
+			return body
+		}
+	}
+}
+
+// readResponse reads the response sent on stream `id`, returning its header fields and body.
+//
+// The header blocks of the other streams are decoded too, keeping the HPACK state in sync.
+func readResponse(t *testing.T, c *Conn, id uint32) (map[string]string, []byte) {
+	t.Helper()
+
+	hfs := map[string]string{}
+	hf := AcquireHeaderField()
+	defer ReleaseHeaderField(hf)
+
+	var body []byte
+
+	for {
+		fr, err := c.readNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch fr.Type() {
+		case FrameHeaders:
+			for b := fr.Body().(*Headers).Headers(); len(b) > 0; {
+				if b, err = c.dec.Next(hf, b); err != nil {
+					t.Fatal(err)
+				}
+
+				if fr.Stream() == id {
+					hfs[hf.Key()] = hf.Value()
+				}
+			}
+		case FrameData:
+			if fr.Stream() == id {
+				body = append(body, fr.Body().(*Data).Data()...)
+			}
+		default:
+			if fr.Stream() == id {
+				t.Fatalf("unexpected %s frame", fr.Type())
+			}
+		}
+
+		end := fr.Stream() == id && fr.Flags().Has(FlagEndStream)
+		ReleaseFrameHeader(fr)
+
+		if end {
+			return hfs, body
+		}
+	}
+}
+
+func TestCookieConcatenation(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.Write(ctx.Request.Header.Peek("Cookie"))
+				ctx.WriteString("|")
+				ctx.Write(ctx.Request.Header.Cookie("b"))
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	fr := makeHeaders(1, c.enc, true, true, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	})
+	h := fr.Body().(*Headers)
+
+	hf := AcquireHeaderField()
+	defer ReleaseHeaderField(hf)
+
+	for _, cookie := range []string{"a=1", "b=2", "c=3"} {
+		hf.Set("cookie", cookie)
+		c.enc.AppendHeaderField(h, hf, false)
+	}
+
+	c.writeFrame(fr)
+
+	if body := readResponseBody(t, c, 1); string(body) != "a=1; b=2; c=3|2" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
+
+func TestSetCookieFields(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"c", "3"}} {
+					cookie := fasthttp.AcquireCookie()
+					cookie.SetKey(kv[0])
+					cookie.SetValue(kv[1])
+					cookie.SetPath("/")
+
+					ctx.Response.Header.SetCookie(cookie)
+					fasthttp.ReleaseCookie(cookie)
+				}
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	c.writeFrame(makeHeaders(1, c.enc, true, true, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}))
+
+	var cookies []string
+
+	for {
+		fr, err := c.readNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.Stream() != 1 || fr.Type() != FrameHeaders {
+			ReleaseFrameHeader(fr)
+			continue
+		}
+
+		hf := AcquireHeaderField()
+
+		for b := fr.Body().(*Headers).Headers(); len(b) > 0; {
+			b, err = c.dec.Next(hf, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if hf.Key() == "set-cookie" {
+				cookies = append(cookies, hf.Value())
+			}
+		}
+
+		ReleaseHeaderField(hf)
+		ReleaseFrameHeader(fr)
+
+		break
+	}
+
+	expected := []string{"a=1; path=/", "b=2; path=/", "c=3; path=/"}
+	if strings.Join(cookies, "|") != strings.Join(expected, "|") {
+		t.Fatalf("expected the fields %q, got %q", expected, cookies)
+	}
+}
+
+func TestPingFlood(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+		},
+		cnf: ServerConfig{
+			MaxPingsPerSecond: 10,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	go func() {
+		for i := 0; i < 50; i++ {
+			fr := AcquireFrameHeader()
+
+			ping := AcquireFrame(FramePing).(*Ping)
+			ping.SetCurrentTime()
+
+			fr.SetBody(ping)
+
+			err := c.writeFrame(fr)
+			ReleaseFrameHeader(fr)
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	acks := 0
+
+	for {
+		// readNext handles the pings, so the frames are read directly.
+		fr, err := ReadFrameFrom(c.br)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ping, ok := fr.Body().(*Ping); ok && ping.IsAck() {
+			acks++
+		}
+
+		ga, ok := fr.Body().(*GoAway)
+		if ok {
+			if ga.Code() != EnhanceYourCalm {
+				t.Fatalf("unexpected GOAWAY: %s", ga.Code())
+			}
+
+			ReleaseFrameHeader(fr)
+
+			break
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+
+	if acks > 10 {
+		t.Fatalf("expected at most 10 pings acknowledged, got %d", acks)
+	}
+}
+
+func TestEvenStreamID(t *testing.T) {
+	var called int32
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				atomic.StoreInt32(&called, 1)
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	c.writeFrame(makeHeaders(2, c.enc, true, true, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}))
+
+	for {
+		fr, err := c.readNext()
+		if err != nil {
+			ga, ok := err.(*GoAway)
+			if !ok {
+				t.Fatal(err)
+			}
+
+			// the last stream id of 0 means no stream was processed.
+			if ga.Code() != ProtocolError || ga.Stream() != 0 {
+				t.Fatalf("unexpected GOAWAY: %s", ga)
+			}
+
+			break
+		}
+
+		if fr.Stream() != 0 {
+			t.Fatalf("unexpected %s frame on stream %d", fr.Type(), fr.Stream())
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+
+	if atomic.LoadInt32(&called) != 0 {
+		t.Fatal("the handler must not be called")
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	certPEM, keyPEM, err := fasthttp.GenerateTestCertificate("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := ConfigureServer(&fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			ctx.Write(ctx.Request.Header.Protocol())
+		},
+	}, ServerConfig{})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go s.ServeTLS(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+
+	d := &Dialer{
+		Addr: ln.Addr().String(),
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+
+	c, err := d.Dial(ConnOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.SetRequestURI("https://localhost/")
+
+	if err := doRequest(c, req, res); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(res.Body()) != "HTTP/2" {
+		t.Fatalf("expected an HTTP/2 request, got %q", res.Body())
+	}
+
+	hc := &fasthttp.HostClient{
+		Addr:  ln.Addr().String(),
+		IsTLS: true,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+
+	res.Reset()
+
+	if err := hc.Do(req, res); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(res.Body()) != "HTTP/1.1" {
+		t.Fatalf("expected an HTTP/1.1 request, got %q", res.Body())
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				io.WriteString(ctx, ctx.RemoteAddr().String())
+			},
+		},
+		cnf: ServerConfig{
+			ProxyProtocol: true,
+		},
+	}
+	s.cnf.defaults()
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go serve(s, ln)
+
+	v2 := append([]byte{}, proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12)
+	v2 = append(v2, 198, 51, 100, 9, 10, 0, 0, 1)
+	v2 = append(v2, 0xc8, 0x50, 0x01, 0xbb)
+
+	for _, tc := range []struct {
+		header []byte
+		addr   string
+	}{
+		{
+			header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"),
+			addr:   "203.0.113.7:51234",
+		},
+		{
+			header: v2,
+			addr:   "198.51.100.9:51280",
+		},
+		{
+			// the connection's own address is kept.
+			header: []byte("PROXY UNKNOWN ffff::1 ffff::2 51234 443\r\n"),
+			addr:   "pipe",
+		},
+	} {
+		nc, err := ln.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := nc.Write(tc.header); err != nil {
+			t.Fatal(err)
+		}
+
+		c := NewConn(nc, ConnOpts{})
+		if err := c.doHandshake(); err != nil {
+			t.Fatal(err)
+		}
+
+		c.writeFrame(makeHeaders(1, c.enc, true, true, map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    "GET",
+			string(StringPath):      "/",
+			string(StringScheme):    "https",
+		}))
+
+		if body := readResponseBody(t, c, 1); string(body) != tc.addr {
+			t.Fatalf("expected remote address %q, got %q", tc.addr, body)
+		}
+
+		c.Close()
+	}
+
+	// the connections without the header are closed.
+	nc, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	c := NewConn(nc, ConnOpts{})
+	if err := c.doHandshake(); err == nil {
+		if _, err = ReadFrameFrom(c.br); err == nil {
+			t.Fatal("expected the connection to be closed")
+		}
+	}
+}
+
+func TestStreamWindowSize(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+		},
+		cnf: ServerConfig{
+			ConnectionWindowSize: 8 << 20,
+			StreamWindowSize:     256 << 10,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	if n := c.serverS.MaxWindowSize(); n != 256<<10 {
+		t.Fatalf("expected a stream window of %d, got %d", 256<<10, n)
+	}
+
+	for {
+		fr, err := ReadFrameFrom(c.br)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.Type() != FrameWindowUpdate {
+			ReleaseFrameHeader(fr)
+			continue
+		}
+
+		if fr.Stream() != 0 {
+			t.Fatalf("unexpected WINDOW_UPDATE on stream %d", fr.Stream())
+		}
+
+		increment := fr.Body().(*WindowUpdate).Increment()
+		ReleaseFrameHeader(fr)
+
+		if increment != 8<<20-int(defaultWindowSize) {
+			t.Fatalf("expected a connection window of %d, got %d", 8<<20, increment+int(defaultWindowSize))
+		}
+
+		break
+	}
+}
+
+func TestWindowSizeDefaults(t *testing.T) {
+	var cnf ServerConfig
+	cnf.defaults()
+
+	if cnf.ConnectionWindowSize != 1<<22 || cnf.StreamWindowSize != 1<<22 {
+		t.Fatalf("unexpected default windows: %d %d", cnf.ConnectionWindowSize, cnf.StreamWindowSize)
+	}
+
+	cnf = ServerConfig{
+		ConnectionWindowSize: math.MaxInt,
+		StreamWindowSize:     math.MaxInt,
+	}
+	cnf.defaults()
+
+	if cnf.ConnectionWindowSize != 1<<31-1 || cnf.StreamWindowSize != 1<<31-1 {
+		t.Fatalf("expected the windows to be limited to %d, got %d %d",
+			1<<31-1, cnf.ConnectionWindowSize, cnf.StreamWindowSize)
+	}
+}
+
+func TestFramesOnRefusedStream(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.Write(ctx.Request.Body())
+			},
+		},
+		cnf: ServerConfig{
+			EnforcedMaxStreams: 1,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	hs := map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "POST",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}
+
+	writeData := func(id uint32, body string) {
+		fr := AcquireFrameHeader()
+		fr.SetStream(id)
+
+		data := AcquireFrame(FrameData).(*Data)
+		data.SetEndStream(true)
+		data.SetData([]byte(body))
+
+		fr.SetBody(data)
+
+		c.writeFrame(fr)
+		ReleaseFrameHeader(fr)
+	}
+
+	// stream 1 stays open until its body is sent.
+	c.writeFrame(makeHeaders(1, c.enc, true, false, hs))
+	c.writeFrame(makeHeaders(3, c.enc, true, false, hs))
+
+	expectReset(t, c, 3, RefusedStreamError)
+
+	// the frames sent before receiving the RST_STREAM are ignored.
+	writeData(3, "refused")
+	c.writeFrame(makeHeaders(3, c.enc, true, true, hs))
+
+	writeData(1, "hello")
+
+	if body := readResponseBody(t, c, 1); string(body) != "hello" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	c.writeFrame(makeHeaders(5, c.enc, true, false, hs))
+	writeData(5, "world")
+
+	if body := readResponseBody(t, c, 5); string(body) != "world" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestResponseAfterReset(t *testing.T) {
+	started := make(chan struct{})
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				if string(ctx.Path()) != "/slow" {
+					ctx.WriteString("fast")
+					return
+				}
+
+				close(started)
+
+				select {
+				case <-StreamFromCtx(ctx).Done():
+				case <-time.After(time.Second):
+				}
+
+				ctx.WriteString("slow")
+			},
+		},
+		cnf: ServerConfig{
+			MaxHandlerWorkers: 1,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	headers := func(id uint32, path string) *FrameHeader {
+		return makeHeaders(id, c.enc, true, true, map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    "GET",
+			string(StringPath):      path,
+			string(StringScheme):    "https",
+		})
+	}
+
+	c.writeFrame(headers(1, "/slow"))
+	<-started
+
+	fr := AcquireFrameHeader()
+	fr.SetStream(1)
+
+	rst := AcquireFrame(FrameResetStream).(*RstStream)
+	rst.SetCode(StreamCanceled)
+	fr.SetBody(rst)
+
+	c.writeFrame(fr)
+	ReleaseFrameHeader(fr)
+
+	// the handlers run sequentially, so the response of stream 3
+	// is sent after the slow handler returns.
+	c.writeFrame(headers(3, "/fast"))
+
+	for {
+		fr, err := c.readNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id, typ := fr.Stream(), fr.Type()
+		ReleaseFrameHeader(fr)
+
+		if id == 1 {
+			t.Fatalf("unexpected %s frame on the reset stream", typ)
+		}
+
+		if id == 3 {
+			break
+		}
+	}
+}
+
+func TestScheduledStreamsInterleaving(t *testing.T) {
+	const chunks = 3
+
+	// the DATA frames of the streams 1 and 3 are written alternately once all of them are queued.
+	var (
+		next    uint32 = 1
+		started bool
+	)
+
+	schedule := func(pending []*FrameHeader) int {
+		ended := 0
+
+		for i, fr := range pending {
+			// the header blocks keep their order.
+			if fr.Type() != FrameData {
+				return i
+			}
+
+			// the flags are set when the frame is written.
+			if fr.Body().(*Data).EndStream() {
+				ended++
+			}
+		}
+
+		if ended < 2 && !started {
+			return -1
+		}
+
+		started = true
+
+		for i, fr := range pending {
+			if fr.Stream() == next {
+				next = 4 - next
+				return i
+			}
+		}
+
+		return 0
+	}
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.Write(bytes.Repeat([]byte("a"), chunks<<14))
+			},
+		},
+		cnf: ServerConfig{
+			MaxHandlerWorkers: 2,
+		},
+		schedule: schedule,
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	for _, id := range []uint32{1, 3} {
+		c.writeFrame(makeHeaders(id, c.enc, true, true, map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    "GET",
+			string(StringPath):      "/",
+			string(StringScheme):    "https",
+		}))
+	}
+
+	var streams []uint32
+
+	for len(streams) < chunks*2 {
+		fr, err := c.readNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.Type() == FrameData {
+			streams = append(streams, fr.Stream())
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+
+	for i, id := range streams {
+		if expected := uint32(1 + 2*(i%2)); id != expected {
+			t.Fatalf("expected the DATA frames to alternate between the streams, got %v", streams)
+		}
+	}
+}
+
+func TestBodilessContentLength(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				// fasthttp ignores the content-length set after a 304 status code.
+				ctx.Response.Header.SetContentLength(1234)
+
+				if string(ctx.Path()) == "/not-modified" {
+					ctx.SetStatusCode(fasthttp.StatusNotModified)
+				}
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	for i, tc := range []struct {
+		method string
+		path   string
+	}{
+		{"HEAD", "/"},
+		{"GET", "/not-modified"},
+	} {
+		id := uint32(i*2 + 1)
+
+		c.writeFrame(makeHeaders(id, c.enc, true, true, map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    tc.method,
+			string(StringPath):      tc.path,
+			string(StringScheme):    "https",
+		}))
+
+		for {
+			fr, err := c.readNext()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fr.Stream() != id {
+				ReleaseFrameHeader(fr)
+				continue
+			}
+
+			if fr.Type() != FrameHeaders || !fr.Flags().Has(FlagEndStream) {
+				t.Fatalf("%s %s: expected the response to end with the headers, got %s", tc.method, tc.path, fr)
+			}
+
+			var contentLength string
+
+			hf := AcquireHeaderField()
+
+			for b := fr.Body().(*Headers).Headers(); len(b) > 0; {
+				b, err = c.dec.Next(hf, b)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if hf.Key() == "content-length" {
+					contentLength = hf.Value()
+				}
+			}
+
+			ReleaseHeaderField(hf)
+			ReleaseFrameHeader(fr)
+
+			if contentLength != "1234" {
+				t.Fatalf("%s %s: expected the content-length set by the handler, got %q", tc.method, tc.path, contentLength)
+			}
+
+			break
+		}
+	}
+}
+
+func TestBodilessResponses(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				switch string(ctx.Path()) {
+				case "/no-content":
+					ctx.SetStatusCode(fasthttp.StatusNoContent)
+				case "/not-modified":
+					ctx.SetStatusCode(fasthttp.StatusNotModified)
+				}
+
+				// the body must not be sent, except for the GET request to /.
+				ctx.WriteString("body")
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	requests := []struct {
+		method string
+		path   string
+	}{
+		{"HEAD", "/"},
+		{"GET", "/no-content"},
+		{"GET", "/not-modified"},
+		{"GET", "/"},
+	}
+
+	for i, req := range requests {
+		c.writeFrame(makeHeaders(uint32(i*2+1), c.enc, true, true, map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    req.method,
+			string(StringPath):      req.path,
+			string(StringScheme):    "https",
+		}))
+	}
+
+	// the handlers run sequentially, so the last response is sent after the rest.
+	last := uint32(len(requests)*2 - 1)
+
+	var body []byte
+
+	for {
+		fr, err := c.readNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id, end := fr.Stream(), fr.Flags().Has(FlagEndStream)
+
+		switch fr.Type() {
+		case FrameHeaders:
+			if id != last && !end {
+				t.Fatalf("expected the response of stream %d to end with the headers", id)
+			}
+		case FrameData:
+			if id != last {
+				t.Fatalf("unexpected DATA frame on stream %d", id)
+			}
+
+			body = append(body, fr.Body().(*Data).Data()...)
+		}
+
+		ReleaseFrameHeader(fr)
+
+		if id == last && end {
+			break
+		}
+	}
+
+	if string(body) != "body" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestExtendedConnect(t *testing.T) {
+	connect := func(c *Conn, id uint32) {
+		c.writeFrame(makeHeaders(id, c.enc, true, true, map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    "CONNECT",
+			string(StringPath):      "/chat",
+			string(StringScheme):    "https",
+			string(StringProtocol):  "websocket",
+		}))
+	}
+
+	for _, enabled := range []bool{true, false} {
+		s := &Server{
+			s: &fasthttp.Server{
+				Handler: func(ctx *fasthttp.RequestCtx) {
+					ctx.Write(StreamFromCtx(ctx).Protocol())
+				},
+			},
+			cnf: ServerConfig{
+				EnableConnectProtocol: enabled,
+			},
+		}
+
+		c, ln, err := getConn(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.serverS.ConnectProtocol() != enabled {
+			t.Fatalf("expected SETTINGS_ENABLE_CONNECT_PROTOCOL=%v", enabled)
+		}
+
+		connect(c, 1)
+
+		if enabled {
+			if body := readResponseBody(t, c, 1); string(body) != "websocket" {
+				t.Fatalf("unexpected protocol %q", body)
+			}
+		} else {
+			expectReset(t, c, 1, ProtocolError)
+		}
+
+		c.Close()
+		ln.Close()
+	}
+}
+
+func TestAbsoluteFormPath(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				fmt.Fprintf(ctx, "%s %s %s %s",
+					ctx.URI().Scheme(), ctx.URI().Host(), ctx.Request.Header.Host(), ctx.URI().RequestURI())
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	for i, test := range []struct {
+		headers  map[string]string
+		expected string
+	}{
+		{
+			headers: map[string]string{
+				string(StringMethod): "GET",
+				string(StringPath):   "http://example.com:8080/a/b?c=d",
+				string(StringScheme): "https",
+			},
+			expected: "http example.com:8080 example.com:8080 /a/b?c=d",
+		},
+		{
+			// the host of the request-target replaces the :authority.
+			headers: map[string]string{
+				string(StringAuthority): "proxy.local",
+				string(StringMethod):    "GET",
+				string(StringPath):      "https://user@example.com?q",
+				string(StringScheme):    "https",
+			},
+			expected: "https example.com example.com /?q",
+		},
+		{
+			headers: map[string]string{
+				string(StringAuthority): "localhost",
+				string(StringMethod):    "GET",
+				string(StringPath):      "/x",
+				string(StringScheme):    "http",
+			},
+			expected: "http localhost localhost /x",
+		},
+	} {
+		id := uint32(i*2 + 1)
+
+		c.writeFrame(makeHeaders(id, c.enc, true, true, test.headers))
+
+		if body := readResponseBody(t, c, id); string(body) != test.expected {
+			t.Fatalf("expected %q, got %q", test.expected, body)
+		}
+	}
+}
+
+// failingConn is a net.Conn whose writes fail with err once fail is set.
+type failingConn struct {
+	net.Conn
+	fail int32
+	err  error
+}
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.fail) == 1 {
+		return 0, c.err
+	}
+
+	return c.Conn.Write(b)
+}
+
+func TestWriteLoopError(t *testing.T) {
+	errWrite := errors.New("broken pipe")
+
+	pc := fasthttputil.NewPipeConns()
+	fc := &failingConn{Conn: pc.Conn2(), err: errWrite}
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				atomic.StoreInt32(&fc.fail, 1)
+				// enough frames to fill the writer.
+				ctx.Write(bytes.Repeat([]byte("a"), 1<<20))
+			},
+		},
+	}
+	s.cnf.defaults()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.ServeConn(fc)
+	}()
+
+	c := NewConn(pc.Conn1(), ConnOpts{})
+	defer c.Close()
+
+	if err := c.doHandshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.writeFrame(makeHeaders(1, c.enc, true, true, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}))
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, errWrite) {
+			t.Fatalf("expected %v, got %v", errWrite, err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("ServeConn didn't return after the write error")
+	}
+}
+
+func TestConsecutiveSettings(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.Write(bytes.Repeat([]byte("a"), 100))
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	// the second frame doesn't include SETTINGS_INITIAL_WINDOW_SIZE, so the value of the first one is kept.
+	c.bw.Write([]byte{
+		0, 0, 6, byte(FrameSettings), 0, 0, 0, 0, 0,
+		byte(MaxWindowSize >> 8), byte(MaxWindowSize), 0, 0, 0, 10,
+		0, 0, 6, byte(FrameSettings), 0, 0, 0, 0, 0,
+		byte(MaxFrameSize >> 8), byte(MaxFrameSize), 0, 0, 0x80, 0,
+	})
+	c.bw.Flush()
+
+	// one ACK per SETTINGS frame, including the one sent in the handshake.
+	for acks := 0; acks < 3; {
+		fr, err := ReadFrameFrom(c.br)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.Type() == FrameSettings && fr.Body().(*Settings).IsAck() {
+			acks++
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+
+	c.writeFrame(makeHeaders(1, c.enc, true, true, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}))
+
+	for {
+		fr, err := c.readNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.Type() != FrameData {
+			ReleaseFrameHeader(fr)
+			continue
+		}
+
+		if n := len(fr.Body().(*Data).Data()); n != 10 {
+			t.Fatalf("expected a DATA frame of 10 bytes, got %d", n)
+		}
+
+		ReleaseFrameHeader(fr)
+
+		break
+	}
+}
+
+// everyFrameFlow replenishes the windows after every DATA frame.
+type everyFrameFlow struct {
+	consumed int32
+}
+
+func (f *everyFrameFlow) Consumed(_ uint32, n int32) {
+	atomic.AddInt32(&f.consumed, n)
+}
+
+func (f *everyFrameFlow) WindowUpdate(_ uint32, window, max int32) int32 {
+	return max - window
+}
+
+func TestFlowController(t *testing.T) {
+	flow := &everyFrameFlow{}
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.Write(ctx.Request.Body())
+			},
+		},
+		cnf: ServerConfig{
+			FlowController: flow,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	c.writeFrame(makeHeaders(1, c.enc, true, false, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "POST",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}))
+
+	for i := 0; i < 3; i++ {
+		if err := writeData(c.bw, 1, bytes.Repeat([]byte("a"), 100), i == 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.bw.Flush()
+
+	// the stream's window is not replenished after the END_STREAM.
+	updates := map[uint32]int{}
+	handshake := true
+
+	for {
+		fr, err := ReadFrameFrom(c.br)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the first one enlarges the connection's window in the handshake.
+		if fr.Type() == FrameWindowUpdate && handshake {
+			handshake = false
+		} else if fr.Type() == FrameWindowUpdate {
+			if inc := fr.Body().(*WindowUpdate).Increment(); inc != 100 {
+				t.Fatalf("unexpected increment %d on stream %d", inc, fr.Stream())
+			}
+
+			updates[fr.Stream()]++
+		}
+
+		isHeaders := fr.Type() == FrameHeaders
+		ReleaseFrameHeader(fr)
+
+		if isHeaders {
+			break
+		}
+	}
+
+	if updates[0] != 3 || updates[1] != 2 {
+		t.Fatalf("unexpected window updates: %v", updates)
+	}
+
+	if n := atomic.LoadInt32(&flow.consumed); n != 500 {
+		t.Fatalf("expected 500 bytes consumed, got %d", n)
+	}
+}
+
+func TestStreamWindowExceeded(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+		},
+		cnf: ServerConfig{
+			StreamWindowSize: 1000,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	c.writeFrame(makeHeaders(1, c.enc, true, false, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "POST",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}))
+
+	if err := writeData(c.bw, 1, bytes.Repeat([]byte("a"), 1200), true); err != nil {
+		t.Fatal(err)
+	}
+
+	c.bw.Flush()
+
+	expectGoAway(t, c, FlowControlError)
+}
+
+func TestServeConnWithConfig(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+		},
+		cnf: ServerConfig{
+			MaxConcurrentStreams: 1,
+		},
+	}
+	s.cnf.defaults()
+
+	for _, maxStreams := range []int{1, 2} {
+		pc := fasthttputil.NewPipeConns()
+
+		if maxStreams == 1 {
+			go s.ServeConn(pc.Conn2())
+		} else {
+			go s.ServeConnWithConfig(pc.Conn2(), ServerConfig{
+				MaxConcurrentStreams: maxStreams,
+			})
+		}
+
+		c := NewConn(pc.Conn1(), ConnOpts{})
+		if err := c.doHandshake(); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := c.serverS.MaxConcurrentStreams(); n != uint32(maxStreams) {
+			t.Fatalf("expected SETTINGS_MAX_CONCURRENT_STREAMS to be %d, got %d", maxStreams, n)
+		}
+
+		// the stream above the limit is refused.
+		refused := uint32(maxStreams*2 + 1)
+
+		for id := uint32(1); id <= refused; id += 2 {
+			c.writeFrame(makeHeaders(id, c.enc, true, false, map[string]string{
+				string(StringAuthority): "localhost",
+				string(StringMethod):    "POST",
+				string(StringPath):      "/",
+				string(StringScheme):    "https",
+			}))
+		}
+
+		expectReset(t, c, refused, RefusedStreamError)
+
+		c.Close()
+	}
+}
+
+func TestHeadersHandlerRejectsBody(t *testing.T) {
+	var handled int32
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				atomic.AddInt32(&handled, 1)
+				ctx.Write(ctx.Request.Body())
+			},
+		},
+		cnf: ServerConfig{
+			HeadersHandler: func(ctx *fasthttp.RequestCtx) bool {
+				if ctx.Request.Header.ContentLength() > 1<<20 {
+					ctx.Error("too large", fasthttp.StatusRequestEntityTooLarge)
+					return false
+				}
+
+				return true
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	c.writeFrame(makeHeaders(1, c.enc, true, false, map[string]string{
+		string(StringAuthority):     "localhost",
+		string(StringMethod):        "POST",
+		string(StringPath):          "/",
+		string(StringScheme):        "https",
+		string(StringContentLength): strconv.Itoa(10 << 20),
+	}))
+
+	if body := readResponseBody(t, c, 1); string(body) != "too large" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	expectReset(t, c, 1, NoError)
+
+	// the data sent before receiving the RST_STREAM is ignored.
+	if err := writeData(c.bw, 1, bytes.Repeat([]byte("a"), 1<<14), false); err != nil {
+		t.Fatal(err)
+	}
+
+	c.bw.Flush()
+
+	c.writeFrame(makeHeaders(3, c.enc, true, false, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "POST",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}))
+
+	if err := writeData(c.bw, 3, []byte("accepted"), true); err != nil {
+		t.Fatal(err)
+	}
+
+	c.bw.Flush()
+
+	if body := readResponseBody(t, c, 3); string(body) != "accepted" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	if n := atomic.LoadInt32(&handled); n != 1 {
+		t.Fatalf("expected the handler to be called once, got %d", n)
+	}
+}
+
+func TestResponseTrailers(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.Response.Header.SetTrailer("Grpc-Status")
+				ctx.Response.Header.Set("Grpc-Status", "0")
+
+				if string(ctx.Path()) == "/stream" {
+					ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+						w.WriteString("hello")
+					})
+				} else {
+					ctx.WriteString("hello")
+				}
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	for i, tc := range []struct {
+		path string
+		te   bool
+	}{
+		{"/", true},
+		{"/stream", true},
+		{"/", false},
+		{"/stream", false},
+	} {
+		id, path := uint32(i*2+1), tc.path
+
+		request := map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    "GET",
+			string(StringPath):      path,
+			string(StringScheme):    "https",
+		}
+
+		// the trailers are only sent to the clients accepting them.
+		if tc.te {
+			request["te"] = "trailers"
+		}
+
+		c.writeFrame(makeHeaders(id, c.enc, true, true, request))
+
+		var (
+			blocks []map[string]string
+			body   []byte
+		)
+
+		for end := false; !end; {
+			fr, err := c.readNext()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fr.Stream() != id {
+				ReleaseFrameHeader(fr)
+				continue
+			}
+
+			end = fr.Flags().Has(FlagEndStream)
+
+			switch fr.Type() {
+			case FrameHeaders:
+				if !fr.Flags().Has(FlagEndHeaders) {
+					t.Fatalf("%s: expected END_HEADERS", path)
+				}
+
+				fields := map[string]string{}
+				hf := AcquireHeaderField()
+
+				for b := fr.Body().(*Headers).Headers(); len(b) > 0; {
+					b, err = c.dec.Next(hf, b)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					fields[hf.Key()] = hf.Value()
+				}
+
+				ReleaseHeaderField(hf)
+
+				blocks = append(blocks, fields)
+			case FrameData:
+				if end && tc.te {
+					t.Fatalf("%s: the DATA frames must not end the stream", path)
+				}
+
+				body = append(body, fr.Body().(*Data).Data()...)
+			}
+
+			ReleaseFrameHeader(fr)
+		}
+
+		if string(body) != "hello" {
+			t.Fatalf("%s: unexpected body %q", path, body)
+		}
+
+		if _, ok := blocks[0]["grpc-status"]; ok || blocks[0][":status"] != "200" {
+			t.Fatalf("%s: unexpected headers %v", path, blocks[0])
+		}
+
+		if !tc.te {
+			if len(blocks) != 1 {
+				t.Fatalf("%s: expected no trailers without te, got %d header blocks", path, len(blocks))
+			}
+
+			continue
+		}
+
+		if len(blocks) != 2 {
+			t.Fatalf("%s: expected the headers and the trailers, got %d header blocks", path, len(blocks))
+		}
+
+		if len(blocks[1]) != 1 || blocks[1]["grpc-status"] != "0" {
+			t.Fatalf("%s: unexpected trailers %v", path, blocks[1])
+		}
+	}
+}
+
+func TestRequestTrailers(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				if keys := ctx.Request.Header.PeekTrailerKeys(); len(keys) != 1 || string(keys[0]) != "Grpc-Status" {
+					ctx.Error(fmt.Sprintf("unexpected trailers %q", keys), fasthttp.StatusBadRequest)
+					return
+				}
+
+				ctx.Write(ctx.Request.Body())
+				ctx.Write(ctx.Request.Header.Peek("Grpc-Status"))
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	request := map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "POST",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}
+
+	c.writeFrame(makeHeaders(1, c.enc, true, false, request))
+
+	if err := writeData(c.bw, 1, []byte("status="), false); err != nil {
+		t.Fatal(err)
+	}
+
+	c.writeFrame(makeHeaders(1, c.enc, true, true, map[string]string{
+		"grpc-status": "0",
+	}))
+
+	if body := readResponseBody(t, c, 1); string(body) != "status=0" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	// pseudo-header fields are not allowed in the trailers.
+	c.writeFrame(makeHeaders(3, c.enc, true, false, request))
+	c.writeFrame(makeHeaders(3, c.enc, true, true, map[string]string{
+		string(StringStatus): "200",
+	}))
+
+	expectReset(t, c, 3, ProtocolError)
+
+	// the trailers must end the stream.
+	c.writeFrame(makeHeaders(5, c.enc, true, false, request))
+	c.writeFrame(makeHeaders(5, c.enc, true, false, map[string]string{
+		"grpc-status": "0",
+	}))
+
+	expectGoAway(t, c, ProtocolError)
+}
+
+func TestStreamByteCounters(t *testing.T) {
+	var received, sent int64
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				strm := StreamFromCtx(ctx)
+				atomic.StoreInt64(&received, strm.BytesReceived())
+
+				ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+					w.Write(bytes.Repeat([]byte("b"), 1<<15))
+					w.Flush()
+
+					// the stream body is sent by another goroutine, but the
+					// stream isn't ended until this function returns.
+					for deadline := time.Now().Add(time.Second); strm.BytesSent() < 1<<15 && time.Now().Before(deadline); {
+						time.Sleep(time.Millisecond)
+					}
+
+					atomic.StoreInt64(&sent, strm.BytesSent())
+				})
+			},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	c.writeFrame(makeHeaders(1, c.enc, true, false, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "POST",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}))
+
+	for i := 0; i < 3; i++ {
+		if err := writeData(c.bw, 1, bytes.Repeat([]byte("a"), 1000), i == 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.bw.Flush()
+
+	if body := readResponseBody(t, c, 1); len(body) != 1<<15 {
+		t.Fatalf("unexpected body size %d", len(body))
+	}
+
+	if n := atomic.LoadInt64(&received); n != 3000 {
+		t.Fatalf("expected 3000 bytes received, got %d", n)
+	}
+
+	if n := atomic.LoadInt64(&sent); n != 1<<15 {
+		t.Fatalf("expected %d bytes sent, got %d", 1<<15, n)
+	}
+}
+
+func TestServerPush(t *testing.T) {
+	for _, workers := range []int{0, 4} {
+		testServerPush(t, workers)
+	}
+}
+
+func testServerPush(t *testing.T, workers int) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				if string(ctx.Path()) == "/style.css" {
+					ctx.SetContentType("text/css")
+					ctx.WriteString("body{}")
+					return
+				}
+
+				err := StreamFromCtx(ctx).Push("GET", "/style.css", map[string][]byte{
+					"Accept": []byte("text/css"),
+				})
+				if err != nil {
+					ctx.WriteString(err.Error())
+					return
+				}
+
+				ctx.WriteString("<html></html>")
+			},
+		},
+		cnf: ServerConfig{
+			MaxHandlerWorkers: workers,
+		},
+	}
+
+	s.cnf.defaults()
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go serve(s, ln)
+
+	for _, push := range []bool{true, false} {
+		nc, err := ln.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := NewConn(nc, ConnOpts{})
+		c.current.SetPush(push)
+
+		if err := c.doHandshake(); err != nil {
+			t.Fatal(err)
+		}
+
+		c.writeFrame(makeHeaders(1, c.enc, true, true, map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    "GET",
+			string(StringPath):      "/",
+			string(StringScheme):    "https",
+		}))
+
+		if !push {
+			if body := readResponseBody(t, c, 1); string(body) != ErrPushDisabled.Error() {
+				t.Fatalf("unexpected body %q", body)
+			}
+
+			c.Close()
+
+			continue
+		}
+
+		var promised uint32
+		fields := map[string]string{}
+
+		for promised == 0 {
+			fr, err := c.readNext()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fr.Type() != FramePushPromise {
+				t.Fatalf("unexpected %s frame", fr.Type())
+			}
+
+			pp := fr.Body().(*PushPromise)
+			if fr.Stream() != 1 || !fr.Flags().Has(FlagEndHeaders) {
+				t.Fatalf("unexpected %s on stream %d", pp, fr.Stream())
+			}
+
+			promised = pp.Stream()
+
+			hf := AcquireHeaderField()
+
+			for b := pp.Headers(); len(b) > 0; {
+				b, err = c.dec.Next(hf, b)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				fields[hf.Key()] = hf.Value()
+			}
+
+			ReleaseHeaderField(hf)
+			ReleaseFrameHeader(fr)
+		}
+
+		if promised != 2 {
+			t.Fatalf("expected the promised stream 2, got %d", promised)
+		}
+
+		for k, v := range map[string]string{
+			":method":    "GET",
+			":scheme":    "https",
+			":authority": "localhost",
+			":path":      "/style.css",
+			"accept":     "text/css",
+		} {
+			if fields[k] != v {
+				t.Fatalf("expected %s: %s, got %q", k, v, fields[k])
+			}
+		}
+
+		if body := readResponseBody(t, c, 1); string(body) != "<html></html>" {
+			t.Fatalf("unexpected body %q", body)
+		}
+
+		if body := readResponseBody(t, c, 2); string(body) != "body{}" {
+			t.Fatalf("unexpected pushed body %q", body)
+		}
+
+		c.Close()
+	}
+}
+
+func TestServerSetPingInterval(t *testing.T) {
+	const interval = 20 * time.Millisecond
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				if !SetPingInterval(ctx, interval) {
+					ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+				}
+			},
+		},
+		cnf: ServerConfig{
+			PingInterval: time.Hour,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	start := time.Now()
+
+	c.writeFrame(makeHeaders(1, c.enc, true, true, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}))
+
+	for pings := 0; pings < 3; {
+		fr, err := ReadFrameFrom(c.br)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch fr.Type() {
+		case FramePing:
+			pings++
+		case FrameHeaders:
+			if fr.Stream() != 1 {
+				t.Fatalf("unexpected HEADERS on stream %d", fr.Stream())
+			}
+
+			hf := AcquireHeaderField()
+
+			if _, err := c.dec.Next(hf, fr.Body().(*Headers).Headers()); err != nil {
+				t.Fatal(err)
+			}
+
+			if hf.Value() != "200" {
+				t.Fatalf("unexpected status %s", hf.Value())
+			}
+
+			ReleaseHeaderField(hf)
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+
+	if elapsed := time.Since(start); elapsed < 3*interval || elapsed > time.Second {
+		t.Fatalf("expected 3 pings every %s, got them in %s", interval, elapsed)
+	}
+}
+
+func TestServeConnH2C(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{},
+	}
+	s.cnf.defaults()
+
+	s.s.Handler = s.H2CUpgrade(func(ctx *fasthttp.RequestCtx) {
+		fmt.Fprintf(ctx, "%s %s %s", ctx.Request.Header.Protocol(), ctx.Request.URI().Scheme(), ctx.Path())
+	})
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.ServeConnH2C(c)
+		}
+	}()
+
+	request := map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringScheme):    "http",
+	}
+
+	t.Run("PriorKnowledge", func(t *testing.T) {
+		nc, err := ln.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := NewConn(nc, ConnOpts{})
+		defer c.Close()
+
+		if err := c.doHandshake(); err != nil {
+			t.Fatal(err)
+		}
+
+		request[string(StringPath)] = "/prior"
+		c.writeFrame(makeHeaders(1, c.enc, true, true, request))
+
+		if body := readResponseBody(t, c, 1); string(body) != "HTTP/2 http /prior" {
+			t.Fatalf("unexpected body %q", body)
+		}
+	})
+
+	t.Run("Upgrade", func(t *testing.T) {
+		nc, err := ln.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		st := &Settings{}
+		st.Reset()
+
+		fmt.Fprintf(nc, "GET /upgrade HTTP/1.1\r\nHost: localhost\r\n"+
+			"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: %s\r\n\r\n",
+			EncodeSettingsBase64(st))
+
+		// the server only sends its SETTINGS after receiving the preface,
+		// so the reader doesn't buffer the HTTP/2 frames.
+		br := bufio.NewReader(nc)
+
+		var res fasthttp.ResponseHeader
+		if err := res.Read(br); err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode() != fasthttp.StatusSwitchingProtocols || string(res.Peek("Upgrade")) != "h2c" {
+			t.Fatalf("unexpected response:\n%s", res.Header())
+		}
+
+		c := NewConn(nc, ConnOpts{})
+		defer c.Close()
+
+		if err := c.doHandshake(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the upgrade request is served as the stream 1.
+		if body := readResponseBody(t, c, 1); string(body) != "HTTP/2 http /upgrade" {
+			t.Fatalf("unexpected body %q", body)
+		}
+
+		request[string(StringPath)] = "/next"
+		c.writeFrame(makeHeaders(3, c.enc, true, true, request))
+
+		if body := readResponseBody(t, c, 3); string(body) != "HTTP/2 http /next" {
+			t.Fatalf("unexpected body %q", body)
+		}
+	})
+
+	t.Run("HTTP1", func(t *testing.T) {
+		nc, err := ln.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer nc.Close()
+
+		fmt.Fprintf(nc, "GET /http1 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+		var res fasthttp.Response
+		if err := res.Read(bufio.NewReader(nc)); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(res.Body()) != "HTTP/1.1 http /http1" {
+			t.Fatalf("unexpected body %q", res.Body())
+		}
+	})
+}
+
+func TestPrefaceSettingsAck(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+		},
+	}
+	s.cnf.defaults()
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go serve(s, ln)
+
+	nc, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConn(nc, ConnOpts{})
+	defer c.Close()
+
+	if err := WritePreface(c.bw); err != nil {
+		t.Fatal(err)
+	}
+
+	// the SETTINGS of the preface can't be an acknowledgement.
+	fr := AcquireFrameHeader()
+
+	st := AcquireFrame(FrameSettings).(*Settings)
+	st.SetAck(true)
+	fr.SetBody(st)
+
+	if err := c.writeFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	ReleaseFrameHeader(fr)
+
+	expectGoAway(t, c, ProtocolError)
+}
+
+func TestResponseDataFrameSize(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.Write(bytes.Repeat([]byte("a"), 40000))
+			},
+		},
+	}
+	s.cnf.defaults()
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go serve(s, ln)
+
+	nc, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConn(nc, ConnOpts{})
+	defer c.Close()
+
+	c.current.SetMaxFrameSize(1 << 15)
+
+	if err := c.doHandshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.writeFrame(makeHeaders(1, c.enc, true, true, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}))
+
+	var sizes []int
+
+	for end := false; !end; {
+		fr, err := c.readNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.Type() == FrameData {
+			sizes = append(sizes, fr.Len())
+		}
+
+		end = fr.Flags().Has(FlagEndStream)
+		ReleaseFrameHeader(fr)
+	}
+
+	if len(sizes) != 2 || sizes[0] != 1<<15 || sizes[1] != 40000-1<<15 {
+		t.Fatalf("unexpected DATA frame sizes %v", sizes)
+	}
+}
+
+func TestResponseFlowControl(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// release makes the rest of the response fit in the client's windows.
+		release func(c *Conn)
+	}{
+		{"WindowUpdate", func(c *Conn) {
+			fr := AcquireFrameHeader()
+			fr.SetStream(1)
+
+			wu := AcquireFrame(FrameWindowUpdate).(*WindowUpdate)
+			wu.SetIncrement(4000)
+			fr.SetBody(wu)
+
+			_ = c.writeFrame(fr)
+			ReleaseFrameHeader(fr)
+		}},
+		{"Settings", func(c *Conn) {
+			fr := AcquireFrameHeader()
+
+			st := AcquireFrame(FrameSettings).(*Settings)
+			c.current.CopyTo(st)
+			st.SetMaxWindowSize(5000)
+			fr.SetBody(st)
+
+			_ = c.writeFrame(fr)
+			ReleaseFrameHeader(fr)
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Server{
+				s: &fasthttp.Server{
+					Handler: func(ctx *fasthttp.RequestCtx) {
+						ctx.Write(bytes.Repeat([]byte("a"), 5000))
+					},
+				},
+			}
+			s.cnf.defaults()
+
+			ln := fasthttputil.NewInmemoryListener()
+			defer ln.Close()
+
+			go serve(s, ln)
+
+			nc, err := ln.Dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := NewConn(nc, ConnOpts{})
+			defer c.Close()
+
+			c.current.SetMaxWindowSize(1000)
+
+			if err := c.doHandshake(); err != nil {
+				t.Fatal(err)
+			}
+
+			c.writeFrame(makeHeaders(1, c.enc, true, true, map[string]string{
+				string(StringAuthority): "localhost",
+				string(StringMethod):    "GET",
+				string(StringPath):      "/",
+				string(StringScheme):    "https",
+			}))
+
+			received := 0
+
+			for received < 1000 {
+				fr, err := c.readNext()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if fr.Type() == FrameData {
+					received += fr.Len()
+				}
+
+				ReleaseFrameHeader(fr)
+			}
+
+			if received > 1000 {
+				t.Fatalf("received %d bytes above the stream's window of 1000", received)
+			}
+
+			// the server can't send more DATA before the PING's ack.
+			fr := AcquireFrameHeader()
+			fr.SetBody(AcquireFrame(FramePing))
+
+			if err := c.writeFrame(fr); err != nil {
+				t.Fatal(err)
+			}
+
+			ReleaseFrameHeader(fr)
+
+			for acked := false; !acked; {
+				// readNext handles the pings, so the frames are read directly.
+				fr, err := ReadFrameFrom(c.br)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if fr.Type() == FrameData {
+					t.Fatalf("received %d bytes above the stream's window", fr.Len())
+				}
+
+				acked = fr.Type() == FramePing && fr.Body().(*Ping).IsAck()
+				ReleaseFrameHeader(fr)
+			}
+
+			test.release(c)
+
+			for end := false; !end; {
+				fr, err := c.readNext()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if fr.Type() == FrameData {
+					received += fr.Len()
+				}
+
+				end = fr.Flags().Has(FlagEndStream)
+				ReleaseFrameHeader(fr)
+			}
+
+			if received != 5000 {
+				t.Fatalf("expected 5000 bytes, got %d", received)
+			}
+		})
+	}
+}
+
+func TestStripHopByHopHeaders(t *testing.T) {
+	var h fasthttp.RequestHeader
+
+	h.SetMethod("GET")
+	h.SetRequestURI("/")
+	h.SetHost("localhost")
+	h.Set(fasthttp.HeaderConnection, "X-Hop, keep-alive")
+	h.Set("X-Hop", "1")
+	h.Set(fasthttp.HeaderKeepAlive, "timeout=5")
+	h.Set("Proxy-Connection", "keep-alive")
+	h.Set(fasthttp.HeaderProxyAuthorization, "Basic Zm9vOmJhcg==")
+	h.Set(fasthttp.HeaderTE, "gzip, trailers")
+	h.Set(fasthttp.HeaderTrailer, "X-Checksum")
+	h.Set(fasthttp.HeaderUpgrade, "websocket")
+	h.Set(fasthttp.HeaderAccept, "text/plain")
+	h.Set("X-End-To-End", "1")
+
+	StripHopByHopHeaders(&h)
+
+	for _, k := range []string{
+		fasthttp.HeaderConnection, "X-Hop", fasthttp.HeaderKeepAlive, "Proxy-Connection",
+		fasthttp.HeaderProxyAuthorization, fasthttp.HeaderTrailer, fasthttp.HeaderUpgrade,
+	} {
+		if v := h.Peek(k); len(v) > 0 {
+			t.Errorf("expected %s to be removed, got %q", k, v)
+		}
+	}
+
+	for k, expected := range map[string]string{
+		fasthttp.HeaderTE:     "trailers",
+		fasthttp.HeaderAccept: "text/plain",
+		"X-End-To-End":        "1",
+		fasthttp.HeaderHost:   "localhost",
+	} {
+		if v := string(h.Peek(k)); v != expected {
+			t.Errorf("expected %s: %s, got %q", k, expected, v)
+		}
+	}
+}
+
+func TestCoalesceDataFrames(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+					for i := 0; i < 1000; i++ {
+						w.WriteByte('a')
+						w.Flush()
+					}
+				})
+			},
+		},
+		cnf: ServerConfig{
+			CoalesceDataFrames: true,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	c.writeFrame(makeHeaders(1, c.enc, true, true, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}))
+
+	frames, received := 0, 0
+
+	for end := false; !end; {
+		fr, err := c.readNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.Type() == FrameData {
+			frames++
+			received += fr.Len()
+		}
+
+		end = fr.Flags().Has(FlagEndStream)
+		ReleaseFrameHeader(fr)
+	}
+
+	if received != 1000 {
+		t.Fatalf("expected 1000 bytes, got %d", received)
+	}
+
+	// the handler keeps writing, so the flushes don't make the frames smaller.
+	if frames >= 100 {
+		t.Fatalf("expected far fewer DATA frames than writes, got %d", frames)
+	}
+}
+
+func TestCoalesceDataFramesFlush(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+					w.WriteString("event")
+					w.Flush()
+
+					<-unblock
+				})
+			},
+		},
+		cnf: ServerConfig{
+			CoalesceDataFrames: true,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	c.writeFrame(makeHeaders(1, c.enc, true, true, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}))
+
+	data := make(chan []byte, 1)
+	go func() {
+		for {
+			fr, err := c.readNext()
+			if err != nil {
+				close(data)
+				return
+			}
+
+			if fr.Type() == FrameData {
+				data <- append([]byte(nil), fr.Body().(*Data).Data()...)
+				ReleaseFrameHeader(fr)
+				return
+			}
+
+			ReleaseFrameHeader(fr)
+		}
+	}()
+
+	// the handler is still writing, but the flushed data must be sent.
+	select {
+	case b := <-data:
+		if string(b) != "event" {
+			t.Fatalf("unexpected data: %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the flushed data was not sent")
+	}
+}
+
+func TestCoalesceDataFramesShortBody(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+					w.WriteString("short")
+				})
+				ctx.Response.Header.SetContentLength(100)
+			},
+		},
+		cnf: ServerConfig{
+			CoalesceDataFrames: true,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	c.writeFrame(makeHeaders(1, c.enc, true, true, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}))
+
+	// the data buffered when the body ends before its Content-Length is not dropped.
+	if body := readResponseBody(t, c, 1); string(body) != "short" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
+
+func TestConnectionFramesOnStream(t *testing.T) {
+	for _, body := range []Frame{
+		AcquireFrame(FrameSettings),
+		AcquireFrame(FrameGoAway),
+	} {
+		t.Run(body.Type().String(), func(t *testing.T) {
+			s := &Server{
+				s: &fasthttp.Server{
+					Handler: func(ctx *fasthttp.RequestCtx) {},
+				},
+			}
+
+			c, ln, err := getConn(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			defer ln.Close()
+
+			fr := AcquireFrameHeader()
+			fr.SetStream(1)
+			fr.SetBody(body)
+
+			if err := c.writeFrame(fr); err != nil {
+				t.Fatal(err)
+			}
+
+			ReleaseFrameHeader(fr)
+
+			expectGoAway(t, c, ProtocolError)
+		})
+	}
+}
+
+func TestIndexedResponseHeaders(t *testing.T) {
+	const sts = "max-age=63072000; includeSubDomains; preload"
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.Response.Header.Set("Strict-Transport-Security", sts)
+				ctx.Response.Header.Set("X-Frame-Options", "DENY")
+			},
+		},
+		cnf: ServerConfig{
+			IndexedResponseHeaders: []string{"Strict-Transport-Security", "x-frame-options"},
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	hf := AcquireHeaderField()
+	defer ReleaseHeaderField(hf)
+
+	var sizes []int
+
+	for id := uint32(1); id <= 3; id += 2 {
+		c.writeFrame(makeHeaders(id, c.enc, true, true, map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    "GET",
+			string(StringPath):      "/",
+			string(StringScheme):    "https",
+		}))
+
+		for {
+			fr, err := c.readNext()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fr.Type() != FrameHeaders {
+				ReleaseFrameHeader(fr)
+				continue
+			}
+
+			b := fr.Body().(*Headers).Headers()
+			sizes = append(sizes, len(b))
+
+			// the client's decoder must resolve the indexes sent by the server.
+			found := 0
+
+			for len(b) > 0 {
+				b, err = c.dec.Next(hf, b)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				switch hf.Key() {
+				case "strict-transport-security":
+					if hf.Value() != sts {
+						t.Fatalf("unexpected %s: %q", hf.Key(), hf.Value())
+					}
+					found++
+				case "x-frame-options":
+					if hf.Value() != "DENY" {
+						t.Fatalf("unexpected %s: %q", hf.Key(), hf.Value())
+					}
+					found++
+				}
+			}
+
+			ReleaseFrameHeader(fr)
+
+			if found != 2 {
+				t.Fatalf("expected 2 indexed fields, got %d", found)
+			}
+
+			break
+		}
+	}
+
+	// the second response sends the fields as indexes of the dynamic table.
+	if sizes[1] >= sizes[0]-len(sts)/2 {
+		t.Fatalf("the second response wasn't compressed: %d bytes, the first %d", sizes[1], sizes[0])
+	}
+}
+
+func TestRapidReset(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+		},
+		cnf: ServerConfig{
+			MaxResetsPerMinute: 10,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	go func() {
+		for id := uint32(1); id < 100; id += 2 {
+			// the streams are reset before sending the request body.
+			c.writeFrame(makeHeaders(id, c.enc, true, false, map[string]string{
+				string(StringAuthority): "localhost",
+				string(StringMethod):    "POST",
+				string(StringPath):      "/",
+				string(StringScheme):    "https",
+			}))
+
+			fr := AcquireFrameHeader()
+			fr.SetStream(id)
+
+			rst := AcquireFrame(FrameResetStream).(*RstStream)
+			rst.SetCode(StreamCanceled)
+			fr.SetBody(rst)
+
+			err := c.writeFrame(fr)
+			ReleaseFrameHeader(fr)
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		fr, err := c.readNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ga, ok := fr.Body().(*GoAway)
+		if ok {
+			if ga.Code() != EnhanceYourCalm {
+				t.Fatalf("unexpected GOAWAY: %s", ga.Code())
+			}
+
+			// the 11th stream exceeds the limit.
+			if ga.Stream() != 21 {
+				t.Fatalf("expected the GOAWAY on the stream 21, got %d", ga.Stream())
+			}
+
+			ReleaseFrameHeader(fr)
+
+			break
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+}
+
+func TestServerMaxConnAge(t *testing.T) {
+	release := make(chan struct{})
+
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				<-release
+				ctx.WriteString("done")
+			},
+		},
+		cnf: ServerConfig{
+			MaxConnAge:        time.Millisecond * 100,
+			MaxHandlerWorkers: 4,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	c.writeFrame(makeHeaders(1, c.enc, true, true, map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}))
+
+	fr, err := c.readNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ga, ok := fr.Body().(*GoAway)
+	if !ok {
+		t.Fatalf("expected a GOAWAY, got %s", fr.Type())
+	}
+
+	// the stream in flight is not affected.
+	if ga.Code() != NoError || ga.Stream() != 1 {
+		t.Fatalf("unexpected GOAWAY: %s", ga)
+	}
+
+	ReleaseFrameHeader(fr)
+	close(release)
+
+	var body []byte
+
+	for {
+		fr, err := c.readNext()
+		if err != nil {
+			break
+		}
+
+		if fr.Type() == FrameData {
+			body = append(body, fr.Body().(*Data).Data()...)
+		}
+
+		ReleaseFrameHeader(fr)
+	}
+
+	if string(body) != "done" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestMaxHeaderListSize(t *testing.T) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				ctx.Write(ctx.Request.Header.Peek("X-Big"))
+			},
+		},
+		cnf: ServerConfig{
+			MaxHeaderListSize: 4096,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	hs := map[string]string{
+		string(StringAuthority): "localhost",
+		string(StringMethod):    "GET",
+		string(StringPath):      "/",
+		string(StringScheme):    "https",
+	}
+
+	hf := AcquireHeaderField()
+	defer ReleaseHeaderField(hf)
+
+	fr := makeHeaders(1, c.enc, true, true, hs)
+
+	value := strings.Repeat("a", 2000)
+	hf.Set("x-big", value)
+	c.enc.AppendHeaderField(fr.Body().(*Headers), hf, false)
+
+	c.writeFrame(fr)
+
+	if body := readResponseBody(t, c, 1); string(body) != value {
+		t.Fatalf("unexpected body of %d bytes", len(body))
+	}
+
+	// a field much larger than the limit is split in CONTINUATION frames.
+	go func() {
+		c.writeFrame(makeHeaders(3, c.enc, false, true, hs))
+
+		hf.Set("x-big", strings.Repeat("a", 1<<20))
+		b := c.enc.AppendHeader(nil, hf, false)
+
+		for len(b) > 0 {
+			n := len(b)
+			if n > 1<<14 {
+				n = 1 << 14
+			}
+
+			fr := AcquireFrameHeader()
+			fr.SetStream(3)
+
+			cont := AcquireFrame(FrameContinuation).(*Continuation)
+			cont.SetHeader(b[:n])
+			cont.SetEndHeaders(n == len(b))
+
+			fr.SetBody(cont)
+
+			err := c.writeFrame(fr)
+			ReleaseFrameHeader(fr)
+
+			if err != nil {
+				return
+			}
+
+			b = b[n:]
+		}
+	}()
+
+	expectGoAway(t, c, EnhanceYourCalm)
+}
+
+func TestContinuationFlood(t *testing.T) {
+	// the CONTINUATION frames are limited even if the header list size isn't.
+	for _, size := range []int{0, -1} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			testContinuationFlood(t, size)
+		})
+	}
+}
+
+func testContinuationFlood(t *testing.T, maxHeaderListSize int) {
+	s := &Server{
+		s: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {},
+		},
+		cnf: ServerConfig{
+			MaxHeaderListSize: maxHeaderListSize,
+		},
+	}
+
+	c, ln, err := getConn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer ln.Close()
+
+	// the empty CONTINUATION frames never end the headers. With the default header list size
+	// the server allows 73 CONTINUATION frames per block.
+	go func() {
+		c.writeFrame(makeHeaders(1, c.enc, false, true, map[string]string{
+			string(StringAuthority): "localhost",
+			string(StringMethod):    "GET",
+			string(StringPath):      "/",
+			string(StringScheme):    "https",
+		}))
+
+		for i := 0; i < 100; i++ {
+			fr := AcquireFrameHeader()
+			fr.SetStream(1)
+			fr.SetBody(AcquireFrame(FrameContinuation))
+
+			err := c.writeFrame(fr)
+			ReleaseFrameHeader(fr)
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	expectGoAway(t, c, EnhanceYourCalm)
+}
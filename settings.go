@@ -1,5 +1,11 @@
 package http2
 
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
 const FrameSettings FrameType = 0x4
 
 var _ Frame = &Settings{}
@@ -22,6 +28,9 @@ const (
 	MaxWindowSize        uint16 = 0x4
 	MaxFrameSize         uint16 = 0x5
 	MaxHeaderListSize    uint16 = 0x6
+
+	// EnableConnectProtocol is defined in RFC 8441 (https://www.rfc-editor.org/rfc/rfc8441#section-3)
+	EnableConnectProtocol uint16 = 0x8
 )
 
 // Settings is the options to establish between endpoints
@@ -37,6 +46,8 @@ type Settings struct {
 	windowSize  uint32
 	frameSize   uint32
 	headerSize  uint32
+
+	connectProtocol bool
 }
 
 func (st *Settings) Type() FrameType {
@@ -52,6 +63,7 @@ func (st *Settings) Reset() {
 	st.frameSize = defaultDataFrameSize
 	st.enablePush = false
 	st.headerSize = 0
+	st.connectProtocol = false
 	st.rawSettings = st.rawSettings[:0]
 	st.ack = false
 }
@@ -66,6 +78,15 @@ func (st *Settings) CopyTo(st2 *Settings) {
 	st2.windowSize = st.windowSize
 	st2.frameSize = st.frameSize
 	st2.headerSize = st.headerSize
+	st2.connectProtocol = st.connectProtocol
+}
+
+// applyTo updates st2 with the parameters received in st.
+//
+// Unlike CopyTo, the parameters that were not included in the frame
+// keep the values set by the previous SETTINGS frames.
+func (st *Settings) applyTo(st2 *Settings) {
+	_ = st2.Read(st.rawSettings)
 }
 
 // SetHeaderTableSize sets the maximum size of the header
@@ -162,6 +183,19 @@ func (st *Settings) MaxHeaderListSize() uint32 {
 	return st.headerSize
 }
 
+// SetConnectProtocol sets SETTINGS_ENABLE_CONNECT_PROTOCOL.
+//
+// If value is true the peer is allowed to use the extended CONNECT method (RFC 8441),
+// like for bootstrapping WebSockets over HTTP/2.
+func (st *Settings) SetConnectProtocol(value bool) {
+	st.connectProtocol = value
+}
+
+// ConnectProtocol returns whether the extended CONNECT method (RFC 8441) is enabled.
+func (st *Settings) ConnectProtocol() bool {
+	return st.connectProtocol
+}
+
 // Read reads from d and decodes the read values into st.
 func (st *Settings) Read(d []byte) error {
 	var b []byte
@@ -197,6 +231,11 @@ func (st *Settings) Read(d []byte) error {
 			st.frameSize = value
 		case MaxHeaderListSize:
 			st.headerSize = value
+		case EnableConnectProtocol:
+			if value != 0 && value != 1 {
+				return NewGoAwayError(ProtocolError, "wrong value for SETTINGS_ENABLE_CONNECT_PROTOCOL")
+			}
+			st.connectProtocol = value != 0
 		}
 
 		last = i
@@ -217,13 +256,17 @@ func (st *Settings) Encode() {
 		)
 	}
 
+	// SETTINGS_ENABLE_PUSH is always sent, as its initial value is 1 (RFC 7540, section 6.5.2).
+	push := byte(0)
 	if st.enablePush {
-		st.rawSettings = append(st.rawSettings,
-			byte(EnablePush>>8), byte(EnablePush),
-			0, 0, 0, 1,
-		)
+		push = 1
 	}
 
+	st.rawSettings = append(st.rawSettings,
+		byte(EnablePush>>8), byte(EnablePush),
+		0, 0, 0, push,
+	)
+
 	if st.maxStreams != 0 {
 		st.rawSettings = append(st.rawSettings,
 			byte(MaxConcurrentStreams>>8), byte(MaxConcurrentStreams),
@@ -255,6 +298,13 @@ func (st *Settings) Encode() {
 			byte(st.headerSize>>8), byte(st.headerSize),
 		)
 	}
+
+	if st.connectProtocol {
+		st.rawSettings = append(st.rawSettings,
+			byte(EnableConnectProtocol>>8), byte(EnableConnectProtocol),
+			0, 0, 0, 1,
+		)
+	}
 }
 
 // IsAck returns true if settings has FlagAck set.
@@ -267,6 +317,54 @@ func (st *Settings) SetAck(ack bool) {
 	st.ack = ack
 }
 
+// String returns a readable representation of the settings, meant for debugging.
+func (st *Settings) String() string {
+	if st.ack {
+		return "SETTINGS[ACK]"
+	}
+
+	return fmt.Sprintf(
+		"SETTINGS[HeaderTableSize=%d EnablePush=%v MaxConcurrentStreams=%d InitialWindowSize=%d MaxFrameSize=%d MaxHeaderListSize=%d EnableConnectProtocol=%v]",
+		st.tableSize, st.enablePush, st.maxStreams, st.windowSize, st.frameSize, st.headerSize, st.connectProtocol,
+	)
+}
+
+// EncodeSettingsBase64 returns the payload of the SETTINGS frame of `st` encoded
+// as the value of the HTTP2-Settings header, used to upgrade an HTTP/1.1 connection to h2c.
+//
+// https://tools.ietf.org/html/rfc7540#section-3.2.1
+func EncodeSettingsBase64(st *Settings) string {
+	st.Encode()
+
+	return base64.RawURLEncoding.EncodeToString(st.rawSettings)
+}
+
+// DecodeSettingsBase64 decodes the value of an HTTP2-Settings header.
+//
+// The parameters not present in `s` keep their default values.
+func DecodeSettingsBase64(s string) (*Settings, error) {
+	// the padding must be omitted, but some clients might still send it.
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b)%6 != 0 {
+		return nil, NewGoAwayError(FrameSizeError, "wrong payload for settings")
+	}
+
+	st := &Settings{}
+	st.Reset()
+
+	if err := st.Read(b); err != nil {
+		return nil, err
+	}
+
+	st.rawSettings = append(st.rawSettings[:0], b...)
+
+	return st, nil
+}
+
 func (st *Settings) Deserialize(fr *FrameHeader) error {
 	if len(fr.payload)%6 != 0 {
 		return NewGoAwayError(FrameSizeError, "wrong payload for settings")
@@ -278,6 +376,9 @@ func (st *Settings) Deserialize(fr *FrameHeader) error {
 		return NewGoAwayError(FrameSizeError, "settings with ack and payload")
 	}
 
+	// keep the parameters as received, in order, to be applied by applyTo.
+	st.rawSettings = append(st.rawSettings[:0], fr.payload...)
+
 	return st.Read(fr.payload)
 }
 
@@ -1,7 +1,9 @@
 package http2
 
 import (
+	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/valyala/fasthttp"
@@ -35,8 +37,15 @@ func (ss StreamState) String() string {
 }
 
 type Stream struct {
-	id                  uint32
-	window              int64
+	id     uint32
+	window int64
+
+	// bytesReceived and bytesSent count the bytes of the request and response bodies.
+	bytesReceived int64
+	bytesSent     int64
+
+	// recvWindow is the number of bytes the client can send on the stream.
+	recvWindow          int32
 	state               StreamState
 	ctx                 *fasthttp.RequestCtx
 	scheme              []byte
@@ -44,11 +53,47 @@ type Stream struct {
 
 	// keeps track of the number of header blocks received
 	headerBlockNum int
+	// headerListSize is the size of the header list being received, see ServerConfig.MaxHeaderListSize.
+	headerListSize int
+	// headerBlockSize and continuations count the bytes and the CONTINUATION frames of the header block being received.
+	headerBlockSize int
+	continuations   int
 
 	// original type
 	origType        FrameType
 	startedAt       time.Time
 	headersFinished bool
+
+	// acceptTrailers is set when the client sent `te: trailers`.
+	acceptTrailers bool
+
+	// inTrailers is set while the trailer block sent after the request body is received.
+	inTrailers bool
+
+	// pseudoHeaders keeps track of the pseudo-header fields received.
+	pseudoHeaders uint8
+
+	// methodErr is set when the server doesn't accept the request method,
+	// so the request is answered with 405 without calling the handler.
+	methodErr error
+
+	// protocol is the value of the :protocol pseudo-header of the extended CONNECT requests.
+	protocol []byte
+
+	// cookies joins the cookie fields received, as they can be split in HTTP/2.
+	cookies []byte
+
+	// handling is set while the handler is processing the request in a worker.
+	handling bool
+
+	// done is closed when the stream reaches the closed state.
+	done chan struct{}
+
+	// sc is the server connection of the stream, used to push the responses.
+	sc *serverConn
+	// pushed contains the streams promised by the handler, which are
+	// handled once the handler returns.
+	pushed []*Stream
 }
 
 var streamPool = sync.Pool{
@@ -61,6 +106,8 @@ func NewStream(id uint32, win int32) *Stream {
 	strm := streamPool.Get().(*Stream)
 	strm.id = id
 	strm.window = int64(win)
+	strm.bytesReceived = 0
+	strm.bytesSent = 0
 	strm.state = StreamStateIdle
 	strm.headersFinished = false
 	strm.startedAt = time.Time{}
@@ -69,6 +116,19 @@ func NewStream(id uint32, win int32) *Stream {
 	strm.scheme = []byte("https")
 	strm.origType = 0
 	strm.headerBlockNum = 0
+	strm.headerListSize = 0
+	strm.headerBlockSize = 0
+	strm.continuations = 0
+	strm.acceptTrailers = false
+	strm.inTrailers = false
+	strm.pseudoHeaders = 0
+	strm.methodErr = nil
+	strm.cookies = strm.cookies[:0]
+	strm.protocol = strm.protocol[:0]
+	strm.handling = false
+	strm.done = make(chan struct{})
+	strm.sc = nil
+	strm.pushed = strm.pushed[:0]
 
 	return strm
 }
@@ -86,9 +146,94 @@ func (s *Stream) State() StreamState {
 }
 
 func (s *Stream) SetState(state StreamState) {
+	if state == StreamStateClosed && s.state != StreamStateClosed {
+		close(s.done)
+	}
+
 	s.state = state
 }
 
+// Done returns a channel that is closed when the stream is closed,
+// either because the response has been sent, the client reset the stream
+// or the connection has been closed.
+//
+// The handlers only run concurrently with the stream processing
+// when ServerConfig.MaxHandlerWorkers is set.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Protocol returns the value of the :protocol pseudo-header of an extended CONNECT request (RFC 8441),
+// or nil if the request doesn't have it.
+//
+// The :protocol pseudo-header is only accepted if ServerConfig.EnableConnectProtocol is set.
+func (s *Stream) Protocol() []byte {
+	if len(s.protocol) == 0 {
+		return nil
+	}
+
+	return s.protocol
+}
+
+// BytesReceived returns the number of bytes of the request body received so far.
+func (s *Stream) BytesReceived() int64 {
+	return atomic.LoadInt64(&s.bytesReceived)
+}
+
+// BytesSent returns the number of bytes of the response body queued to be sent so far.
+//
+// The body set with ctx.SetBody is only sent once the handler returns,
+// but the bodies written by a fasthttp.StreamWriter are counted as they are written.
+func (s *Stream) BytesSent() int64 {
+	return atomic.LoadInt64(&s.bytesSent)
+}
+
+// Errors returned by Stream.Push.
+var (
+	ErrPushDisabled     = errors.New("the client disabled the server push")
+	ErrPushLimit        = errors.New("the client's limit of concurrent streams has been reached")
+	ErrPushNotCacheable = errors.New("the pushed requests must be GET or HEAD")
+)
+
+// Push promises the response of a `method` request to `path` to the client,
+// sending a PUSH_PROMISE frame on the stream. The request is built using
+// the authority and scheme of the stream's request, and the fields in `header`.
+//
+// Once the handler returns, the promised request is served by the server's handler
+// on a new stream, as any other request. The handlers of the pushed requests can't push.
+//
+// Push fails if the client disabled the push with SETTINGS_ENABLE_PUSH,
+// or if the pushed streams reached the client's SETTINGS_MAX_CONCURRENT_STREAMS.
+func (s *Stream) Push(method, path string, header map[string][]byte) error {
+	if s.sc == nil {
+		return ErrPushDisabled
+	}
+
+	return s.sc.push(s, method, path, header)
+}
+
+// closed reports whether the stream reached the closed state.
+// Unlike State, it can be called from the handlers' goroutines.
+func (s *Stream) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// streamKey is the user value key under which the Stream is stored in the fasthttp.RequestCtx.
+type streamKey struct{}
+
+// StreamFromCtx returns the Stream serving `ctx`, or nil if the request wasn't received over HTTP/2.
+//
+// The Stream must not be used after the handler returns.
+func StreamFromCtx(ctx *fasthttp.RequestCtx) *Stream {
+	strm, _ := ctx.UserValue(streamKey{}).(*Stream)
+	return strm
+}
+
 func (s *Stream) Window() int32 {
 	return int32(s.window)
 }
@@ -101,6 +246,12 @@ func (s *Stream) IncrWindow(win int32) {
 	s.window += int64(win)
 }
 
+// AcceptTrailers returns whether the client signaled it accepts
+// trailers by sending the `te: trailers` header.
+func (s *Stream) AcceptTrailers() bool {
+	return s.acceptTrailers
+}
+
 func (s *Stream) Ctx() *fasthttp.RequestCtx {
 	return s.ctx
 }
@@ -1,20 +1,26 @@
 package http2
 
+import "bytes"
+
 var (
 	StringPath          = []byte(":path")
 	StringStatus        = []byte(":status")
 	StringAuthority     = []byte(":authority")
 	StringScheme        = []byte(":scheme")
 	StringMethod        = []byte(":method")
+	StringProtocol      = []byte(":protocol")
 	StringServer        = []byte("server")
 	StringContentLength = []byte("content-length")
 	StringContentType   = []byte("content-type")
 	StringUserAgent     = []byte("user-agent")
+	StringCookie        = []byte("cookie")
 	StringGzip          = []byte("gzip")
 	StringGET           = []byte("GET")
 	StringHEAD          = []byte("HEAD")
 	StringPOST          = []byte("POST")
 	StringHTTP2         = []byte("HTTP/2")
+	StringTE            = []byte("te")
+	StringTrailers      = []byte("trailers")
 )
 
 func ToLower(b []byte) []byte {
@@ -25,9 +31,92 @@ func ToLower(b []byte) []byte {
 	return b
 }
 
+// isToken reports whether `b` is a non-empty token as defined in RFC 7230 section 3.2.6.
+func isToken(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+
+	for _, c := range b {
+		if c >= 0x80 || !tokenChars[c] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isValidPath reports whether `b` doesn't contain spaces nor control characters,
+// which are not allowed in a request target (RFC 3986).
+func isValidPath(b []byte) bool {
+	for _, c := range b {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isAbsoluteForm reports whether the request target `b` is in absolute-form,
+// like http://example.com/path (RFC 7230 section 5.3.2).
+func isAbsoluteForm(b []byte) bool {
+	i := bytes.Index(b, []byte("://"))
+	if i <= 0 || len(b) == i+3 {
+		return false
+	}
+
+	for _, c := range b[:i] {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.') {
+			return false
+		}
+	}
+
+	return true
+}
+
+var tokenChars = func() (t [128]bool) {
+	for c := '0'; c <= '9'; c++ {
+		t[c] = true
+	}
+
+	for c := 'a'; c <= 'z'; c++ {
+		t[c] = true
+		t[c-32] = true
+	}
+
+	for _, c := range "!#$%&'*+-.^_`|~" {
+		t[c] = true
+	}
+
+	return
+}()
+
 const (
 	// H2TLSProto is the string used in ALPN-TLS negotiation.
 	H2TLSProto = "h2"
 	// H2Clean is the string used in HTTP headers by the client to upgrade the connection.
 	H2Clean = "h2c"
 )
+
+// splitAbsoluteForm splits the absolute-form request target `b` into
+// its scheme and authority. `ok` is false if `b` is not in absolute-form.
+func splitAbsoluteForm(b []byte) (scheme, authority []byte, ok bool) {
+	if !isAbsoluteForm(b) {
+		return nil, nil, false
+	}
+
+	i := bytes.Index(b, []byte("://"))
+	scheme, authority = b[:i], b[i+3:]
+
+	if n := bytes.IndexAny(authority, "/?#"); n >= 0 {
+		authority = authority[:n]
+	}
+
+	// the userinfo is not part of the authority sent to the server.
+	if n := bytes.LastIndexByte(authority, '@'); n >= 0 {
+		authority = authority[n+1:]
+	}
+
+	return scheme, authority, true
+}
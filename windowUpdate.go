@@ -1,6 +1,8 @@
 package http2
 
 import (
+	"fmt"
+
 	"github.com/dgrr/http2/http2utils"
 )
 
@@ -17,6 +19,11 @@ func (wu *WindowUpdate) Type() FrameType {
 	return FrameWindowUpdate
 }
 
+// String returns a readable representation of the frame, meant for debugging.
+func (wu *WindowUpdate) String() string {
+	return fmt.Sprintf("WINDOW_UPDATE[Increment=%d]", wu.increment)
+}
+
 func (wu *WindowUpdate) Reset() {
 	wu.increment = 0
 }